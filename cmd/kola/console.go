@@ -34,18 +34,44 @@ var (
 Check console output for expressions matching failure messages logged
 by a Container Linux instance.
 
-If no files are specified as arguments, stdin is checked.
+If no files are specified as arguments, stdin is checked. Checks can
+be added or overridden with a rules file, see --console-rules.
 `}
 
 	checkConsoleVerbose bool
+
+	consoleRulesFile string
 )
 
 func init() {
 	cmdCheckConsole.Flags().BoolVarP(&checkConsoleVerbose, "verbose", "v", false, "output user input prompts")
+	for _, cmd := range []*cobra.Command{cmdCheckConsole, cmdRun} {
+		cmd.Flags().StringVar(&consoleRulesFile, "console-rules", "", "YAML file with console and journal checks to add or override")
+	}
 	root.AddCommand(cmdCheckConsole)
 }
 
+// loadConsoleRules adds the console checks from --console-rules.
+func loadConsoleRules() {
+	if consoleRulesFile == "" {
+		return
+	}
+	if err := kola.LoadConsoleRules(consoleRulesFile); err != nil {
+		fmt.Fprintf(os.Stderr, "loading console rules: %v\n", err)
+		os.Exit(1)
+	}
+}
+
 func runCheckConsole(cmd *cobra.Command, args []string) {
+	loadConsoleRules()
+
+	// checks limited to some platforms only apply if one was chosen,
+	// not for the default of --platform
+	var pltfrm string
+	if root.PersistentFlags().Changed("platform") {
+		pltfrm = kolaPlatform
+	}
+
 	if len(args) == 0 {
 		// default to stdin
 		args = append(args, "-")
@@ -70,10 +96,14 @@ func runCheckConsole(cmd *cobra.Command, args []string) {
 			errors += 1
 			continue
 		}
-		for _, badness := range kola.CheckConsole(console, nil) {
-			fmt.Printf("%v: %v\n", sourceName, badness)
+		badness, warnings := kola.CheckConsole(console, nil, pltfrm)
+		for _, b := range badness {
+			fmt.Printf("%v: %v\n", sourceName, b)
 			errors += 1
 		}
+		for _, w := range warnings {
+			fmt.Printf("%v: warning: %v\n", sourceName, w)
+		}
 	}
 	if errors > 0 {
 		os.Exit(1)
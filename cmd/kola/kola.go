@@ -29,7 +29,9 @@ import (
 	"github.com/spf13/cobra"
 
 	"github.com/flatcar/mantle/cli"
+	"github.com/flatcar/mantle/harness/reporters"
 	"github.com/flatcar/mantle/kola"
+	"github.com/flatcar/mantle/kola/declarative"
 	"github.com/flatcar/mantle/kola/register"
 
 	// register OS test suite
@@ -55,7 +57,7 @@ restrictions on the versions of Container Linux supported by that test
 will be ignored.
 `,
 		Run:    runRun,
-		PreRun: preRun,
+		PreRun: preRunRun,
 	}
 
 	cmdList = &cobra.Command{
@@ -67,9 +69,15 @@ will be ignored.
 	listJSON   bool
 	listFilter bool
 
-	runRemove     bool
-	runSetSSHKeys bool
-	runSSHKeys    []string
+	shardDurations string
+
+	runRemove      bool
+	runSetSSHKeys  bool
+	runSSHKeys     []string
+	runRerunFailed string
+	runResume      string
+	// rerunReport is the report read for --rerun-failed
+	rerunReport *reporters.JSONReport
 )
 
 func init() {
@@ -77,11 +85,23 @@ func init() {
 	root.AddCommand(cmdList)
 
 	cmdList.Flags().BoolVar(&listJSON, "json", false, "format output in JSON")
-	cmdList.Flags().BoolVar(&listFilter, "filter", false, "Filter by --platform and --distro, required for glob patterns, uses '*' as pattern if no pattern is specified")
+	cmdList.Flags().BoolVar(&listFilter, "filter", false, "Filter by --platform and --distro, required for glob patterns, uses '*' as pattern if no pattern is specified. Implied by --shard-count")
+
+	for _, cmd := range []*cobra.Command{cmdRun, cmdList} {
+		cmd.Flags().IntVar(&kola.ShardIndex, "shard-index", 0, "only use the tests of this shard, counting from 0")
+		cmd.Flags().IntVar(&kola.ShardCount, "shard-count", 0, "split the tests into this many shards of about the same duration, each test is part of exactly one shard")
+		cmd.Flags().StringVar(&shardDurations, "shard-durations", "", "balance the shards by the test durations in this report.json of a previous run")
+	}
 
 	cmdRun.Flags().BoolVarP(&runRemove, "remove", "r", true, "remove instances after test exits (--remove=false will keep them)")
 	cmdRun.Flags().BoolVarP(&runSetSSHKeys, "keys", "k", false, "add SSH keys from --key options")
 	cmdRun.Flags().StringSliceVar(&runSSHKeys, "key", nil, "path to SSH public key (default: SSH agent + ~/.ssh/id_{rsa,dsa,ecdsa,ed25519}.pub)")
+	cmdRun.Flags().StringVar(&kola.JUnitFile, "junit-file", "", "file to write JUnit XML results to")
+	cmdRun.Flags().StringVar(&kola.EventStream, "event-stream", "", "file or unix:/path/to/socket to stream test events to as JSON lines while the tests run")
+	cmdRun.Flags().IntVar(&kola.TestRetries, "retry", 0, "rerun failed tests up to N times on a fresh cluster, tests passing on a retry are reported as flaky")
+	cmdRun.Flags().StringVar(&runRerunFailed, "rerun-failed", "", "only run the tests which failed or did not complete in this report.json of a previous run, on its platform")
+	cmdRun.Flags().StringVar(&runResume, "resume", "", "skip the tests which passed in this output directory of a previous, possibly interrupted, run")
+	cmdRun.Flags().DurationVar(&kola.TestTimeout, "test-timeout", 0, "fail tests which run longer than this and let the others continue, unless the test sets its own timeout (0 means no timeout)")
 
 }
 
@@ -105,7 +125,57 @@ func preRun(cmd *cobra.Command, args []string) {
 	}
 }
 
+// preRunRun takes the platform from the report given to --rerun-failed,
+// so that it is checked and used to set up the options like one given to
+// --platform.
+func preRunRun(cmd *cobra.Command, args []string) {
+	if runRerunFailed != "" {
+		var err error
+		rerunReport, err = reporters.ReadJSONReport(runRerunFailed)
+		if err == nil && rerunReport.Platform != kolaPlatform {
+			if cmd.Flags().Changed("platform") {
+				err = fmt.Errorf("report is for platform %q, not %q", rerunReport.Platform, kolaPlatform)
+			} else {
+				kolaPlatform = rerunReport.Platform
+			}
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "--rerun-failed: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	preRun(cmd, args)
+}
+
+// registerTestDir registers the declarative tests from --test-dir.
+func registerTestDir() {
+	if kolaTestDir == "" {
+		return
+	}
+	if err := declarative.RegisterDir(kolaTestDir); err != nil {
+		fmt.Fprintf(os.Stderr, "loading tests from %s: %v\n", kolaTestDir, err)
+		os.Exit(1)
+	}
+}
+
+// readShardDurations reads the durations from --shard-durations.
+func readShardDurations() {
+	if shardDurations == "" {
+		return
+	}
+	var err error
+	kola.ShardDurations, err = kola.ReadShardDurations(shardDurations)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "--shard-durations: %v\n", err)
+		os.Exit(1)
+	}
+}
+
 func runRun(cmd *cobra.Command, args []string) {
+	registerTestDir()
+	loadConsoleRules()
+	readShardDurations()
+
 	var patterns []string
 	if len(args) >= 1 {
 		patterns = args
@@ -114,6 +184,33 @@ func runRun(cmd *cobra.Command, args []string) {
 	}
 
 	var err error
+	if runRerunFailed != "" {
+		patterns, err = rerunFailed(patterns)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "--rerun-failed: %v\n", err)
+			os.Exit(1)
+		}
+		if len(patterns) == 0 {
+			fmt.Printf("No failed tests to rerun in %v\n", runRerunFailed)
+			return
+		}
+	}
+
+	// the previous run has to be read before the output directory is
+	// cleaned, in case they are the same
+	if runResume != "" {
+		if outputDir != "" && filepath.Clean(outputDir) == filepath.Clean(runResume) {
+			fmt.Fprintf(os.Stderr, "--resume: the output directory of the resumed run would be removed, use a different --output-dir\n")
+			os.Exit(1)
+		}
+		kola.SkipTests, err = kola.PassedTests(runResume)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "--resume: %v\n", err)
+			os.Exit(1)
+		}
+		plog.Noticef("Skipping %d tests which passed in %v", len(kola.SkipTests), runResume)
+	}
+
 	outputDir, err = kola.SetupOutputDir(outputDir, kolaPlatform)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "%v\n", err)
@@ -144,6 +241,28 @@ func runRun(cmd *cobra.Command, args []string) {
 	}
 }
 
+// rerunFailed narrows the patterns down to the names of the tests which
+// did not pass in the report given to --rerun-failed, and runs them with
+// the version of the report. Its platform was taken by preRunRun.
+func rerunFailed(patterns []string) ([]string, error) {
+	kola.ReportVersion = rerunReport.Version
+
+	var names []string
+	for _, name := range rerunReport.Failed() {
+		for _, pattern := range patterns {
+			match, err := filepath.Match(pattern, name)
+			if err != nil {
+				return nil, err
+			}
+			if match {
+				names = append(names, name)
+				break
+			}
+		}
+	}
+	return names, nil
+}
+
 func writeProps() error {
 	f, err := os.OpenFile(filepath.Join(outputDir, "properties.json"), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
 	if err != nil {
@@ -268,9 +387,14 @@ func writeProps() error {
 }
 
 func runList(cmd *cobra.Command, args []string) {
+	registerTestDir()
+	readShardDurations()
+
 	tests := register.Tests
 
-	if listFilter {
+	// kola run shards the filtered tests, the shards only match if
+	// they are filtered in the same way
+	if listFilter || kola.ShardCount > 0 {
 		var patterns []string
 		if len(args) >= 1 {
 			patterns = args
@@ -285,6 +409,15 @@ func runList(cmd *cobra.Command, args []string) {
 		}
 	}
 
+	if kola.ShardCount > 0 {
+		var err error
+		tests, err = kola.ShardTests(tests, kola.ShardIndex, kola.ShardCount, kola.ShardDurations)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "sharding error: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
 	var testlist []*item
 
 	for name, test := range tests {
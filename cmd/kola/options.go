@@ -35,6 +35,7 @@ import (
 
 var (
 	outputDir          string
+	kolaTestDir        string
 	kolaPlatform       string
 	kolaChannel        string
 	kolaOffering       string
@@ -44,6 +45,8 @@ var (
 	kolaDistros        = []string{"cl", "fcos", "rhcos"}
 	kolaChannels       = []string{"alpha", "beta", "stable", "edge", "lts"}
 	kolaOfferings      = []string{"basic", "pro"}
+	kolaQEMUFirmware   string
+	kolaQEMUFirmwares  = []string{"bios", "uefi", "uefi-secure"}
 	kolaDefaultImages  = map[string]string{
 		"amd64-usr": sdk.BuildRoot() + "/images/amd64-usr/latest/flatcar_production_image.bin",
 		"arm64-usr": sdk.BuildRoot() + "/images/arm64-usr/latest/flatcar_production_image.bin",
@@ -72,6 +75,7 @@ func init() {
 
 	// general options
 	sv(&outputDir, "output-dir", "", "Temporary output directory for test data and logs")
+	sv(&kolaTestDir, "test-dir", "", "Directory with additional declarative tests in YAML or JSON files")
 	sv(&kola.TorcxManifestFile, "torcx-manifest", "", "Path to a torcx manifest that should be made available to tests")
 	sv(&kola.DevcontainerURL, "devcontainer-url", "http://bincache.flatcar-linux.net/images/@ARCH@/@VERSION@", "URL to a dev container archive that should be made available to tests")
 	sv(&kola.DevcontainerFile, "devcontainer-file", "", "Path to a dev container archive that should be made available to tests as alternative to devcontainer-url, note that a working devcontainer-binhost-url is still needed")
@@ -85,6 +89,8 @@ func init() {
 	sv(&kola.Options.BaseName, "basename", "kola", "Cluster name prefix")
 	ss("debug-systemd-unit", []string{}, "full-unit-name.service to enable SYSTEMD_LOG_LEVEL=debug on. Specify multiple times for multiple units.")
 	sv(&kola.UpdatePayloadFile, "update-payload", "", "Path to an update payload that should be made available to tests")
+	root.PersistentFlags().StringSliceVar(&kola.UpdateChain, "update-chain", nil, "Updates to apply in sequence to one machine: payload paths, versions found in --update-chain-dir or VERSION=PATH")
+	sv(&kola.UpdateChainDir, "update-chain-dir", "", "Directory with a VERSION/flatcar_production_update.gz payload for each version of --update-chain")
 	bv(&kola.ForceFlatcarKey, "force-flatcar-key", false, "Use the Flatcar production key to verify update payload")
 	sv(&kola.Options.IgnitionVersion, "ignition-version", "", "Ignition version override: v2, v3")
 	iv(&kola.Options.SSHRetries, "ssh-retries", kolaSSHRetries, "Number of retries with the SSH timeout when starting the machine")
@@ -224,7 +230,12 @@ func init() {
 	sv(&kola.QEMUOptions.Board, "board", defaultTargetBoard, "target board")
 	sv(&kola.QEMUOptions.DiskImage, "qemu-image", "", "path to CoreOS disk image")
 	sv(&kola.QEMUOptions.BIOSImage, "qemu-bios", "", "BIOS to use for QEMU vm")
+	sv(&kolaQEMUFirmware, "qemu-firmware", "bios", "firmware to boot QEMU vms with: bios, uefi or uefi-secure (amd64-usr only)")
+	sv(&kola.QEMUOptions.UEFICode, "qemu-uefi-code", "", "UEFI code image for --qemu-firmware=uefi(-secure), defaults to the one built with the image")
+	sv(&kola.QEMUOptions.UEFIVars, "qemu-uefi-vars", "", "UEFI variables image for --qemu-firmware=uefi(-secure), copied for each vm, defaults to the one built with the image")
+	bv(&kola.QEMUOptions.TPM, "qemu-swtpm", false, "attach a TPM2 device emulated by swtpm to QEMU vms")
 	bv(&kola.QEMUOptions.UseVanillaImage, "qemu-skip-mangle", false, "don't modify CL disk image to capture console log")
+	bv(&kola.QEMUOptions.MachinePool, "qemu-machine-pool", false, "boot the machines of tests flagged as pool-safe from snapshots of machines with the same config which already completed their first boot")
 	sv(&kola.QEMUOptions.ExtraBaseDiskSize, "qemu-grow-base-disk-by", "", "grow base disk by the given size in bytes, following optional 1024-based suffixes are allowed: b (ignored), k, K, M, G, T")
 }
 
@@ -287,6 +298,29 @@ func syncOptions() error {
 	if kola.QEMUOptions.BIOSImage == "" {
 		kola.QEMUOptions.BIOSImage = kolaDefaultBIOS[kola.QEMUOptions.Board]
 	}
+
+	if err := validateOption("qemu firmware", kolaQEMUFirmware, kolaQEMUFirmwares); err != nil {
+		return err
+	}
+	if kolaQEMUFirmware != "bios" {
+		// the images built along with the qemu_uefi(_secure) image
+		prefix := filepath.Join(sdk.BuildImageDir(kola.QEMUOptions.Board, "latest"), "flatcar_production_qemu_uefi")
+		if kolaQEMUFirmware == "uefi-secure" {
+			if kola.QEMUOptions.Board != "amd64-usr" {
+				return fmt.Errorf("--qemu-firmware=uefi-secure is only supported on amd64-usr")
+			}
+			prefix += "_secure"
+			kola.QEMUOptions.SecureBoot = true
+		}
+		if kola.QEMUOptions.UEFICode == "" {
+			kola.QEMUOptions.UEFICode = prefix + "_efi_code.fd"
+		}
+		if kola.QEMUOptions.UEFIVars == "" {
+			kola.QEMUOptions.UEFIVars = prefix + "_efi_vars.fd"
+		}
+	} else if kola.QEMUOptions.UEFICode != "" || kola.QEMUOptions.UEFIVars != "" {
+		return fmt.Errorf("--qemu-uefi-code and --qemu-uefi-vars require --qemu-firmware=uefi or uefi-secure")
+	}
 	units, _ := root.PersistentFlags().GetStringSlice("debug-systemd-units")
 	for _, unit := range units {
 		kola.Options.SystemdDropins = append(kola.Options.SystemdDropins, platform.SystemdDropin{
@@ -0,0 +1,271 @@
+// Copyright The Mantle Authors.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/flatcar/mantle/update"
+	"github.com/flatcar/mantle/update/disk"
+	"github.com/flatcar/mantle/update/signature"
+)
+
+var (
+	payloadJSON bool
+	payloadKeys []string
+
+	cmdPayload = &cobra.Command{
+		Use:   "payload",
+		Short: "Inspect and apply update payloads",
+	}
+	cmdPayloadInspect = &cobra.Command{
+		Run:   runPayloadInspect,
+		Use:   "inspect PAYLOAD",
+		Short: "Print the contents of an update payload",
+		Long: `
+Print the header, manifest, procedures, operations and signatures of an
+update payload, and whether its data and signatures are valid.`,
+	}
+	cmdPayloadVerify = &cobra.Command{
+		Run:   runPayloadVerify,
+		Use:   "verify PAYLOAD",
+		Short: "Verify an update payload without applying it",
+		Long: `
+Check the data hash of every operation and the signatures of an update
+payload without applying it.`,
+	}
+	cmdPayloadDiff = &cobra.Command{
+		Run:   runPayloadDiff,
+		Use:   "diff PAYLOAD PAYLOAD",
+		Short: "Compare two update payloads",
+		Long: `
+Compare the header, manifest, operations and signatures of two update
+payloads, and the content they write to find the first divergent
+blocks, e.g. to find out why two builds produced different payloads.
+Exits with status 1 if the payloads differ.`,
+	}
+	cmdPayloadApply = &cobra.Command{
+		Run:   runPayloadApply,
+		Use:   "apply DISK PAYLOAD",
+		Short: "Apply an update payload to a disk image",
+		Long: `
+Apply an update payload to the inactive /usr partition of a Flatcar disk
+image and make it the partition booted next, like update_engine does on a
+running system. The kernel of the payload is written to the EFI system
+partition with mtools. Images which aren't raw are attached with
+qemu-nbd, which requires root.`,
+	}
+)
+
+func init() {
+	for _, cmd := range []*cobra.Command{cmdPayloadInspect, cmdPayloadVerify, cmdPayloadApply} {
+		cmd.Flags().StringSliceVar(&payloadKeys, "public-key", nil,
+			"PEM files of the keys the payload may be signed with (default developer key)")
+		cmdPayload.AddCommand(cmd)
+	}
+	for _, cmd := range []*cobra.Command{cmdPayloadInspect, cmdPayloadDiff} {
+		cmd.Flags().BoolVar(&payloadJSON, "json", false, "format output in JSON")
+	}
+	cmdPayload.AddCommand(cmdPayloadDiff)
+	root.AddCommand(cmdPayload)
+}
+
+func payloadVerifiers() []signature.Verifier {
+	var verifiers []signature.Verifier
+	for _, path := range payloadKeys {
+		key, err := signature.ReadPublicKey(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Reading key failed: %v\n", err)
+			os.Exit(1)
+		}
+		verifiers = append(verifiers, signature.NewKeyVerifier(path, key))
+	}
+	return verifiers
+}
+
+func openPayload(args []string) *update.Payload {
+	if len(args) != 1 {
+		fmt.Fprintf(os.Stderr, "Expected a single payload\n")
+		os.Exit(2)
+	}
+	payload := openPayloadFile(args[0])
+	payload.Verifiers = payloadVerifiers()
+	return payload
+}
+
+func openPayloadFile(path string) *update.Payload {
+	// the file stays open until the command exits
+	f, err := os.Open(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+
+	payload, err := update.NewPayloadFrom(f)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
+		os.Exit(1)
+	}
+	return payload
+}
+
+func runPayloadInspect(cmd *cobra.Command, args []string) {
+	info := openPayload(args).Inspect()
+
+	if payloadJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(info); err != nil {
+			fmt.Fprintf(os.Stderr, "Writing JSON failed: %v\n", err)
+			os.Exit(1)
+		}
+	} else {
+		writePayloadInfo(os.Stdout, info)
+	}
+
+	if !info.Verified {
+		os.Exit(1)
+	}
+}
+
+func runPayloadVerify(cmd *cobra.Command, args []string) {
+	if err := openPayload(args).Verify(); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", args[0], err)
+		os.Exit(1)
+	}
+	fmt.Printf("%s: OK\n", args[0])
+}
+
+func runPayloadDiff(cmd *cobra.Command, args []string) {
+	if len(args) != 2 {
+		fmt.Fprintf(os.Stderr, "Expected two payloads\n")
+		os.Exit(2)
+	}
+
+	diff, err := update.DiffPayloads(openPayloadFile(args[0]), openPayloadFile(args[1]))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Comparing payloads failed: %v\n", err)
+		os.Exit(1)
+	}
+
+	if payloadJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(diff); err != nil {
+			fmt.Fprintf(os.Stderr, "Writing JSON failed: %v\n", err)
+			os.Exit(1)
+		}
+	} else {
+		for _, d := range diff.Differences {
+			fmt.Println(d)
+		}
+		for _, b := range diff.Blocks {
+			fmt.Printf("%s: %d divergent blocks", b.Procedure, b.Divergent)
+			if b.Unknown != 0 {
+				fmt.Printf(", %d not compared", b.Unknown)
+			}
+			fmt.Println()
+			for _, r := range b.Ranges {
+				fmt.Printf("  blocks %d-%d\n", r.StartBlock, r.StartBlock+r.NumBlocks-1)
+			}
+		}
+		if diff.Equal() {
+			fmt.Println("Payloads are identical")
+		}
+	}
+
+	if !diff.Equal() {
+		os.Exit(1)
+	}
+}
+
+func runPayloadApply(cmd *cobra.Command, args []string) {
+	if len(args) != 2 {
+		fmt.Fprintf(os.Stderr, "Expected a disk image and a payload\n")
+		os.Exit(2)
+	}
+	verifiers := payloadVerifiers()
+
+	d, err := disk.Open(args[0])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+	target, err := d.Apply(args[1], verifiers)
+	if e := d.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Applying %s to %s failed: %v\n", args[1], args[0], err)
+		os.Exit(1)
+	}
+	fmt.Printf("%s: updated %s\n", args[0], target.Label)
+}
+
+func writePayloadInfo(w io.Writer, info *update.PayloadInfo) {
+	fmt.Fprintf(w, "Magic: %s\n", info.Magic)
+	fmt.Fprintf(w, "Version: %d\n", info.Version)
+	fmt.Fprintf(w, "Manifest size: %d\n", info.ManifestSize)
+	fmt.Fprintf(w, "Block size: %d\n", info.BlockSize)
+	fmt.Fprintf(w, "Signatures: offset %d, size %d\n", info.SignaturesOffset, info.SignaturesSize)
+
+	for _, proc := range info.Procedures {
+		fmt.Fprintf(w, "\nProcedure %s:\n", proc.Type)
+		if proc.OldInfo != nil {
+			fmt.Fprintf(w, "  Old: size %d, sha256 %s\n", proc.OldInfo.Size, proc.OldInfo.SHA256)
+		}
+		if proc.NewInfo != nil {
+			fmt.Fprintf(w, "  New: size %d, sha256 %s\n", proc.NewInfo.Size, proc.NewInfo.SHA256)
+		}
+		for i, op := range proc.Operations {
+			fmt.Fprintf(w, "  Operation %d: %s\n", i+1, op.Type)
+			if op.DataOffset != nil || op.DataLength != 0 {
+				offset := "none"
+				if op.DataOffset != nil {
+					offset = fmt.Sprint(*op.DataOffset)
+				}
+				fmt.Fprintf(w, "    Data: offset %s, length %d, sha256 %s\n", offset, op.DataLength, op.DataSHA256)
+			}
+			if len(op.SrcExtents) != 0 {
+				fmt.Fprintf(w, "    Source: %s", formatExtents(op.SrcExtents))
+				if op.SrcLength != 0 {
+					fmt.Fprintf(w, " (%d bytes)", op.SrcLength)
+				}
+				fmt.Fprintln(w)
+			}
+			if len(op.DstExtents) != 0 {
+				fmt.Fprintf(w, "    Destination: %s", formatExtents(op.DstExtents))
+				if op.DstLength != 0 {
+					fmt.Fprintf(w, " (%d bytes)", op.DstLength)
+				}
+				fmt.Fprintln(w)
+			}
+		}
+	}
+
+	fmt.Fprintln(w)
+	for _, sig := range info.Signatures {
+		fmt.Fprintf(w, "Signature: v%d, %d bytes\n", sig.Version, sig.Size)
+	}
+	if info.Verified {
+		fmt.Fprintln(w, "Verification: OK")
+	} else {
+		fmt.Fprintf(w, "Verification: FAILED: %s\n", info.Error)
+	}
+}
+
+// formatExtents formats extents as start+count block ranges.
+func formatExtents(extents []update.ExtentInfo) string {
+	var s []string
+	for _, e := range extents {
+		s = append(s, fmt.Sprintf("%d+%d", e.StartBlock, e.NumBlocks))
+	}
+	return strings.Join(s, " ")
+}
@@ -61,7 +61,7 @@ func init() {
 	cmdSpawn.Flags().StringVar(&spawnOmahaPackage, "omaha-package", "", "add an update payload to the Omaha server, referenced by image version (e.g. 'latest')")
 	cmdSpawn.Flags().BoolVarP(&spawnShell, "shell", "s", true, "spawn a shell in an instance before exiting")
 	cmdSpawn.Flags().BoolVarP(&spawnRemove, "remove", "r", true, "remove instances after shell exits")
-	cmdSpawn.Flags().StringVar(&spawnMachineOptions, "qemu-options", "", "experimental: path to QEMU machine options json")
+	cmdSpawn.Flags().StringVar(&spawnMachineOptions, "qemu-options", "", "experimental: path to QEMU machine options json, e.g. {\"MemoryMiB\": 4096, \"VCPUs\": 2}")
 	cmdSpawn.Flags().BoolVarP(&spawnSetSSHKeys, "keys", "k", false, "add SSH keys from --key options")
 	cmdSpawn.Flags().StringSliceVar(&spawnSSHKeys, "key", nil, "path to SSH public key (default: SSH agent + ~/.ssh/id_{rsa,dsa,ecdsa,ed25519}.pub)")
 	root.AddCommand(cmdSpawn)
@@ -123,11 +123,26 @@ func doSpawn(cmd *cobra.Command, args []string) error {
 		defer flight.Destroy()
 	}
 
+	var machineOpts platform.MachineOptions
+	if spawnMachineOptions != "" {
+		if kolaPlatform != "qemu" && kolaPlatform != "qemu-unpriv" {
+			return errors.New("--qemu-options is only supported on qemu and qemu-unpriv")
+		}
+		b, err := ioutil.ReadFile(spawnMachineOptions)
+		if err != nil {
+			return fmt.Errorf("Could not read machine options: %v", err)
+		}
+		if err := json.Unmarshal(b, &machineOpts); err != nil {
+			return fmt.Errorf("Could not unmarshal machine options: %v", err)
+		}
+	}
+
 	cluster, err := flight.NewCluster(&platform.RuntimeConfig{
 		OutputDir:        outputDir,
 		AllowFailedUnits: true,
 		SSHRetries:       kola.Options.SSHRetries,
 		SSHTimeout:       kola.Options.SSHTimeout,
+		MachineOptions:   machineOpts,
 	})
 	if err != nil {
 		return fmt.Errorf("Cluster failed: %v", err)
@@ -161,26 +176,8 @@ func doSpawn(cmd *cobra.Command, args []string) error {
 
 	var someMach platform.Machine
 	for i := 0; i < spawnNodeCount; i++ {
-		var mach platform.Machine
-		var err error
 		plog.Infof("Spawning machine...")
-		if kolaPlatform == "qemu" && spawnMachineOptions != "" {
-			var b []byte
-			b, err = ioutil.ReadFile(spawnMachineOptions)
-			if err != nil {
-				return fmt.Errorf("Could not read machine options: %v", err)
-			}
-
-			var machineOpts platform.MachineOptions
-			err = json.Unmarshal(b, &machineOpts)
-			if err != nil {
-				return fmt.Errorf("Could not unmarshal machine options: %v", err)
-			}
-
-			mach, err = cluster.(*qemu.Cluster).NewMachineWithOptions(userdata, machineOpts)
-		} else {
-			mach, err = cluster.NewMachine(userdata)
-		}
+		mach, err := cluster.NewMachine(userdata)
 		if err != nil {
 			return fmt.Errorf("Spawning instance failed: %v", err)
 		}
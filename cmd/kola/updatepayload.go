@@ -17,6 +17,8 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"crypto/x509"
+	"encoding/pem"
 	"fmt"
 	"net"
 	"os"
@@ -34,12 +36,18 @@ import (
 	"github.com/flatcar/mantle/platform/machine/qemu"
 	"github.com/flatcar/mantle/sdk"
 	sdkomaha "github.com/flatcar/mantle/sdk/omaha"
+	"github.com/flatcar/mantle/update"
+	"github.com/flatcar/mantle/update/signature"
 )
 
 var (
 	updateTimeout    time.Duration
 	updatePayload    string
-	cmdUpdatePayload = &cobra.Command{
+	updatePayloadKey string
+	// signing of the generated payload
+	updatePayloadPrivateKey string
+	updatePayloadSignCmd    string
+	cmdUpdatePayload        = &cobra.Command{
 		Run:    runUpdatePayload,
 		PreRun: preRun,
 		Use:    "updatepayload",
@@ -50,13 +58,19 @@ Boot a CoreOS instance and serve an update payload to its update_engine.
 This command must run inside of the SDK as root, e.g.
 
 sudo kola updatepayload
+
+Without --payload, a payload of the latest image of the SDK is generated,
+signed with --payload-private-key or --payload-sign-command if given.
+The machine accepts payloads signed with --payload-key, which defaults to
+the public part of --payload-private-key or the developer key.
 `,
 	}
 )
 
 type userdataParams struct {
-	Port int
-	Keys []*agent.Key
+	Port      int
+	Keys      []*agent.Key
+	PublicKey string
 }
 
 // The user data is a bash script executed by cloudinit to ensure
@@ -79,17 +93,9 @@ SERVER=http://10.0.0.1:{{printf "%d" .Port}}/v1/update/
 EOF
 mv /etc/flatcar/update.conf{.new,}
 
-# inject the dev key so official images can be used for testing
+# inject the payload key so official images can be used for testing
 cat >/etc/flatcar/update-payload-key.pub.pem <<EOF
------BEGIN PUBLIC KEY-----
-MIIBIjANBgkqhkiG9w0BAQEFAAOCAQ8AMIIBCgKCAQEAzFS5uVJ+pgibcFLD3kbY
-k02Edj0HXq31ZT/Bva1sLp3Ysv+QTv/ezjf0gGFfASdgpz6G+zTipS9AIrQr0yFR
-+tdp1ZsHLGxVwvUoXFftdapqlyj8uQcWjjbN7qJsZu0Ett/qo93hQ5nHW7Sv5dRm
-/ZsDFqk2Uvyaoef4bF9r03wYpZq7K3oALZ2smETv+A5600mj1Xg5M52QFU67UHls
-EFkZphrGjiqiCdp9AAbAvE7a5rFcJf86YR73QX08K8BX7OMzkn3DsqdnWvLB3l3W
-6kvIuP+75SrMNeYAcU8PI1+bzLcAG3VN3jA78zeKALgynUNH50mxuiiU3DO4DZ+p
-5QIDAQAB
------END PUBLIC KEY-----
+{{.PublicKey}}
 EOF
 mount --bind /etc/flatcar/update-payload-key.pub.pem \
 	/usr/share/update_engine/update-payload-key.pub.pem
@@ -110,6 +116,15 @@ func init() {
 	cmdUpdatePayload.Flags().StringVar(
 		&updatePayload, "payload", "",
 		"update payload")
+	cmdUpdatePayload.Flags().StringVar(
+		&updatePayloadKey, "payload-key", "",
+		"PEM file of the public key the payload is signed with (default developer key)")
+	cmdUpdatePayload.Flags().StringVar(
+		&updatePayloadPrivateKey, "payload-private-key", "",
+		"PEM file of the private key to sign the generated payload with (default developer key)")
+	cmdUpdatePayload.Flags().StringVar(
+		&updatePayloadSignCmd, "payload-sign-command", "",
+		"command signing the generated payload, it reads the hash on stdin and writes the signature to stdout, requires --payload-key")
 	root.AddCommand(cmdUpdatePayload)
 }
 
@@ -118,25 +133,44 @@ func runUpdatePayload(cmd *cobra.Command, args []string) {
 		plog.Fatal("No args accepted")
 	}
 
-	if updatePayload == "" {
-		updatePayload = newPayload()
+	signers, err := payloadSigners()
+	if err != nil {
+		plog.Fatal(err)
+	}
+	if updatePayload != "" && len(signers) > 0 {
+		plog.Fatal("--payload-private-key and --payload-sign-command only apply to generated payloads")
+	}
+	if updatePayload == "" && updatePayloadKey != "" && len(signers) == 0 {
+		// the generated payload would be signed with the developer key
+		plog.Fatal("--payload-key requires --payload, --payload-private-key or --payload-sign-command")
 	}
 
 	start := time.Now()
 	plog.Notice("=== Running Flatcar upgrade test")
-	if err := runUpdateTest(); err != nil {
+	if err := runUpdateTest(signers); err != nil {
 		plog.Fatalf("--- FAIL: %v (%s)", err, time.Since(start))
 	}
 	plog.Noticef("--- PASS: Flatcar upgrade test (%s)", time.Since(start))
 }
 
-func runUpdateTest() error {
+func runUpdateTest(signers []signature.Signer) error {
 	outputDir, err := kola.SetupOutputDir(outputDir, "qemu")
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Setup failed: %v\n", err)
 		os.Exit(1)
 	}
 
+	if updatePayload == "" {
+		if updatePayload, err = newPayload(outputDir, signers); err != nil {
+			return fmt.Errorf("building update payload: %v", err)
+		}
+	}
+
+	publicKey, err := payloadPublicKey()
+	if err != nil {
+		return err
+	}
+
 	flight, err := qemu.NewFlight(&kola.QEMUOptions)
 	if err != nil {
 		return fmt.Errorf("new flight: %v", err)
@@ -158,7 +192,7 @@ func runUpdateTest() error {
 		return fmt.Errorf("bad payload: %v", err)
 	}
 
-	userdata, err := newUserdata(qc)
+	userdata, err := newUserdata(qc, publicKey)
 	if err != nil {
 		return fmt.Errorf("bad userdata: %v", err)
 	}
@@ -239,27 +273,121 @@ func tryUpdate(m platform.Machine) error {
 	return nil
 }
 
-func newPayload() string {
+// newPayload returns the payload of the latest image of the SDK. Payloads
+// signed with the developer key are generated next to the image, once,
+// others are written to outputDir.
+func newPayload(outputDir string, signers []signature.Signer) (string, error) {
 	plog.Info("Generating update payload")
 
-	// check for update file, generate if it doesn't exist
 	dir := sdk.BuildImageDir(kola.QEMUOptions.Board, "latest")
+	if len(signers) > 0 {
+		path := filepath.Join(outputDir, "flatcar_production_update.gz")
+		return path, sdkomaha.GenerateSignedPayload(dir, path, signers...)
+	}
+
+	// check for update file, generate if it doesn't exist
 	if err := sdkomaha.GenerateFullUpdate(dir); err != nil {
-		plog.Fatalf("Building full update failed: %v", err)
+		return "", err
+	}
+
+	return filepath.Join(dir, "flatcar_production_update.gz"), nil
+}
+
+// payloadSigners returns the signers of the generated payload, none if it
+// is signed with the developer key.
+func payloadSigners() ([]signature.Signer, error) {
+	switch {
+	case updatePayloadPrivateKey != "" && updatePayloadSignCmd != "":
+		return nil, fmt.Errorf("--payload-private-key and --payload-sign-command are mutually exclusive")
+	case updatePayloadPrivateKey != "":
+		key, err := signature.ReadPrivateKey(updatePayloadPrivateKey)
+		if err != nil {
+			return nil, err
+		}
+		return []signature.Signer{signature.NewKeySigner(key)}, nil
+	case updatePayloadSignCmd != "":
+		if updatePayloadKey == "" {
+			return nil, fmt.Errorf("--payload-sign-command requires --payload-key")
+		}
+		key, err := signature.ReadPublicKey(updatePayloadKey)
+		if err != nil {
+			return nil, err
+		}
+		command := strings.Fields(updatePayloadSignCmd)
+		return []signature.Signer{signature.NewCommandSigner(command, key)}, nil
 	}
+	return nil, nil
+}
 
-	return filepath.Join(dir, "flatcar_production_update.gz")
+// payloadPublicKey returns the PEM encoded public key update_engine checks
+// the payload with, after checking the payload itself is signed with it.
+func payloadPublicKey() (string, error) {
+	var (
+		name string
+		data []byte
+		err  error
+	)
+	switch {
+	case updatePayloadKey != "":
+		name = updatePayloadKey
+		if data, err = os.ReadFile(updatePayloadKey); err != nil {
+			return "", err
+		}
+	case updatePayloadPrivateKey != "":
+		name = updatePayloadPrivateKey
+		if data, err = publicKeyPEM(updatePayloadPrivateKey); err != nil {
+			return "", err
+		}
+	default:
+		return strings.TrimSpace(signature.DeveloperPublicKey), nil
+	}
+
+	key, err := signature.ParsePublicKey(data)
+	if err != nil {
+		return "", fmt.Errorf("%s: %v", name, err)
+	}
+
+	f, err := os.Open(updatePayload)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	payload, err := update.NewPayloadFrom(f)
+	if err != nil {
+		return "", fmt.Errorf("%s: %v", updatePayload, err)
+	}
+	payload.Verifiers = []signature.Verifier{signature.NewKeyVerifier(name, key)}
+	if err := payload.Verify(); err != nil {
+		return "", fmt.Errorf("%s: %v", updatePayload, err)
+	}
+
+	return strings.TrimSpace(string(data)), nil
+}
+
+// publicKeyPEM returns the PEM encoded public part of a private key.
+func publicKeyPEM(path string) ([]byte, error) {
+	key, err := signature.ReadPrivateKey(path)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), nil
 }
 
-func newUserdata(qc *qemu.Cluster) (*conf.UserData, error) {
+func newUserdata(qc *qemu.Cluster, publicKey string) (*conf.UserData, error) {
 	keys, err := qc.Keys()
 	if err != nil {
 		return nil, err
 	}
 
 	params := userdataParams{
-		Port: qc.OmahaServer.Addr().(*net.TCPAddr).Port,
-		Keys: keys,
+		Port:      qc.OmahaServer.Addr().(*net.TCPAddr).Port,
+		Keys:      keys,
+		PublicKey: publicKey,
 	}
 	tmpl, err := template.New("userdata").Parse(userdataTmpl)
 	if err != nil {
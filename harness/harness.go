@@ -27,6 +27,7 @@ import (
 	"path/filepath"
 	"regexp"
 	"runtime"
+	"runtime/pprof"
 	"strings"
 	"sync"
 	"time"
@@ -53,12 +54,15 @@ type H struct {
 	logger   *log.Logger
 	ctx      context.Context
 	cancel   context.CancelFunc
+	timer    *time.Timer
 	ran      bool // Test (or one of its subtests) was executed.
 	failed   bool // Test has failed.
 	skipped  bool // Test has been skipped.
 	finished bool // Test function has completed.
 	done     bool // Test is finished and all subtests have completed.
 	hasSub   bool
+	timedOut bool // Test exceeded its timeout.
+	claimed  bool // Completion of the test has been claimed.
 
 	suite    *Suite
 	parent   *H
@@ -69,10 +73,14 @@ type H struct {
 	barrier  chan bool // To signal parallel subtests they may start.
 	signal   chan bool // To signal a test is done.
 	sub      []*H      // Queue of subtests to be run in parallel.
+	top      []*H      // Top-level tests started by the root test.
+	attempt  int       // Number of previous attempts at running the test.
+	noRetry  bool      // Test must not be retried after a failure.
 
 	isParallel bool
 
 	reporters reporters.Reporters
+	pending   *pendingReporter // Holds back reports until retries are decided.
 }
 
 func (c *H) parentContext() context.Context {
@@ -92,6 +100,8 @@ func (c *H) status() testresult.TestResult {
 		return testresult.Fail
 	} else if c.Skipped() {
 		return testresult.Skip
+	} else if c.attempt > 0 && c.level == 1 {
+		return testresult.Flaky
 	}
 	return testresult.Pass
 }
@@ -108,7 +118,7 @@ func (c *H) flushToParent(format string, args ...interface{}) {
 	status := c.status()
 
 	// TODO: include test numbers in TAP output.
-	if p.tap != nil {
+	if p.tap != nil && !c.willRetry() {
 		name := strings.Replace(c.name, "#", "", -1)
 		if status == testresult.Fail {
 			// Filter passed subtests and their output away
@@ -118,6 +128,8 @@ func (c *H) flushToParent(format string, args ...interface{}) {
 			fmt.Fprintf(p.tap, "not ok - %s\n  ---\n  Error: %q\n  ...\n", name, msg)
 		} else if status == testresult.Skip {
 			fmt.Fprintf(p.tap, "ok - %s # SKIP\n", name)
+		} else if status == testresult.Flaky {
+			fmt.Fprintf(p.tap, "ok - %s # FLAKY\n", name)
 		} else {
 			fmt.Fprintf(p.tap, "ok - %s\n", name)
 		}
@@ -182,18 +194,27 @@ func (c *H) setRan() {
 
 // Fail marks the function as having failed but continues execution.
 func (c *H) Fail() {
-	if c.parent != nil {
+	if c.parent != nil && !c.abandoned() {
 		c.parent.Fail()
 	}
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	// c.done needs to be locked to synchronize checks to c.done in parent tests.
-	if c.done {
+	// A test which was abandoned after its timeout may still be running.
+	if c.done && !c.timedOut {
 		panic("Fail in goroutine after " + c.name + " has completed")
 	}
 	c.failed = true
 }
 
+// abandoned reports whether the test was reported as done after its
+// timeout while its goroutine may still be running.
+func (c *H) abandoned() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.done && c.timedOut
+}
+
 // Failed reports whether the function has failed.
 func (c *H) Failed() bool {
 	c.mu.RLock()
@@ -235,11 +256,25 @@ func (c *H) FailNow() {
 
 // log generates the output. It's always at the same stack depth.
 func (c *H) log(s string) {
+	c.Event(reporters.Event{
+		Type:    reporters.EventLog,
+		Message: strings.TrimSuffix(s, "\n"),
+	})
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	c.logger.Output(3, s)
 }
 
+// Event streams an event of the test to the reporters, e.g. when the
+// test creates or destroys a machine. The time and test of the event
+// are filled in.
+func (c *H) Event(e reporters.Event) {
+	e.Time = time.Now()
+	e.Test = c.name
+	e.Attempt = c.attempt
+	c.suite.opts.Reporters.Event(e)
+}
+
 // Log formats its arguments using default formatting, analogous to Println,
 // and records the text in the error log. The text will be printed only if
 // the test fails or the -harness.v flag is set.
@@ -314,6 +349,9 @@ func (c *H) Skipped() bool {
 
 func (h *H) mkOutputDir() (dir string, err error) {
 	dir = h.suite.outputPath(h.name)
+	if h.attempt > 0 {
+		dir = h.suite.outputPath(filepath.Join(fmt.Sprintf("retry-%d", h.attempt), h.name))
+	}
 	if err = os.MkdirAll(dir, 0777); err != nil {
 		err = fmt.Errorf("Failed to create output dir: %v", err)
 	}
@@ -364,6 +402,39 @@ func (h *H) TempFile(prefix string) *os.File {
 	return tmp
 }
 
+// NoRetry signals that this test must not be run again after a failure,
+// even if the Suite is configured to retry failed tests. Only top-level
+// tests are retried so calling NoRetry from a subtest has no effect.
+func (h *H) NoRetry() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.noRetry = true
+}
+
+// WillRetry reports whether the test, having failed so far, is going to
+// be run again. Only top-level tests are retried.
+func (h *H) WillRetry() bool {
+	return h.willRetry()
+}
+
+// willRetry reports whether the failed top-level test will be attempted
+// again.
+func (h *H) willRetry() bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.level == 1 && h.failed && !h.noRetry && h.attempt < h.suite.opts.Retries
+}
+
+// writeAttemptLog saves the output of an attempt which is going to be
+// retried, its reports are discarded so this is the only record of it.
+func (h *H) writeAttemptLog() error {
+	dir, err := h.mkOutputDir()
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, "output.log"), h.output.Bytes(), 0666)
+}
+
 // Parallel signals that this test is to be run in parallel with (and only with)
 // other parallel tests.
 func (t *H) Parallel() {
@@ -380,9 +451,11 @@ func (t *H) Parallel() {
 	// Add to the list of tests to be released by the parent.
 	t.parent.sub = append(t.parent.sub, t)
 
+	t.Event(reporters.Event{Type: reporters.EventTestPause})
 	t.signal <- true   // Release calling test.
 	<-t.parent.barrier // Wait for the parent test to complete.
 	t.suite.waitParallel()
+	t.Event(reporters.Event{Type: reporters.EventTestContinue})
 	t.start = time.Now()
 }
 
@@ -395,6 +468,13 @@ func tRunner(t *H, fn func(t *H)) {
 	// a call to runtime.Goexit, record the duration and send
 	// a signal saying that the test is done.
 	defer func() {
+		if !t.claim() {
+			// The test was abandoned after its timeout.
+			return
+		}
+		if t.timer != nil {
+			t.timer.Stop()
+		}
 		t.duration += time.Now().Sub(t.start)
 		// If the test panicked, print any test output before dying.
 		err := recover()
@@ -442,6 +522,102 @@ func tRunner(t *H, fn func(t *H)) {
 	t.finished = true
 }
 
+// timeoutGracePeriod is how long a test which exceeded its timeout may
+// take to return before it is abandoned.
+var timeoutGracePeriod = time.Minute
+
+// SetTimeout fails the test if it is still running after d. When the
+// timeout expires a dump of all goroutines is written to goroutines.txt
+// in the test's output directory, the test's context is cancelled and
+// diag, if not nil, is called to collect further diagnostics or free
+// resources the test is blocked on. A test which doesn't return shortly
+// after is abandoned so that the rest of the suite can continue.
+//
+// SetTimeout should be called from the goroutine running the test, after
+// any call to Parallel. Calling it again replaces the previous timeout.
+func (t *H) SetTimeout(d time.Duration, diag func()) {
+	if t.timer != nil {
+		t.timer.Stop()
+	}
+	grace := timeoutGracePeriod
+	t.timer = time.AfterFunc(d, func() {
+		t.timeout(d, grace, diag)
+	})
+}
+
+// timeout handles a test exceeding its timeout.
+func (t *H) timeout(d, grace time.Duration, diag func()) {
+	t.mu.Lock()
+	if t.claimed {
+		t.mu.Unlock()
+		return
+	}
+	t.timedOut = true
+	t.mu.Unlock()
+
+	t.Errorf("test timed out after %v", d)
+	if err := t.writeGoroutines(); err != nil {
+		t.Errorf("writing goroutine dump: %v", err)
+	}
+	t.cancel()
+
+	// Scheduled first so that the test is abandoned even if diag hangs,
+	// e.g. because the test is stuck in the same cleanup.
+	time.AfterFunc(grace, func() {
+		if t.claim() {
+			t.abandon(grace)
+		}
+	})
+	if diag != nil {
+		diag()
+	}
+}
+
+// claim reports whether the caller is the first to complete the test,
+// either because it returned or because it was abandoned.
+func (t *H) claim() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.claimed {
+		return false
+	}
+	t.claimed = true
+	return true
+}
+
+// abandon reports a test which failed to return after its timeout as done,
+// leaving its goroutine behind. Parallel subtests which haven't started yet
+// are never run.
+func (t *H) abandon(grace time.Duration) {
+	t.Logf("test did not return %v after its timeout, abandoning it", grace)
+	t.duration += time.Now().Sub(t.start)
+	if t.isParallel {
+		t.suite.release()
+	}
+	t.report()
+
+	t.mu.Lock()
+	t.done = true
+	t.mu.Unlock()
+	if t.parent != nil && !t.hasSub {
+		t.setRan()
+	}
+	t.signal <- true
+}
+
+func (t *H) writeGoroutines() error {
+	dir, err := t.mkOutputDir()
+	if err != nil {
+		return err
+	}
+	f, err := os.Create(filepath.Join(dir, "goroutines.txt"))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return pprof.Lookup("goroutine").WriteTo(f, 2)
+}
+
 // Run runs f as a subtest of t called name. It reports whether f succeeded.
 // Run will block until all its parallel subtests have completed.
 func (t *H) Run(name string, f func(t *H)) bool {
@@ -457,8 +633,16 @@ func (t *H) Run(name string, f func(t *H)) bool {
 		suite:     t.suite,
 		parent:    t,
 		level:     t.level + 1,
+		attempt:   t.attempt,
 		reporters: t.reporters,
 	}
+	if t.level == 1 {
+		t.parent.top = append(t.parent.top, t)
+		if t.suite.opts.Retries > 0 {
+			t.pending = &pendingReporter{}
+			t.reporters = reporters.Reporters{t.pending}
+		}
+	}
 	t.w = indenter{t}
 	// Indent logs 8 spaces to distinguish them from sub-test headers.
 	const indent = "        "
@@ -471,6 +655,11 @@ func (t *H) Run(name string, f func(t *H)) bool {
 		}
 		fmt.Fprintf(root.w, "=== RUN   %s\n", t.name)
 	}
+	if t.level == 1 {
+		t.Event(reporters.Event{Type: reporters.EventTestStart})
+	} else {
+		t.Event(reporters.Event{Type: reporters.EventSubtestStart})
+	}
 	// Instead of reducing the running count of this test before calling the
 	// tRunner and increasing it afterwards, we rely on tRunner keeping the
 	// count correct. This ensures that a sequence of sequential tests runs
@@ -506,6 +695,54 @@ func (t *H) report() {
 	// this being a TODO if you don't want to tackle it in this initial
 	// PR.
 	t.reporters.ReportTest(t.name, status, t.duration, t.output.Bytes())
+	t.Event(reporters.Event{
+		Type:     reporters.EventTestEnd,
+		Result:   status,
+		Duration: t.duration,
+	})
+	if t.pending != nil && !t.willRetry() {
+		t.pending.replay(t.suite.opts.Reporters)
+	}
+}
+
+// pendingReporter records the reports of a top-level test and its subtests
+// so they can be forwarded once it is known that the test won't be retried.
+type pendingReporter struct {
+	mu      sync.Mutex
+	reports []pendingReport
+}
+
+type pendingReport struct {
+	name     string
+	result   testresult.TestResult
+	duration time.Duration
+	output   []byte
+}
+
+func (r *pendingReporter) ReportTest(name string, result testresult.TestResult, duration time.Duration, b []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.reports = append(r.reports, pendingReport{
+		name:     name,
+		result:   result,
+		duration: duration,
+		output:   append([]byte(nil), b...),
+	})
+}
+
+func (r *pendingReporter) Output(path string) error {
+	return nil
+}
+
+func (r *pendingReporter) SetResult(result testresult.TestResult) {}
+
+// replay forwards all recorded reports to reps.
+func (r *pendingReporter) replay(reps reporters.Reporters) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, rep := range r.reports {
+		reps.ReportTest(rep.name, rep.result, rep.duration, rep.output)
+	}
 }
 
 // CleanOutputDir creates/empties an output directory and returns the cleaned path.
@@ -17,6 +17,7 @@ package harness
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"os"
@@ -25,9 +26,13 @@ import (
 	"regexp"
 	"runtime"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/flatcar/mantle/harness/reporters"
+	"github.com/flatcar/mantle/harness/testresult"
 )
 
 func TestMain(m *testing.M) {
@@ -487,3 +492,242 @@ func TestTempFile(t *testing.T) {
 		t.Errorf("%q missing %q prefix", second, "second")
 	}
 }
+
+type recordingReporter struct {
+	mu      sync.Mutex
+	results map[string][]testresult.TestResult
+	result  testresult.TestResult
+}
+
+func (r *recordingReporter) ReportTest(name string, result testresult.TestResult, duration time.Duration, b []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.results[name] = append(r.results[name], result)
+}
+
+func (r *recordingReporter) Output(path string) error { return nil }
+
+func (r *recordingReporter) SetResult(result testresult.TestResult) { r.result = result }
+
+func TestRetry(t *testing.T) {
+	var suitedir string
+	if dir, err := ioutil.TempDir("", ""); err != nil {
+		t.Fatal(err)
+	} else {
+		defer os.RemoveAll(dir)
+		suitedir = filepath.Join(dir, "_test_temp")
+	}
+
+	var mu sync.Mutex
+	attempts := map[string]int{}
+	attempt := func(h *H) int {
+		mu.Lock()
+		defer mu.Unlock()
+		attempts[h.Name()]++
+		return attempts[h.Name()]
+	}
+
+	rep := &recordingReporter{results: map[string][]testresult.TestResult{}}
+	opts := Options{
+		OutputDir: suitedir,
+		Retries:   2,
+		Reporters: reporters.Reporters{rep},
+	}
+	suite := NewSuite(opts, Tests{
+		"Flaky": func(h *H) {
+			h.Parallel()
+			n := attempt(h)
+			h.Run("sub", func(h *H) {})
+			if n < 2 {
+				h.Fatal("first attempt fails")
+			}
+		},
+		"Broken": func(h *H) {
+			h.Parallel()
+			attempt(h)
+			h.Fatal("always fails")
+		},
+		"NoRetry": func(h *H) {
+			h.NoRetry()
+			attempt(h)
+			h.Fatal("fails once")
+		},
+		"Pass": func(h *H) {
+			attempt(h)
+		},
+	})
+
+	buf := &bytes.Buffer{}
+	if err := suite.runTests(buf, nil); err != SuiteFailed {
+		t.Log("\n" + buf.String())
+		t.Errorf("expected %v, got %v", SuiteFailed, err)
+	}
+
+	expectAttempts := map[string]int{"Flaky": 2, "Broken": 3, "NoRetry": 1, "Pass": 1}
+	if !reflect.DeepEqual(attempts, expectAttempts) {
+		t.Errorf("attempts %v != %v", attempts, expectAttempts)
+	}
+
+	expectResults := map[string][]testresult.TestResult{
+		"Flaky":     {testresult.Flaky},
+		"Flaky/sub": {testresult.Pass},
+		"Broken":    {testresult.Fail},
+		"NoRetry":   {testresult.Fail},
+		"Pass":      {testresult.Pass},
+	}
+	if !reflect.DeepEqual(rep.results, expectResults) {
+		t.Errorf("results %v != %v", rep.results, expectResults)
+	}
+	if rep.result != testresult.Fail {
+		t.Errorf("suite result %v != %v", rep.result, testresult.Fail)
+	}
+
+	for _, log := range []string{
+		filepath.Join(suitedir, "Flaky", "output.log"),
+		filepath.Join(suitedir, "Broken", "output.log"),
+		filepath.Join(suitedir, "retry-1", "Broken", "output.log"),
+	} {
+		if _, err := os.Stat(log); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	var suitedir string
+	if dir, err := ioutil.TempDir("", ""); err != nil {
+		t.Fatal(err)
+	} else {
+		defer os.RemoveAll(dir)
+		suitedir = filepath.Join(dir, "_test_temp")
+	}
+
+	grace := timeoutGracePeriod
+	timeoutGracePeriod = 10 * time.Millisecond
+	defer func() { timeoutGracePeriod = grace }()
+
+	release := make(chan struct{})
+	returned := make(chan struct{})
+	var diags int32
+
+	rep := &recordingReporter{results: map[string][]testresult.TestResult{}}
+	opts := Options{
+		OutputDir: suitedir,
+		Parallel:  3,
+		Reporters: reporters.Reporters{rep},
+	}
+	suite := NewSuite(opts, Tests{
+		"Cancelled": func(h *H) {
+			h.Parallel()
+			h.SetTimeout(10*time.Millisecond, func() {
+				atomic.AddInt32(&diags, 1)
+			})
+			<-h.Context().Done()
+		},
+		"Hung": func(h *H) {
+			defer close(returned)
+			h.Parallel()
+			h.SetTimeout(10*time.Millisecond, nil)
+			<-release
+			h.Fatal("returning after being abandoned")
+		},
+		"HungDiag": func(h *H) {
+			h.Parallel()
+			h.SetTimeout(10*time.Millisecond, func() {
+				<-release
+			})
+			<-release
+		},
+		"Fast": func(h *H) {
+			h.Parallel()
+			h.SetTimeout(time.Minute, nil)
+		},
+	})
+
+	buf := &bytes.Buffer{}
+	if err := suite.runTests(buf, nil); err != SuiteFailed {
+		t.Log("\n" + buf.String())
+		t.Errorf("expected %v, got %v", SuiteFailed, err)
+	}
+	close(release)
+	<-returned
+
+	if n := atomic.LoadInt32(&diags); n != 1 {
+		t.Errorf("diag called %d times", n)
+	}
+	expectResults := map[string][]testresult.TestResult{
+		"Cancelled": {testresult.Fail},
+		"Hung":      {testresult.Fail},
+		"HungDiag":  {testresult.Fail},
+		"Fast":      {testresult.Pass},
+	}
+	if !reflect.DeepEqual(rep.results, expectResults) {
+		t.Errorf("results %v != %v", rep.results, expectResults)
+	}
+	for _, name := range []string{"Cancelled", "Hung", "HungDiag"} {
+		if _, err := os.Stat(filepath.Join(suitedir, name, "goroutines.txt")); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestEventStream(t *testing.T) {
+	var suitedir string
+	if dir, err := ioutil.TempDir("", ""); err != nil {
+		t.Fatal(err)
+	} else {
+		defer os.RemoveAll(dir)
+		suitedir = filepath.Join(dir, "_test_temp")
+	}
+
+	streamPath := filepath.Join(t.TempDir(), "events.json")
+	stream, err := reporters.NewStreamReporter(streamPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := Options{
+		OutputDir: suitedir,
+		Reporters: reporters.Reporters{stream},
+	}
+	suite := NewSuite(opts, Tests{
+		"Test": func(h *H) {
+			h.Parallel()
+			h.Logf("hello")
+			h.Event(reporters.Event{Type: reporters.EventMachineCreated, Machine: "m1", IP: "10.0.0.2"})
+			h.Run("sub", func(h *H) {})
+		},
+	})
+	if err := suite.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := ioutil.ReadFile(streamPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, line := range strings.Split(strings.TrimSpace(string(b)), "\n") {
+		var e reporters.Event
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatalf("parsing %q: %v", line, err)
+		}
+		if e.Time.IsZero() {
+			t.Errorf("event without time: %q", line)
+		}
+		got = append(got, fmt.Sprintf("%s %s %s%s%s%s", e.Type, e.Test, e.Result, e.Message, e.Machine, e.IP))
+	}
+	expected := []string{
+		"test-start Test ",
+		"test-pause Test ",
+		"test-continue Test ",
+		"log Test hello",
+		"machine-created Test m110.0.0.2",
+		"subtest-start Test/sub ",
+		"test-end Test/sub PASS",
+		"test-end Test PASS",
+		"run-end  PASS",
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("got events:\n%s\nexpected:\n%s", strings.Join(got, "\n"), strings.Join(expected, "\n"))
+	}
+}
@@ -16,15 +16,17 @@ package reporters
 
 import (
 	"encoding/json"
+	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/flatcar/mantle/harness/testresult"
 )
 
 type jsonReporter struct {
-	Tests    []jsonTest            `json:"tests"`
+	Tests    []JSONTest            `json:"tests"`
 	Result   testresult.TestResult `json:"result"`
 	filename string
 
@@ -33,7 +35,16 @@ type jsonReporter struct {
 	Version  string `json:"version"`
 }
 
-type jsonTest struct {
+// JSONReport is the report written by the JSON reporter.
+type JSONReport struct {
+	Tests    []JSONTest            `json:"tests"`
+	Result   testresult.TestResult `json:"result"`
+	Platform string                `json:"platform"`
+	Version  string                `json:"version"`
+}
+
+// JSONTest is the result of a single test or subtest in a JSONReport.
+type JSONTest struct {
 	Name     string                `json:"name"`
 	Result   testresult.TestResult `json:"result"`
 	Duration time.Duration         `json:"duration"`
@@ -49,7 +60,7 @@ func NewJSONReporter(filename, platform, version string) *jsonReporter {
 }
 
 func (r *jsonReporter) ReportTest(name string, result testresult.TestResult, duration time.Duration, b []byte) {
-	r.Tests = append(r.Tests, jsonTest{
+	r.Tests = append(r.Tests, JSONTest{
 		Name:     name,
 		Result:   result,
 		Duration: duration,
@@ -70,3 +81,54 @@ func (r *jsonReporter) Output(path string) error {
 func (r *jsonReporter) SetResult(result testresult.TestResult) {
 	r.Result = result
 }
+
+// ReadJSONReport reads a report written by the JSON reporter.
+func ReadJSONReport(path string) (*JSONReport, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var report JSONReport
+	if err := json.NewDecoder(f).Decode(&report); err != nil {
+		return nil, fmt.Errorf("parsing %s: %v", path, err)
+	}
+	return &report, nil
+}
+
+// Failed returns the names of the top-level tests which failed, as well
+// as those which never completed because only some of their subtests
+// were recorded.
+func (r *JSONReport) Failed() []string {
+	var failed []string
+	completed := make(map[string]bool)
+	for _, t := range r.Tests {
+		if !strings.Contains(t.Name, "/") {
+			completed[t.Name] = true
+			if t.Result == testresult.Fail {
+				failed = append(failed, t.Name)
+			}
+		}
+	}
+	for _, t := range r.Tests {
+		name := strings.SplitN(t.Name, "/", 2)[0]
+		if !completed[name] {
+			completed[name] = true
+			failed = append(failed, name)
+		}
+	}
+	return failed
+}
+
+// Passed returns the names of the top-level tests which passed, including
+// those which only passed on a retry.
+func (r *JSONReport) Passed() []string {
+	var passed []string
+	for _, t := range r.Tests {
+		if !strings.Contains(t.Name, "/") && (t.Result == testresult.Pass || t.Result == testresult.Flaky) {
+			passed = append(passed, t.Name)
+		}
+	}
+	return passed
+}
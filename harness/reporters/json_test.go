@@ -0,0 +1,47 @@
+// Copyright The Mantle Authors.
+// SPDX-License-Identifier: Apache-2.0
+
+package reporters
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/flatcar/mantle/harness/testresult"
+)
+
+func TestJSONReport(t *testing.T) {
+	dir := t.TempDir()
+
+	r := NewJSONReporter("report.json", "qemu", "1.2.3")
+	r.ReportTest("a/x", testresult.Fail, time.Second, nil)
+	r.ReportTest("a", testresult.Fail, time.Second, nil)
+	r.ReportTest("b", testresult.Pass, time.Second, nil)
+	r.ReportTest("c", testresult.Flaky, time.Second, nil)
+	r.ReportTest("d", testresult.Skip, 0, nil)
+	// e never completed, only its subtest was recorded.
+	r.ReportTest("e/x", testresult.Pass, time.Second, nil)
+	r.SetResult(testresult.Fail)
+	if err := r.Output(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := ReadJSONReport(filepath.Join(dir, "report.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Platform != "qemu" || report.Version != "1.2.3" || report.Result != testresult.Fail {
+		t.Errorf("unexpected report context: %+v", report)
+	}
+	if len(report.Tests) != 6 || report.Tests[1].Duration != time.Second {
+		t.Errorf("unexpected tests: %+v", report.Tests)
+	}
+	if failed := report.Failed(); !reflect.DeepEqual(failed, []string{"a", "e"}) {
+		t.Errorf("unexpected failed tests: %v", failed)
+	}
+	if passed := report.Passed(); !reflect.DeepEqual(passed, []string{"b", "c"}) {
+		t.Errorf("unexpected passed tests: %v", passed)
+	}
+}
@@ -0,0 +1,263 @@
+// Copyright The Mantle Authors.
+// SPDX-License-Identifier: Apache-2.0
+
+package reporters
+
+import (
+	"encoding/xml"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/flatcar/mantle/harness/testresult"
+)
+
+// junitReporter collects test results and writes them as JUnit XML.
+// Top-level tests become testsuites, subtests become testcases, and
+// subtests which have subtests of their own become nested testsuites.
+type junitReporter struct {
+	mu       sync.Mutex
+	tests    map[string]*junitTest
+	filename string
+
+	// Context variables
+	platform string
+	version  string
+}
+
+type junitTest struct {
+	name     string
+	result   testresult.TestResult
+	duration time.Duration
+	output   string
+	children []*junitTest
+}
+
+type junitTestSuites struct {
+	XMLName  xml.Name         `xml:"testsuites"`
+	Tests    int              `xml:"tests,attr"`
+	Failures int              `xml:"failures,attr"`
+	Skipped  int              `xml:"skipped,attr"`
+	Time     string           `xml:"time,attr"`
+	Suites   []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name       string           `xml:"name,attr"`
+	Tests      int              `xml:"tests,attr"`
+	Failures   int              `xml:"failures,attr"`
+	Skipped    int              `xml:"skipped,attr"`
+	Time       string           `xml:"time,attr"`
+	Properties []junitProperty  `xml:"properties>property,omitempty"`
+	Cases      []junitTestCase  `xml:"testcase"`
+	Suites     []junitTestSuite `xml:"testsuite"`
+}
+
+type junitProperty struct {
+	Name  string `xml:"name,attr"`
+	Value string `xml:"value,attr"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	Classname string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitMessage `xml:"failure,omitempty"`
+	Skipped   *junitMessage `xml:"skipped,omitempty"`
+	SystemOut string        `xml:"system-out,omitempty"`
+}
+
+type junitMessage struct {
+	Message  string `xml:"message,attr,omitempty"`
+	Contents string `xml:",chardata"`
+}
+
+// NewJUnitReporter returns a Reporter which writes a JUnit XML document
+// to filename in the report directory. The platform and version are
+// recorded as properties of each top-level testsuite.
+func NewJUnitReporter(filename, platform, version string) *junitReporter {
+	return &junitReporter{
+		tests:    make(map[string]*junitTest),
+		platform: platform,
+		version:  version,
+		filename: filename,
+	}
+}
+
+func (r *junitReporter) ReportTest(name string, result testresult.TestResult, duration time.Duration, b []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.tests[name] = &junitTest{
+		name:     name,
+		result:   result,
+		duration: duration,
+		output:   string(b),
+	}
+}
+
+// SetResult is a no-op, JUnit derives the overall result from the
+// individual testcases.
+func (r *junitReporter) SetResult(result testresult.TestResult) {}
+
+func (r *junitReporter) Output(path string) error {
+	r.mu.Lock()
+	doc := r.document()
+	r.mu.Unlock()
+
+	f, err := os.Create(filepath.Join(path, r.filename))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err := f.WriteString(xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(f)
+	enc.Indent("", "  ")
+	if err := enc.Encode(doc); err != nil {
+		return err
+	}
+	_, err = f.WriteString("\n")
+	return err
+}
+
+// document builds the XML tree from the flat list of reported tests,
+// using the slash separated test names to find each subtest's parent.
+func (r *junitReporter) document() *junitTestSuites {
+	for _, t := range r.tests {
+		t.children = nil
+	}
+
+	var roots []*junitTest
+	for _, name := range sortedTestNames(r.tests) {
+		t := r.tests[name]
+		if parent := r.parent(name); parent != nil {
+			parent.children = append(parent.children, t)
+		} else {
+			roots = append(roots, t)
+		}
+	}
+
+	doc := &junitTestSuites{}
+	var total time.Duration
+	for _, t := range roots {
+		suite := r.suite(t)
+		suite.Properties = []junitProperty{
+			{Name: "platform", Value: r.platform},
+			{Name: "version", Value: r.version},
+		}
+		doc.Suites = append(doc.Suites, suite)
+		doc.Tests += suite.Tests
+		doc.Failures += suite.Failures
+		doc.Skipped += suite.Skipped
+		total += t.duration
+	}
+	doc.Time = junitDuration(total)
+	return doc
+}
+
+// parent returns the closest reported ancestor of the named test.
+func (r *junitReporter) parent(name string) *junitTest {
+	for i := strings.LastIndex(name, "/"); i > 0; i = strings.LastIndex(name, "/") {
+		name = name[:i]
+		if t, ok := r.tests[name]; ok {
+			return t
+		}
+	}
+	return nil
+}
+
+// suite converts a test and its subtests into a testsuite. Subtests
+// without subtests of their own become testcases. A test is reported as
+// a testcase of its own suite if it has no subtests or if its result is
+// not already explained by one of its subtests.
+func (r *junitReporter) suite(t *junitTest) junitTestSuite {
+	s := junitTestSuite{
+		Name: t.name,
+		Time: junitDuration(t.duration),
+	}
+
+	explained := t.result == testresult.Pass || t.result == testresult.Flaky
+	for _, c := range t.children {
+		if len(c.children) > 0 {
+			sub := r.suite(c)
+			s.Suites = append(s.Suites, sub)
+			s.Tests += sub.Tests
+			s.Failures += sub.Failures
+			s.Skipped += sub.Skipped
+		} else {
+			s.Cases = append(s.Cases, junitCase(c, t.name))
+			s.count(c.result)
+		}
+		if c.result == t.result {
+			explained = true
+		}
+	}
+
+	if len(t.children) == 0 || !explained {
+		s.Cases = append([]junitTestCase{junitCase(t, t.name)}, s.Cases...)
+		s.count(t.result)
+	}
+	return s
+}
+
+func (s *junitTestSuite) count(result testresult.TestResult) {
+	s.Tests++
+	switch result {
+	case testresult.Fail:
+		s.Failures++
+	case testresult.Skip:
+		s.Skipped++
+	}
+}
+
+func junitCase(t *junitTest, classname string) junitTestCase {
+	c := junitTestCase{
+		Name:      t.name,
+		Classname: classname,
+		Time:      junitDuration(t.duration),
+		SystemOut: t.output,
+	}
+	switch t.result {
+	case testresult.Fail:
+		c.Failure = &junitMessage{
+			Message:  firstLine(t.output),
+			Contents: t.output,
+		}
+		c.SystemOut = ""
+	case testresult.Skip:
+		c.Skipped = &junitMessage{
+			Message: firstLine(t.output),
+		}
+	}
+	return c
+}
+
+// firstLine returns the first non-empty line of the test output, which
+// is usually the message passed to Fatal or Skip.
+func firstLine(output string) string {
+	for _, line := range strings.Split(output, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			return line
+		}
+	}
+	return ""
+}
+
+func junitDuration(d time.Duration) string {
+	return fmt.Sprintf("%.3f", d.Seconds())
+}
+
+func sortedTestNames(tests map[string]*junitTest) []string {
+	names := make([]string, 0, len(tests))
+	for name := range tests {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,82 @@
+// Copyright The Mantle Authors.
+// SPDX-License-Identifier: Apache-2.0
+
+package reporters
+
+import (
+	"encoding/xml"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/flatcar/mantle/harness/testresult"
+)
+
+func TestJUnitReporter(t *testing.T) {
+	dir := t.TempDir()
+
+	r := NewJUnitReporter("junit.xml", "qemu", "1.2.3")
+	// Subtests are reported before their parents.
+	r.ReportTest("a/x", testresult.Pass, time.Second, []byte("x output\n"))
+	r.ReportTest("a/y/1", testresult.Fail, time.Second, []byte("y1 failed\nmore\n"))
+	r.ReportTest("a/y", testresult.Fail, 2*time.Second, nil)
+	r.ReportTest("a", testresult.Fail, 3*time.Second, nil)
+	r.ReportTest("b", testresult.Skip, 0, []byte("  not supported\n"))
+	r.ReportTest("c", testresult.Fail, time.Second, []byte("c failed after subtests\n"))
+	r.ReportTest("c/z", testresult.Pass, time.Second, nil)
+	r.SetResult(testresult.Fail)
+
+	if err := r.Output(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(filepath.Join(dir, "junit.xml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var doc junitTestSuites
+	if err := xml.NewDecoder(f).Decode(&doc); err != nil {
+		t.Fatal(err)
+	}
+
+	if doc.Tests != 5 || doc.Failures != 2 || doc.Skipped != 1 {
+		t.Errorf("unexpected totals: tests=%d failures=%d skipped=%d",
+			doc.Tests, doc.Failures, doc.Skipped)
+	}
+	if len(doc.Suites) != 3 {
+		t.Fatalf("expected 3 testsuites, got %d", len(doc.Suites))
+	}
+
+	a := doc.Suites[0]
+	if a.Name != "a" || len(a.Cases) != 1 || len(a.Suites) != 1 {
+		t.Fatalf("unexpected suite a: %+v", a)
+	}
+	if a.Properties[0] != (junitProperty{"platform", "qemu"}) ||
+		a.Properties[1] != (junitProperty{"version", "1.2.3"}) {
+		t.Errorf("unexpected properties: %v", a.Properties)
+	}
+	if a.Cases[0].Name != "a/x" || a.Cases[0].Failure != nil || a.Cases[0].SystemOut != "x output\n" {
+		t.Errorf("unexpected testcase a/x: %+v", a.Cases[0])
+	}
+	y := a.Suites[0]
+	if y.Name != "a/y" || len(y.Cases) != 1 || y.Failures != 1 {
+		t.Fatalf("unexpected suite a/y: %+v", y)
+	}
+	if fail := y.Cases[0].Failure; fail == nil || fail.Message != "y1 failed" {
+		t.Errorf("unexpected failure for a/y/1: %+v", fail)
+	}
+
+	b := doc.Suites[1]
+	if len(b.Cases) != 1 || b.Cases[0].Skipped == nil || b.Cases[0].Skipped.Message != "not supported" {
+		t.Errorf("unexpected suite b: %+v", b)
+	}
+
+	// c failed on its own, so it needs its own testcase.
+	c := doc.Suites[2]
+	if len(c.Cases) != 2 || c.Cases[0].Name != "c" || c.Cases[0].Failure == nil {
+		t.Errorf("unexpected suite c: %+v", c)
+	}
+}
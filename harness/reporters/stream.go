@@ -0,0 +1,119 @@
+// Copyright The Mantle Authors.
+// SPDX-License-Identifier: Apache-2.0
+
+package reporters
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/flatcar/mantle/harness/testresult"
+)
+
+// Types of the events reported while the tests run.
+const (
+	EventTestStart        = "test-start"
+	EventSubtestStart     = "subtest-start"
+	EventTestPause        = "test-pause"    // parallel test waiting to run
+	EventTestContinue     = "test-continue" // parallel test running again
+	EventLog              = "log"
+	EventMachineCreated   = "machine-created"
+	EventMachineDestroyed = "machine-destroyed"
+	EventTestEnd          = "test-end"
+	EventRunEnd           = "run-end"
+)
+
+// Event is something happening while the tests run. Only the fields
+// relevant to the type of the event are set.
+type Event struct {
+	Time     time.Time             `json:"time"`
+	Type     string                `json:"type"`
+	Test     string                `json:"test,omitempty"`
+	Attempt  int                   `json:"attempt,omitempty"`
+	Result   testresult.TestResult `json:"result,omitempty"`
+	Duration time.Duration         `json:"duration,omitempty"`
+	Message  string                `json:"message,omitempty"`
+	Machine  string                `json:"machine,omitempty"`
+	IP       string                `json:"ip,omitempty"`
+}
+
+// EventReporter is a Reporter which is also told about events while the
+// tests run. Events may be reported concurrently.
+type EventReporter interface {
+	Reporter
+	Event(Event)
+}
+
+// Event forwards the event to the reporters which implement EventReporter.
+func (reps Reporters) Event(e Event) {
+	for _, r := range reps {
+		if er, ok := r.(EventReporter); ok {
+			er.Event(e)
+		}
+	}
+}
+
+type streamReporter struct {
+	mu  sync.Mutex
+	w   io.WriteCloser
+	enc *json.Encoder
+	err error
+}
+
+// NewStreamReporter returns a Reporter which writes each event as a line
+// of JSON as soon as it happens. The target is either a file, which is
+// truncated, or a unix socket given as "unix:/path/to/socket".
+func NewStreamReporter(target string) (*streamReporter, error) {
+	var w io.WriteCloser
+	var err error
+	if path := strings.TrimPrefix(target, "unix:"); path != target {
+		w, err = net.Dial("unix", path)
+	} else {
+		w, err = os.Create(target)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &streamReporter{
+		w:   w,
+		enc: json.NewEncoder(w),
+	}, nil
+}
+
+func (r *streamReporter) Event(e Event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	// Keep running the tests if the reader goes away, the error is
+	// returned by Output.
+	if r.err == nil {
+		r.err = r.enc.Encode(e)
+	}
+}
+
+// ReportTest is a no-op, the end of each test is streamed as an event
+// when it happens.
+func (r *streamReporter) ReportTest(name string, result testresult.TestResult, duration time.Duration, b []byte) {
+}
+
+func (r *streamReporter) SetResult(result testresult.TestResult) {
+	r.Event(Event{
+		Time:   time.Now(),
+		Type:   EventRunEnd,
+		Result: result,
+	})
+}
+
+// Output closes the stream, the events have already been written.
+func (r *streamReporter) Output(path string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.w.Close(); r.err == nil {
+		r.err = err
+	}
+	return r.err
+}
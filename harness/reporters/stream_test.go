@@ -0,0 +1,61 @@
+// Copyright The Mantle Authors.
+// SPDX-License-Identifier: Apache-2.0
+
+package reporters
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/flatcar/mantle/harness/testresult"
+)
+
+func TestStreamReporterSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	events := make(chan Event)
+	go func() {
+		defer close(events)
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		scanner := bufio.NewScanner(conn)
+		for scanner.Scan() {
+			var e Event
+			if err := json.Unmarshal(scanner.Bytes(), &e); err == nil {
+				events <- e
+			}
+		}
+	}()
+
+	r, err := NewStreamReporter("unix:" + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	Reporters{r}.Event(Event{Time: time.Now(), Type: EventTestStart, Test: "a"})
+	r.SetResult(testresult.Pass)
+
+	if e := <-events; e.Type != EventTestStart || e.Test != "a" {
+		t.Errorf("unexpected event: %+v", e)
+	}
+	if e := <-events; e.Type != EventRunEnd || e.Result != testresult.Pass {
+		t.Errorf("unexpected event: %+v", e)
+	}
+	if err := r.Output(""); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := <-events; ok {
+		t.Error("stream not closed")
+	}
+}
@@ -74,6 +74,10 @@ type Options struct {
 	// Limit number of tests to run in parallel (0 means GOMAXPROCS).
 	Parallel int
 
+	// Rerun failed top-level tests up to this many times (0 means never).
+	// A test which passes on a later attempt is reported as flaky.
+	Retries int
+
 	Reporters reporters.Reporters
 }
 
@@ -106,6 +110,8 @@ func (o *Options) FlagSet(prefix string, errorHandling flag.ErrorHandling) *flag
 		"fail test binary execution after duration `d` (0 means unlimited)")
 	f.IntVar(&o.Parallel, prefix+"parallel", o.Parallel,
 		"run at most `n` tests in parallel")
+	f.IntVar(&o.Retries, prefix+"retry", o.Retries,
+		"rerun failed tests up to `n` times")
 	return f
 }
 
@@ -274,6 +280,49 @@ func (s *Suite) Run() (err error) {
 }
 
 func (s *Suite) runTests(out, tap io.Writer) error {
+	failed := false
+	tests := s.tests
+	for attempt := 0; len(tests) > 0; attempt++ {
+		t := s.runAttempt(out, tap, tests, attempt)
+		if attempt == 0 && !t.ran {
+			return SuiteEmpty
+		}
+
+		// Collect the tests which failed but may be tried once more.
+		tests = nil
+		for _, c := range t.top {
+			if c.willRetry() {
+				if err := c.writeAttemptLog(); err != nil {
+					fmt.Fprintf(out, "harness: %v\n", err)
+				}
+				tests.Add(c.name, s.tests[c.name])
+			} else if c.Failed() {
+				failed = true
+			}
+		}
+		for _, name := range tests.List() {
+			fmt.Fprintf(out, "=== RETRY %s (attempt %d of %d)\n", name, attempt+2, s.opts.Retries+1)
+		}
+	}
+
+	if failed {
+		s.opts.Reporters.SetResult(testresult.Fail)
+		return SuiteFailed
+	}
+
+	s.opts.Reporters.SetResult(testresult.Pass)
+
+	return nil
+}
+
+// runAttempt runs the given tests under a new root test and returns
+// it once all tests have completed.
+func (s *Suite) runAttempt(out, tap io.Writer, tests Tests, attempt int) *H {
+	if attempt > 0 {
+		// Forget the subtest names of the previous attempt so that the
+		// subtests of retried tests keep their names.
+		s.match = newMatcher(s.opts.Match, "Match")
+	}
 	s.running = 1 // Set the count to 1 for the main (sequential) test.
 	t := &H{
 		signal:    make(chan bool),
@@ -281,10 +330,11 @@ func (s *Suite) runTests(out, tap io.Writer) error {
 		w:         out,
 		tap:       tap,
 		suite:     s,
+		attempt:   attempt,
 		reporters: s.opts.Reporters,
 	}
 	tRunner(t, func(t *H) {
-		for name, test := range s.tests {
+		for name, test := range tests {
 			t.Run(name, test)
 		}
 		// Run catching the signal rather than the tRunner as a separate
@@ -292,17 +342,7 @@ func (s *Suite) runTests(out, tap io.Writer) error {
 		// phase as this pollutes the stacktrace output when aborting.
 		go func() { <-t.signal }()
 	})
-	if !t.ran {
-		return SuiteEmpty
-	}
-	if t.Failed() {
-		s.opts.Reporters.SetResult(testresult.Fail)
-		return SuiteFailed
-	}
-
-	s.opts.Reporters.SetResult(testresult.Pass)
-
-	return nil
+	return t
 }
 
 // outputPath returns the file name under Options.OutputDir.
@@ -0,0 +1,52 @@
+// Copyright The Mantle Authors.
+// SPDX-License-Identifier: Apache-2.0
+
+package harness
+
+import (
+	"bufio"
+	"os"
+	"strings"
+
+	"github.com/flatcar/mantle/harness/testresult"
+)
+
+// ReadTAP reads the results of the top-level tests from the test.tap file
+// a suite writes to its output directory. The file is written as tests
+// complete, so it also records the results of an interrupted run.
+func ReadTAP(path string) (map[string]testresult.TestResult, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	results := make(map[string]testresult.TestResult)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		var result testresult.TestResult
+		switch {
+		case strings.HasPrefix(line, "ok - "):
+			line = strings.TrimPrefix(line, "ok - ")
+			result = testresult.Pass
+		case strings.HasPrefix(line, "not ok - "):
+			line = strings.TrimPrefix(line, "not ok - ")
+			result = testresult.Fail
+		default:
+			continue
+		}
+		name, directive, _ := strings.Cut(line, " # ")
+		switch directive {
+		case "SKIP":
+			result = testresult.Skip
+		case "FLAKY":
+			result = testresult.Flaky
+		}
+		results[name] = result
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
@@ -0,0 +1,43 @@
+// Copyright The Mantle Authors.
+// SPDX-License-Identifier: Apache-2.0
+
+package harness
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/flatcar/mantle/harness/testresult"
+)
+
+func TestReadTAP(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.tap")
+	tap := `1..5
+ok - a
+not ok - b
+  ---
+  Error: "b.go:1: ok - c"
+  ...
+ok - c # SKIP
+ok - d # FLAKY
+`
+	if err := os.WriteFile(path, []byte(tap), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	results, err := ReadTAP(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]testresult.TestResult{
+		"a": testresult.Pass,
+		"b": testresult.Fail,
+		"c": testresult.Skip,
+		"d": testresult.Flaky,
+	}
+	if !reflect.DeepEqual(results, expected) {
+		t.Errorf("got %v, expected %v", results, expected)
+	}
+}
@@ -18,6 +18,9 @@ const (
 	Fail TestResult = "FAIL"
 	Skip TestResult = "SKIP"
 	Pass TestResult = "PASS"
+
+	// Flaky is a test which passed only after being retried.
+	Flaky TestResult = "FLAKY"
 )
 
 type TestResult string
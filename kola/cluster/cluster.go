@@ -16,10 +16,13 @@ package cluster
 
 import (
 	"bytes"
+	"context"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 
 	"github.com/flatcar/mantle/harness"
 	"github.com/flatcar/mantle/platform"
@@ -106,19 +109,67 @@ func (t *TestCluster) DropFile(localPath string) error {
 }
 
 // SSH runs a ssh command on the given machine in the cluster. It differs from
-// Machine.SSH in that stderr is written to the test's output as a 'Log' line.
-// This ensures the output will be correctly accumulated under the correct
-// test.
+// Machine.SSH in that stderr is written to the test's output as 'Log' lines
+// while the command runs, and the command is killed when the test's context
+// is cancelled, e.g. on timeout. This ensures the output will be correctly
+// accumulated under the correct test.
 func (t *TestCluster) SSH(m platform.Machine, cmd string) ([]byte, error) {
-	stdout, stderr, err := m.SSH(cmd)
+	res, err := t.RunContext(t.Context(), m, cmd, platform.RunOptions{})
+	if res == nil {
+		return nil, err
+	}
+	return bytes.TrimSpace(res.Stdout), err
+}
+
+// RunContext runs a command on the given machine like Machine.RunContext,
+// writing its stderr to the test's output unless opts.Stderr is set. Use
+// LogWriter to stream stdout into the test's output as well.
+func (t *TestCluster) RunContext(ctx context.Context, m platform.Machine, cmd string, opts platform.RunOptions) (*platform.RunResult, error) {
+	if opts.Stderr == nil {
+		w := t.LogWriter("")
+		defer w.Close()
+		opts.Stderr = w
+	}
+	return m.RunContext(ctx, cmd, opts)
+}
+
+// LogWriter returns a writer which writes every line to the test's output
+// as a 'Log' line, starting with prefix. Close writes an incomplete last
+// line.
+func (t *TestCluster) LogWriter(prefix string) io.WriteCloser {
+	return &logWriter{h: t.H, prefix: prefix}
+}
+
+type logWriter struct {
+	h      *harness.H
+	prefix string
+	mu     sync.Mutex
+	buf    []byte
+}
 
-	if len(stderr) > 0 {
-		for _, line := range strings.Split(string(stderr), "\n") {
-			t.Log(line)
+func (w *logWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
 		}
+		w.h.Log(w.prefix + string(w.buf[:i]))
+		w.buf = w.buf[i+1:]
 	}
+	return len(p), nil
+}
 
-	return stdout, err
+func (w *logWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.buf) > 0 {
+		w.h.Log(w.prefix + string(w.buf))
+		w.buf = nil
+	}
+	return nil
 }
 
 // MustSSH runs a ssh command on the given machine in the cluster, writes
@@ -0,0 +1,170 @@
+// Copyright The Mantle Authors.
+// SPDX-License-Identifier: Apache-2.0
+
+package kola
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/flatcar/mantle/kola/register"
+)
+
+// Severities of console checks.
+const (
+	SeverityFail   = "fail"   // fail the test, the default
+	SeverityWarn   = "warn"   // only log a warning
+	SeverityIgnore = "ignore" // disable the check
+)
+
+type consoleCheck struct {
+	desc        string
+	match       *regexp.Regexp
+	skipIfMatch *regexp.Regexp
+	skipFlag    *register.Flag
+	severity    string
+	platforms   []string // platforms the check applies to, all if empty
+	tests       []string // glob patterns of the tests the check applies to, all if empty
+}
+
+func (check *consoleCheck) appliesTo(t *register.Test, pltfrm string) bool {
+	if len(check.platforms) > 0 {
+		found := false
+		for _, p := range check.platforms {
+			if p == pltfrm {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(check.tests) > 0 {
+		if t == nil {
+			return false
+		}
+		for _, pattern := range check.tests {
+			if match, _ := filepath.Match(pattern, t.Name); match {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// ConsoleRules is the file format of additional console and journal
+// checks:
+//
+//	rules:
+//	  - desc: known bad message
+//	    match: "something (went wrong)"
+//	  - desc: kernel warning
+//	    severity: warn
+//	    platforms: [qemu]
+//	    tests: ["cl.internet"]
+//
+// A rule with the description of an existing check overrides it for
+// the platforms and tests the rule applies to, e.g. to turn it into a
+// warning or to ignore it. Other rules add new checks.
+type ConsoleRules struct {
+	Rules []ConsoleRule `yaml:"rules"`
+}
+
+// ConsoleRule is a single check of ConsoleRules. Match and SkipIfMatch
+// are regular expressions, if Match has a subexpression the first one is
+// included in the reported badness. Match may only be omitted when
+// overriding an existing check, which is then used.
+type ConsoleRule struct {
+	Desc        string   `yaml:"desc"`
+	Match       string   `yaml:"match"`
+	SkipIfMatch string   `yaml:"skipIfMatch"`
+	Severity    string   `yaml:"severity"`
+	Platforms   []string `yaml:"platforms"`
+	Tests       []string `yaml:"tests"`
+}
+
+// LoadConsoleRules adds the rules from a YAML file to the console checks.
+func LoadConsoleRules(path string) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var rules ConsoleRules
+	dec := yaml.NewDecoder(bytes.NewReader(b))
+	dec.KnownFields(true)
+	if err := dec.Decode(&rules); err != nil {
+		return fmt.Errorf("parsing %s: %v", path, err)
+	}
+
+	for i, rule := range rules.Rules {
+		check, err := rule.check()
+		if err != nil {
+			return fmt.Errorf("%s: rule %d: %v", path, i, err)
+		}
+		consoleChecks = append(consoleChecks, check)
+	}
+	return nil
+}
+
+func (rule *ConsoleRule) check() (consoleCheck, error) {
+	if rule.Desc == "" {
+		return consoleCheck{}, fmt.Errorf("missing description")
+	}
+	check := consoleCheck{
+		desc:      rule.Desc,
+		severity:  rule.Severity,
+		platforms: rule.Platforms,
+		tests:     rule.Tests,
+	}
+	switch rule.Severity {
+	case "":
+		check.severity = SeverityFail
+	case SeverityFail, SeverityWarn, SeverityIgnore:
+	default:
+		return consoleCheck{}, fmt.Errorf("unknown severity %q", rule.Severity)
+	}
+	for _, pattern := range rule.Tests {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return consoleCheck{}, fmt.Errorf("test pattern %q: %v", pattern, err)
+		}
+	}
+
+	var err error
+	if rule.Match != "" {
+		if check.match, err = regexp.Compile(rule.Match); err != nil {
+			return consoleCheck{}, fmt.Errorf("match: %v", err)
+		}
+	}
+	if rule.SkipIfMatch != "" {
+		if check.skipIfMatch, err = regexp.Compile(rule.SkipIfMatch); err != nil {
+			return consoleCheck{}, fmt.Errorf("skipIfMatch: %v", err)
+		}
+	}
+
+	// an override inherits what it doesn't redefine from the check
+	// it overrides
+	for _, existing := range consoleChecks {
+		if existing.desc != rule.Desc {
+			continue
+		}
+		check.skipFlag = existing.skipFlag
+		if rule.Match == "" {
+			check.match = existing.match
+			if check.skipIfMatch == nil {
+				check.skipIfMatch = existing.skipIfMatch
+			}
+		}
+	}
+	if check.match == nil {
+		return consoleCheck{}, fmt.Errorf("missing match for new check %q", rule.Desc)
+	}
+	return check, nil
+}
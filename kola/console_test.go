@@ -0,0 +1,198 @@
+// Copyright The Mantle Authors.
+// SPDX-License-Identifier: Apache-2.0
+
+package kola
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"testing"
+
+	"github.com/flatcar/mantle/kola/register"
+)
+
+// loadRules replaces the console checks with checks plus the rules of
+// the given YAML document, restoring the previous checks when the test
+// finishes.
+func loadRules(t *testing.T, checks []consoleCheck, rules string) error {
+	saved := consoleChecks
+	t.Cleanup(func() { consoleChecks = saved })
+	consoleChecks = checks
+
+	dir, err := ioutil.TempDir("", "kola-console")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "rules.yaml")
+	if err := ioutil.WriteFile(path, []byte(rules), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return LoadConsoleRules(path)
+}
+
+func TestLoadConsoleRules(t *testing.T) {
+	err := loadRules(t, nil, `
+rules:
+  - desc: known bad message
+    match: "something (went wrong)"
+  - desc: kernel warning
+    match: "WARNING: CPU"
+    skipIfMatch: "expected warning"
+    severity: warn
+    platforms: [qemu, aws]
+    tests: ["cl.internet", "cl.etcd-*"]
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(consoleChecks) != 2 {
+		t.Fatalf("expected 2 checks, got %d", len(consoleChecks))
+	}
+
+	check := consoleChecks[0]
+	if check.desc != "known bad message" || check.match.String() != "something (went wrong)" ||
+		check.skipIfMatch != nil || check.severity != SeverityFail ||
+		check.platforms != nil || check.tests != nil {
+		t.Errorf("unexpected first check: %+v", check)
+	}
+
+	check = consoleChecks[1]
+	if check.desc != "kernel warning" || check.match.String() != "WARNING: CPU" ||
+		check.skipIfMatch.String() != "expected warning" || check.severity != SeverityWarn ||
+		!reflect.DeepEqual(check.platforms, []string{"qemu", "aws"}) ||
+		!reflect.DeepEqual(check.tests, []string{"cl.internet", "cl.etcd-*"}) {
+		t.Errorf("unexpected second check: %+v", check)
+	}
+}
+
+func TestLoadConsoleRulesInvalid(t *testing.T) {
+	for name, rules := range map[string]string{
+		"unknown field":    "rules:\n  - desc: a\n    match: b\n    severty: warn\n",
+		"no description":   "rules:\n  - match: b\n",
+		"no match":         "rules:\n  - desc: new check\n",
+		"unknown severity": "rules:\n  - desc: a\n    match: b\n    severity: fatal\n",
+		"bad match":        "rules:\n  - desc: a\n    match: \"(\"\n",
+		"bad skipIfMatch":  "rules:\n  - desc: a\n    match: b\n    skipIfMatch: \"(\"\n",
+		"bad test pattern": "rules:\n  - desc: a\n    match: b\n    tests: [\"[\"]\n",
+	} {
+		t.Run(name, func(t *testing.T) {
+			if err := loadRules(t, nil, rules); err == nil {
+				t.Errorf("expected an error")
+			}
+		})
+	}
+}
+
+func TestConsoleCheckAppliesTo(t *testing.T) {
+	internet := &register.Test{Name: "cl.internet"}
+	etcd := &register.Test{Name: "cl.etcd-member.discovery"}
+	for _, c := range []struct {
+		check  consoleCheck
+		test   *register.Test
+		pltfrm string
+		want   bool
+	}{
+		{consoleCheck{}, nil, "", true},
+		{consoleCheck{}, internet, "qemu", true},
+		{consoleCheck{platforms: []string{"qemu"}}, internet, "qemu", true},
+		{consoleCheck{platforms: []string{"qemu"}}, internet, "aws", false},
+		// check-console without --platform
+		{consoleCheck{platforms: []string{"qemu"}}, nil, "", false},
+		{consoleCheck{tests: []string{"cl.etcd-*"}}, etcd, "qemu", true},
+		{consoleCheck{tests: []string{"cl.etcd-*"}}, internet, "qemu", false},
+		// check-console checks output without a test
+		{consoleCheck{tests: []string{"cl.etcd-*"}}, nil, "qemu", false},
+		{consoleCheck{platforms: []string{"aws"}, tests: []string{"cl.etcd-*"}}, etcd, "qemu", false},
+	} {
+		name := "<none>"
+		if c.test != nil {
+			name = c.test.Name
+		}
+		if got := c.check.appliesTo(c.test, c.pltfrm); got != c.want {
+			t.Errorf("check for platforms %v and tests %v applies to test %s on %q: got %v, want %v",
+				c.check.platforms, c.check.tests, name, c.pltfrm, got, c.want)
+		}
+	}
+}
+
+func TestConsoleRulesOverride(t *testing.T) {
+	flag := register.NoKernelPanicCheck
+	base := []consoleCheck{{
+		desc:     "kernel panic",
+		match:    regexp.MustCompile("Kernel panic - not syncing: (.*)"),
+		skipFlag: &flag,
+	}}
+	err := loadRules(t, base, `
+rules:
+  - desc: kernel panic
+    severity: warn
+    platforms: [qemu]
+  - desc: kernel panic
+    severity: ignore
+    tests: ["cl.ignored"]
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, check := range consoleChecks[1:] {
+		if check.match != base[0].match || check.skipFlag != base[0].skipFlag {
+			t.Errorf("override didn't inherit the match and skip flag: %+v", check)
+		}
+	}
+
+	output := []byte("Kernel panic - not syncing: oops\n")
+	test := &register.Test{Name: "cl.test"}
+	for _, c := range []struct {
+		test     *register.Test
+		pltfrm   string
+		badness  []string
+		warnings []string
+	}{
+		{test, "qemu", nil, []string{"kernel panic (oops)"}},
+		{test, "aws", []string{"kernel panic (oops)"}, nil},
+		{nil, "", []string{"kernel panic (oops)"}, nil},
+		{&register.Test{Name: "cl.ignored"}, "aws", nil, nil},
+		{&register.Test{Name: "cl.flagged", Flags: []register.Flag{flag}}, "aws", nil, nil},
+	} {
+		badness, warnings := CheckConsole(output, c.test, c.pltfrm)
+		if !reflect.DeepEqual(badness, c.badness) || !reflect.DeepEqual(warnings, c.warnings) {
+			t.Errorf("test %v on %q: got badness %q and warnings %q, want %q and %q",
+				c.test, c.pltfrm, badness, warnings, c.badness, c.warnings)
+		}
+	}
+}
+
+func TestConsoleRulesSkipIfMatch(t *testing.T) {
+	err := loadRules(t, nil, `
+rules:
+  - desc: failed unit
+    match: "Failed to start (.*)\\."
+    skipIfMatch: "Failed to start Expected Failure\\."
+  - desc: slow boot
+    match: "took too long"
+    severity: warn
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		output   string
+		badness  []string
+		warnings []string
+	}{
+		{"Failed to start Foo.\n", []string{"failed unit (Foo)"}, nil},
+		{"Failed to start Foo.\nFailed to start Expected Failure.\n", nil, nil},
+		{"boot took too long\n", nil, []string{"slow boot"}},
+		{"all good\n", nil, nil},
+	} {
+		badness, warnings := CheckConsole([]byte(c.output), nil, "")
+		if !reflect.DeepEqual(badness, c.badness) || !reflect.DeepEqual(warnings, c.warnings) {
+			t.Errorf("%q: got badness %q and warnings %q, want %q and %q",
+				c.output, badness, warnings, c.badness, c.warnings)
+		}
+	}
+}
@@ -0,0 +1,345 @@
+// Copyright The Mantle Authors.
+// SPDX-License-Identifier: Apache-2.0
+
+// Package declarative loads kola tests which are described in YAML or
+// JSON files instead of Go code. Each file describes a single test:
+//
+//	name: cl.example.hostname
+//	userdata:
+//	  kind: butane
+//	  data: |
+//	    variant: flatcar
+//	    version: 1.0.0
+//	    storage:
+//	      files:
+//	        - path: /etc/hostname
+//	          contents:
+//	            inline: example
+//	platforms: [qemu, qemu-unpriv]
+//	minVersion: 3033.0.0
+//	commands:
+//	  - run: hostname
+//	    stdout: ["^example$"]
+//	  - run: systemctl is-active does-not-exist.service
+//	    exitCode: 3
+//
+// The commands are run in order on every machine of the cluster, each
+// one as a subtest of the test.
+package declarative
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/coreos/go-semver/semver"
+	"golang.org/x/crypto/ssh"
+	"gopkg.in/yaml.v3"
+
+	"github.com/flatcar/mantle/kola/cluster"
+	"github.com/flatcar/mantle/kola/register"
+	"github.com/flatcar/mantle/platform/conf"
+)
+
+// Test is the file format of a declarative test.
+type Test struct {
+	Name             string    `yaml:"name"`
+	UserData         *UserData `yaml:"userdata"`
+	ClusterSize      *int      `yaml:"clusterSize"`
+	Platforms        []string  `yaml:"platforms"`
+	ExcludePlatforms []string  `yaml:"excludePlatforms"`
+	Distros          []string  `yaml:"distros"`
+	ExcludeDistros   []string  `yaml:"excludeDistros"`
+	Channels         []string  `yaml:"channels"`
+	ExcludeChannels  []string  `yaml:"excludeChannels"`
+	Offerings        []string  `yaml:"offerings"`
+	ExcludeOfferings []string  `yaml:"excludeOfferings"`
+	Architectures    []string  `yaml:"architectures"`
+	MinVersion       string    `yaml:"minVersion"`
+	EndVersion       string    `yaml:"endVersion"`
+	Commands         []Command `yaml:"commands"`
+}
+
+// UserData is the configuration passed to the machines of the test.
+// Data and File are mutually exclusive, File is relative to the
+// directory of the test file. If Kind is empty it is guessed from the
+// contents.
+type UserData struct {
+	Kind string `yaml:"kind"`
+	Data string `yaml:"data"`
+	File string `yaml:"file"`
+}
+
+// Command is a shell command run on the machines of the test. Stdout
+// and Stderr are lists of regular expressions which must all match the
+// respective output of the command.
+type Command struct {
+	Name     string   `yaml:"name"`
+	Run      string   `yaml:"run"`
+	ExitCode int      `yaml:"exitCode"`
+	Stdout   []string `yaml:"stdout"`
+	Stderr   []string `yaml:"stderr"`
+}
+
+var userDataKinds = map[string]func(string) *conf.UserData{
+	"":                       conf.Unknown,
+	"butane":                 conf.Butane,
+	"ignition":               conf.Ignition,
+	"container-linux-config": conf.ContainerLinuxConfig,
+	"cloud-config":           conf.CloudConfig,
+	"script":                 conf.Script,
+	"multipart-mime":         conf.MultipartMimeConfig,
+}
+
+// RegisterDir loads every .yaml, .yml and .json file in dir and registers
+// the tests they describe.
+func RegisterDir(dir string) error {
+	tests, err := LoadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, t := range tests {
+		if _, ok := register.Tests[t.Name]; ok {
+			return fmt.Errorf("test %v already registered", t.Name)
+		}
+		register.Register(t)
+	}
+	return nil
+}
+
+// LoadDir loads every .yaml, .yml and .json file in dir and returns the
+// tests they describe, sorted by file name.
+func LoadDir(dir string) ([]*register.Test, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []string
+	for _, e := range entries {
+		switch filepath.Ext(e.Name()) {
+		case ".yaml", ".yml", ".json":
+			if !e.IsDir() {
+				files = append(files, filepath.Join(dir, e.Name()))
+			}
+		}
+	}
+	sort.Strings(files)
+
+	var tests []*register.Test
+	for _, file := range files {
+		t, err := LoadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		tests = append(tests, t)
+	}
+	return tests, nil
+}
+
+// LoadFile parses a single test file.
+func LoadFile(path string) (*register.Test, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var spec Test
+	dec := yaml.NewDecoder(bytes.NewReader(b))
+	dec.KnownFields(true)
+	if err := dec.Decode(&spec); err != nil {
+		return nil, fmt.Errorf("parsing %s: %v", path, err)
+	}
+
+	t, err := spec.test(filepath.Dir(path))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return t, nil
+}
+
+// test converts the file format into a registrable test.
+func (spec *Test) test(dir string) (*register.Test, error) {
+	if spec.Name == "" {
+		return nil, fmt.Errorf("missing test name")
+	}
+	if len(spec.Commands) == 0 {
+		return nil, fmt.Errorf("test %v has no commands", spec.Name)
+	}
+
+	t := &register.Test{
+		Name:             spec.Name,
+		ClusterSize:      1,
+		Platforms:        spec.Platforms,
+		ExcludePlatforms: spec.ExcludePlatforms,
+		Distros:          spec.Distros,
+		ExcludeDistros:   spec.ExcludeDistros,
+		Channels:         spec.Channels,
+		ExcludeChannels:  spec.ExcludeChannels,
+		Offerings:        spec.Offerings,
+		ExcludeOfferings: spec.ExcludeOfferings,
+		Architectures:    spec.Architectures,
+	}
+	if spec.ClusterSize != nil {
+		if *spec.ClusterSize < 1 {
+			return nil, fmt.Errorf("test %v needs at least one machine to run commands on", spec.Name)
+		}
+		t.ClusterSize = *spec.ClusterSize
+	}
+
+	if spec.UserData != nil {
+		userdata, err := spec.UserData.userData(dir)
+		if err != nil {
+			return nil, err
+		}
+		// The declared config is used regardless of the Ignition version
+		// kola selects for the distribution.
+		t.UserData = userdata
+		t.UserDataV3 = userdata
+	}
+
+	for _, v := range []struct {
+		field string
+		in    string
+		out   *semver.Version
+	}{
+		{"minVersion", spec.MinVersion, &t.MinVersion},
+		{"endVersion", spec.EndVersion, &t.EndVersion},
+	} {
+		if v.in == "" {
+			continue
+		}
+		version, err := semver.NewVersion(v.in)
+		if err != nil {
+			return nil, fmt.Errorf("parsing %s: %v", v.field, err)
+		}
+		*v.out = *version
+	}
+	if (t.EndVersion != semver.Version{}) && !t.MinVersion.LessThan(t.EndVersion) {
+		return nil, fmt.Errorf("test %v has an invalid version range", t.Name)
+	}
+
+	commands := make([]command, len(spec.Commands))
+	for i, c := range spec.Commands {
+		cmd, err := c.compile(i)
+		if err != nil {
+			return nil, fmt.Errorf("command %d: %v", i, err)
+		}
+		commands[i] = cmd
+	}
+	t.Run = func(c cluster.TestCluster) {
+		for _, cmd := range commands {
+			cmd := cmd
+			c.Run(cmd.name, cmd.run)
+		}
+	}
+
+	return t, nil
+}
+
+func (u *UserData) userData(dir string) (*conf.UserData, error) {
+	newUserData, ok := userDataKinds[u.Kind]
+	if !ok {
+		return nil, fmt.Errorf("unknown userdata kind %q", u.Kind)
+	}
+
+	data := u.Data
+	if u.File != "" {
+		if data != "" {
+			return nil, fmt.Errorf("userdata data and file are mutually exclusive")
+		}
+		path := u.File
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(dir, path)
+		}
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		data = string(b)
+	}
+
+	return newUserData(data), nil
+}
+
+type command struct {
+	name     string
+	cmd      string
+	exitCode int
+	stdout   []*regexp.Regexp
+	stderr   []*regexp.Regexp
+}
+
+func (c *Command) compile(i int) (command, error) {
+	if strings.TrimSpace(c.Run) == "" {
+		return command{}, fmt.Errorf("missing command to run")
+	}
+
+	cmd := command{
+		name:     c.Name,
+		cmd:      c.Run,
+		exitCode: c.ExitCode,
+	}
+	if cmd.name == "" {
+		cmd.name = fmt.Sprintf("cmd%d", i)
+	}
+
+	compile := func(exprs []string) ([]*regexp.Regexp, error) {
+		var res []*regexp.Regexp
+		for _, expr := range exprs {
+			re, err := regexp.Compile(expr)
+			if err != nil {
+				return nil, err
+			}
+			res = append(res, re)
+		}
+		return res, nil
+	}
+	var err error
+	if cmd.stdout, err = compile(c.Stdout); err != nil {
+		return command{}, fmt.Errorf("stdout: %v", err)
+	}
+	if cmd.stderr, err = compile(c.Stderr); err != nil {
+		return command{}, fmt.Errorf("stderr: %v", err)
+	}
+
+	return cmd, nil
+}
+
+// run executes the command on every machine of the cluster and checks
+// its exit code and output.
+func (cmd command) run(c cluster.TestCluster) {
+	c.Logf("+ %s", cmd.cmd)
+	for _, m := range c.Machines() {
+		stdout, stderr, err := m.SSH(cmd.cmd)
+
+		exitCode := 0
+		if err != nil {
+			exit, ok := err.(*ssh.ExitError)
+			if !ok {
+				c.Fatalf("machine %s: running %q: %v", m.ID(), cmd.cmd, err)
+			}
+			exitCode = exit.Waitmsg.ExitStatus()
+		}
+		if exitCode != cmd.exitCode {
+			c.Errorf("machine %s: %q exited with %d, expected %d: stdout %q, stderr %q",
+				m.ID(), cmd.cmd, exitCode, cmd.exitCode, stdout, stderr)
+			continue
+		}
+
+		for _, re := range cmd.stdout {
+			if !re.Match(stdout) {
+				c.Errorf("machine %s: stdout of %q does not match %q: %q", m.ID(), cmd.cmd, re, stdout)
+			}
+		}
+		for _, re := range cmd.stderr {
+			if !re.Match(stderr) {
+				c.Errorf("machine %s: stderr of %q does not match %q: %q", m.ID(), cmd.cmd, re, stderr)
+			}
+		}
+	}
+}
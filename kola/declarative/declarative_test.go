@@ -0,0 +1,94 @@
+// Copyright The Mantle Authors.
+// SPDX-License-Identifier: Apache-2.0
+
+package declarative
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/coreos/go-semver/semver"
+)
+
+func writeFile(t *testing.T, dir, name, contents string) {
+	t.Helper()
+	if err := os.WriteFile(filepath.Join(dir, name), []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadDir(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, dir, "a.yaml", `
+name: test.yaml
+userdata:
+  kind: butane
+  file: config.bu
+clusterSize: 2
+platforms: [qemu]
+excludeDistros: [fcos]
+minVersion: 3033.0.0
+endVersion: 3500.0.0
+commands:
+  - run: hostname
+    stdout: ["^example$"]
+  - name: missing-unit
+    run: systemctl is-active missing.service
+    exitCode: 3
+`)
+	writeFile(t, dir, "config.bu", "variant: flatcar\nversion: 1.0.0\n")
+	writeFile(t, dir, "b.json", `{"name": "test.json", "commands": [{"run": "true"}]}`)
+	writeFile(t, dir, "README.md", "ignored")
+
+	tests, err := LoadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tests) != 2 {
+		t.Fatalf("expected 2 tests, got %d", len(tests))
+	}
+
+	y := tests[0]
+	if y.Name != "test.yaml" || y.ClusterSize != 2 {
+		t.Errorf("unexpected test: %+v", y)
+	}
+	if !reflect.DeepEqual(y.Platforms, []string{"qemu"}) || !reflect.DeepEqual(y.ExcludeDistros, []string{"fcos"}) {
+		t.Errorf("unexpected filters: %v %v", y.Platforms, y.ExcludeDistros)
+	}
+	if y.MinVersion != (semver.Version{Major: 3033}) || y.EndVersion != (semver.Version{Major: 3500}) {
+		t.Errorf("unexpected versions: %v %v", y.MinVersion, y.EndVersion)
+	}
+	if y.UserData == nil || !y.UserData.Contains("variant: flatcar") || y.UserDataV3 != y.UserData {
+		t.Errorf("unexpected userdata: %+v", y.UserData)
+	}
+	if y.Run == nil {
+		t.Error("missing Run function")
+	}
+
+	j := tests[1]
+	if j.Name != "test.json" || j.ClusterSize != 1 || j.UserData != nil {
+		t.Errorf("unexpected test: %+v", j)
+	}
+}
+
+func TestLoadFileErrors(t *testing.T) {
+	for name, contents := range map[string]string{
+		"no-name":       `commands: [{run: "true"}]`,
+		"no-commands":   `name: x`,
+		"empty-command": `{name: x, commands: [{run: " "}]}`,
+		"unknown-field": `{name: x, commands: [{run: "true"}], bogus: 1}`,
+		"bad-kind":      `{name: x, userdata: {kind: bogus}, commands: [{run: "true"}]}`,
+		"bad-regexp":    `{name: x, commands: [{run: "true", stdout: ["("]}]}`,
+		"bad-version":   `{name: x, minVersion: "x", commands: [{run: "true"}]}`,
+		"bad-range":     `{name: x, minVersion: 2.0.0, endVersion: 1.0.0, commands: [{run: "true"}]}`,
+		"no-machines":   `{name: x, clusterSize: 0, commands: [{run: "true"}]}`,
+	} {
+		dir := t.TempDir()
+		writeFile(t, dir, "test.yaml", contents)
+		if _, err := LoadFile(filepath.Join(dir, "test.yaml")); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
@@ -0,0 +1,210 @@
+// Copyright The Mantle Authors.
+// SPDX-License-Identifier: Apache-2.0
+
+package kola
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/flatcar/mantle/harness"
+	"github.com/flatcar/mantle/kola/cluster"
+	"github.com/flatcar/mantle/kola/register"
+	"github.com/flatcar/mantle/platform"
+)
+
+// fixtureSet holds the clusters of the fixtures used by the tests of a
+// run.
+type fixtureSet struct {
+	flight    platform.Flight
+	pltfrm    string
+	outputDir string
+	remove    bool
+	fixtures  map[string]*fixtureState
+}
+
+type fixtureState struct {
+	fixture *register.Fixture
+
+	mu        sync.Mutex
+	remaining int           // tests of the run which haven't finished using the fixture
+	refs      int           // tests currently using the fixture
+	ready     chan struct{} // closed once the setup is done, nil if it didn't start
+	cluster   platform.Cluster
+	err       error
+}
+
+// newFixtureSet counts the tests using each fixture, so that the fixture
+// can be destroyed once all of them finished.
+func newFixtureSet(tests map[string]*register.Test, flight platform.Flight, pltfrm, outputDir string, remove bool) (*fixtureSet, error) {
+	fs := &fixtureSet{
+		flight:    flight,
+		pltfrm:    pltfrm,
+		outputDir: outputDir,
+		remove:    remove,
+		fixtures:  make(map[string]*fixtureState),
+	}
+	for _, t := range tests {
+		if t.Fixture == "" {
+			continue
+		}
+		f, ok := register.Fixtures[t.Fixture]
+		if !ok {
+			return nil, fmt.Errorf("test %v uses unknown fixture %v", t.Name, t.Fixture)
+		}
+		state, ok := fs.fixtures[f.Name]
+		if !ok {
+			state = &fixtureState{fixture: f}
+			fs.fixtures[f.Name] = state
+		}
+		state.remaining++
+	}
+	return fs, nil
+}
+
+// acquire returns the cluster of the named fixture, creating and setting
+// it up if the test is the first one using it. Other tests wait for the
+// setup to finish, or for their own context to be cancelled. The test
+// must call release when it is done with the fixture, even if acquire
+// failed. A *discoveryError is returned as is, see clusterFailed.
+func (fs *fixtureSet) acquire(h *harness.H, name string) (platform.Cluster, error) {
+	state := fs.fixtures[name]
+	state.mu.Lock()
+	state.refs++
+	ready := state.ready
+	if ready == nil {
+		ready = make(chan struct{})
+		state.ready = ready
+		state.mu.Unlock()
+
+		c, err := fs.setup(h, state.fixture)
+		if _, ok := err.(*discoveryError); err != nil && !ok {
+			err = fmt.Errorf("setting up fixture %v in %v: %v", name, h.Name(), err)
+		}
+
+		state.mu.Lock()
+		state.cluster, state.err = c, err
+		close(ready)
+		// the test may have released the fixture after timing out
+		unused := state.unused()
+		state.mu.Unlock()
+		if unused != nil {
+			fs.teardown(h, name, unused)
+		}
+		return c, err
+	}
+	state.mu.Unlock()
+
+	select {
+	case <-ready:
+	case <-h.Context().Done():
+		return nil, fmt.Errorf("waiting for fixture %v: %v", name, h.Context().Err())
+	}
+
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	return state.cluster, state.err
+}
+
+// release marks the test as done with the fixture. The fixture is
+// destroyed when no test is using it anymore and no other test of the
+// run is going to use it, badness found on its machines is reported as
+// errors of the last test. A test which is going to be retried still
+// counts as a future user of the fixture.
+func (fs *fixtureSet) release(h *harness.H, name string) {
+	state := fs.fixtures[name]
+	state.mu.Lock()
+	state.refs--
+	if state.remaining > 0 && !h.WillRetry() {
+		state.remaining--
+	}
+	unused := state.unused()
+	state.mu.Unlock()
+
+	if unused != nil {
+		fs.teardown(h, name, unused)
+	}
+}
+
+// unused returns the cluster of the fixture if no test is going to use
+// it anymore, resetting the state so that a test retried after all
+// others finished sets the fixture up again. A failed setup is forgotten
+// as soon as no test is using the fixture, so that retried tests try it
+// again. mu must be held.
+func (state *fixtureState) unused() platform.Cluster {
+	if state.refs > 0 || state.ready == nil {
+		return nil
+	}
+	select {
+	case <-state.ready:
+	default:
+		// acquire tears the fixture down once the setup is done
+		return nil
+	}
+	if state.err == nil && state.remaining > 0 {
+		return nil
+	}
+
+	c := state.cluster
+	state.ready = nil
+	state.cluster = nil
+	state.err = nil
+	return c
+}
+
+func (fs *fixtureSet) teardown(h *harness.H, name string, c platform.Cluster) {
+	if fs.remove {
+		c.Destroy()
+	}
+	h.Logf("Checking console and journal output of fixture %v", name)
+	checkConsoles(h, c, nil, fs.pltfrm)
+}
+
+func (fs *fixtureSet) setup(h *harness.H, f *register.Fixture) (platform.Cluster, error) {
+	dir := filepath.Join(fs.outputDir, "fixtures", f.Name)
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return nil, err
+	}
+
+	rconf := &platform.RuntimeConfig{
+		OutputDir:          dir,
+		NoSSHKeyInUserData: f.HasFlag(register.NoSSHKeyInUserData),
+		NoSSHKeyInMetadata: f.HasFlag(register.NoSSHKeyInMetadata),
+		NoEnableSelinux:    f.HasFlag(register.NoEnableSelinux),
+		MachinePoolSafe:    f.HasFlag(register.MachinePoolSafe),
+		SSHRetries:         Options.SSHRetries,
+		SSHTimeout:         Options.SSHTimeout,
+		DefaultUser:        f.DefaultUser,
+		Events:             h.Event,
+		MachineOptions:     f.MachineOptions,
+	}
+	c, err := fs.flight.NewCluster(rconf)
+	if err != nil {
+		return nil, fmt.Errorf("cluster failed: %v", err)
+	}
+
+	if f.ClusterSize > 0 {
+		if err := startMachines(c, f.ClusterSize, f.UserData, f.UserDataV3); err != nil {
+			if fs.remove {
+				c.Destroy()
+			}
+			return nil, err
+		}
+	}
+
+	if f.Setup != nil {
+		ok := h.Run("fixture-setup", func(h *harness.H) {
+			f.Setup(cluster.TestCluster{H: h, Cluster: c})
+		})
+		if !ok {
+			if fs.remove {
+				c.Destroy()
+			}
+			checkConsoles(h, c, nil, fs.pltfrm)
+			return nil, fmt.Errorf("setup failed")
+		}
+	}
+	return c, nil
+}
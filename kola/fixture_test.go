@@ -0,0 +1,285 @@
+// Copyright The Mantle Authors.
+// SPDX-License-Identifier: Apache-2.0
+
+package kola
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/flatcar/mantle/harness"
+	"github.com/flatcar/mantle/kola/cluster"
+	"github.com/flatcar/mantle/kola/register"
+	"github.com/flatcar/mantle/platform"
+	"github.com/flatcar/mantle/platform/conf"
+)
+
+// fakeFlight creates clusters without machines and records their
+// lifecycle.
+type fakeFlight struct {
+	platform.Flight
+
+	mu        sync.Mutex
+	created   int
+	destroyed int
+}
+
+func (f *fakeFlight) NewCluster(rconf *platform.RuntimeConfig) (platform.Cluster, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.created++
+	return &fakeCluster{flight: f}, nil
+}
+
+func (f *fakeFlight) counts() (created, destroyed int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.created, f.destroyed
+}
+
+type fakeCluster struct {
+	platform.Cluster
+	flight *fakeFlight
+
+	mu        sync.Mutex
+	destroyed bool
+}
+
+func (c *fakeCluster) Destroy() {
+	c.mu.Lock()
+	c.destroyed = true
+	c.mu.Unlock()
+
+	c.flight.mu.Lock()
+	c.flight.destroyed++
+	c.flight.mu.Unlock()
+}
+
+func (c *fakeCluster) isDestroyed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.destroyed
+}
+
+func (c *fakeCluster) GetDiscoveryURL(size int) (string, error) {
+	return "", errors.New("503 Service Unavailable")
+}
+
+func (c *fakeCluster) ConsoleOutput() map[string]string { return nil }
+func (c *fakeCluster) JournalOutput() map[string]string { return nil }
+
+// runFixtureTests runs tests using the fixture f with the given number
+// of retries, returning the error of the suite.
+func runFixtureTests(t *testing.T, f *register.Fixture, retries int, tests map[string]func(*harness.H, *fixtureSet)) (*fakeFlight, error) {
+	dir, err := ioutil.TempDir("", "kola-fixture")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	register.Fixtures[f.Name] = f
+	defer delete(register.Fixtures, f.Name)
+
+	registered := make(map[string]*register.Test)
+	for name := range tests {
+		registered[name] = &register.Test{Name: name, Fixture: f.Name}
+	}
+	flight := &fakeFlight{}
+	fixtures, err := newFixtureSet(registered, flight, "qemu", dir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var htests harness.Tests
+	for name, test := range tests {
+		test := test
+		htests.Add(name, func(h *harness.H) {
+			test(h, fixtures)
+		})
+	}
+	suite := harness.NewSuite(harness.Options{
+		OutputDir: filepath.Join(dir, "suite"),
+		Parallel:  len(tests),
+		Retries:   retries,
+	}, htests)
+	return flight, suite.Run()
+}
+
+// useFixture acquires and releases the fixture around fn, like runTest.
+func useFixture(name string, fn func(h *harness.H, c *fakeCluster)) func(*harness.H, *fixtureSet) {
+	return func(h *harness.H, fixtures *fixtureSet) {
+		h.Parallel()
+		defer fixtures.release(h, name)
+		c, err := fixtures.acquire(h, name)
+		if err != nil {
+			clusterFailed(h, err)
+		}
+		if fc := c.(*fakeCluster); fc.isDestroyed() {
+			h.Fatal("got a destroyed fixture")
+		} else if fn != nil {
+			fn(h, fc)
+		}
+	}
+}
+
+func TestFixtureShared(t *testing.T) {
+	var mu sync.Mutex
+	clusters := make(map[*fakeCluster]bool)
+	record := func(h *harness.H, c *fakeCluster) {
+		mu.Lock()
+		clusters[c] = true
+		mu.Unlock()
+	}
+
+	var setups int
+	f := &register.Fixture{
+		Name: "shared",
+		Setup: func(c cluster.TestCluster) {
+			setups++
+			// let the other tests wait for the setup
+			time.Sleep(50 * time.Millisecond)
+		},
+	}
+	flight, err := runFixtureTests(t, f, 0, map[string]func(*harness.H, *fixtureSet){
+		"a": useFixture(f.Name, record),
+		"b": useFixture(f.Name, record),
+		"c": useFixture(f.Name, record),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if setups != 1 || len(clusters) != 1 {
+		t.Errorf("expected one setup and cluster, got %d setups and %d clusters", setups, len(clusters))
+	}
+	if created, destroyed := flight.counts(); created != 1 || destroyed != 1 {
+		t.Errorf("expected one cluster created and destroyed, got %d and %d", created, destroyed)
+	}
+}
+
+func TestFixtureRetry(t *testing.T) {
+	var mu sync.Mutex
+	attempts := 0
+	f := &register.Fixture{Name: "retry"}
+	flight, err := runFixtureTests(t, f, 1, map[string]func(*harness.H, *fixtureSet){
+		"flaky": useFixture(f.Name, func(h *harness.H, c *fakeCluster) {
+			mu.Lock()
+			attempts++
+			n := attempts
+			mu.Unlock()
+			if n == 1 {
+				h.Fatal("first attempt fails")
+			}
+		}),
+		"pass": useFixture(f.Name, nil),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attempts != 2 {
+		t.Errorf("expected 2 attempts, got %d", attempts)
+	}
+	// the retried test reuses the fixture of the first attempt
+	if created, destroyed := flight.counts(); created != 1 || destroyed != 1 {
+		t.Errorf("expected one cluster created and destroyed, got %d and %d", created, destroyed)
+	}
+}
+
+func TestFixtureSetupRetry(t *testing.T) {
+	setups := 0
+	f := &register.Fixture{
+		Name: "setup-retry",
+		Setup: func(c cluster.TestCluster) {
+			setups++
+			if setups == 1 {
+				c.Fatal("first setup fails")
+			}
+		},
+	}
+	flight, err := runFixtureTests(t, f, 1, map[string]func(*harness.H, *fixtureSet){
+		"test": useFixture(f.Name, nil),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if setups != 2 {
+		t.Errorf("expected the setup to run again, got %d setups", setups)
+	}
+	if created, destroyed := flight.counts(); created != 2 || destroyed != 2 {
+		t.Errorf("expected two clusters created and destroyed, got %d and %d", created, destroyed)
+	}
+}
+
+func TestFixtureWaitTimeout(t *testing.T) {
+	started := make(chan struct{})
+	unblock := make(chan struct{})
+	f := &register.Fixture{
+		Name: "wait-timeout",
+		Setup: func(c cluster.TestCluster) {
+			close(started)
+			<-unblock
+		},
+	}
+
+	var waitErr error
+	flight, err := runFixtureTests(t, f, 0, map[string]func(*harness.H, *fixtureSet){
+		"setup": useFixture(f.Name, nil),
+		"wait": func(h *harness.H, fixtures *fixtureSet) {
+			h.Parallel()
+			defer close(unblock)
+			defer fixtures.release(h, f.Name)
+			<-started
+			h.SetTimeout(10*time.Millisecond, nil)
+			_, waitErr = fixtures.acquire(h, f.Name)
+		},
+	})
+	if err != harness.SuiteFailed {
+		t.Errorf("expected the waiting test to time out, got %v", err)
+	}
+	if waitErr == nil || !strings.Contains(waitErr.Error(), "waiting for fixture") {
+		t.Errorf("unexpected error of the waiting test: %v", waitErr)
+	}
+	if created, destroyed := flight.counts(); created != 1 || destroyed != 1 {
+		t.Errorf("expected one cluster created and destroyed, got %d and %d", created, destroyed)
+	}
+}
+
+func TestFixtureDiscoverySkip(t *testing.T) {
+	version := Options.IgnitionVersion
+	Options.IgnitionVersion = "v3"
+	defer func() { Options.IgnitionVersion = version }()
+
+	var mu sync.Mutex
+	ran := 0
+	f := &register.Fixture{
+		Name:        "discovery",
+		ClusterSize: 3,
+		UserDataV3:  conf.Ignition(`{"ignition": {"version": "3.0.0"}, "discovery": "$discovery"}`),
+	}
+	count := func(h *harness.H, c *fakeCluster) {
+		mu.Lock()
+		ran++
+		mu.Unlock()
+	}
+	flight, err := runFixtureTests(t, f, 0, map[string]func(*harness.H, *fixtureSet){
+		"a": useFixture(f.Name, count),
+		"b": useFixture(f.Name, count),
+	})
+	// an outage of the discovery service skips the tests, like without
+	// a fixture
+	if err != nil {
+		t.Errorf("expected the tests to be skipped, got %v", err)
+	}
+	if ran != 0 {
+		t.Errorf("%d tests ran without a fixture", ran)
+	}
+	// a test not waiting for the failed setup tries again
+	if created, destroyed := flight.counts(); created == 0 || created != destroyed {
+		t.Errorf("expected the clusters to be destroyed, %d created and %d destroyed", created, destroyed)
+	}
+}
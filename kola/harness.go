@@ -25,6 +25,7 @@ import (
 	"reflect"
 	"regexp"
 	"strings"
+	"sync"
 	"time"
 
 	"golang.org/x/crypto/ssh/agent"
@@ -34,6 +35,7 @@ import (
 
 	"github.com/flatcar/mantle/harness"
 	"github.com/flatcar/mantle/harness/reporters"
+	"github.com/flatcar/mantle/harness/testresult"
 	"github.com/flatcar/mantle/kola/cluster"
 	"github.com/flatcar/mantle/kola/register"
 	"github.com/flatcar/mantle/kola/torcx"
@@ -74,7 +76,9 @@ var (
 	QEMUOptions         = qemu.Options{Options: &Options}            // glue to set platform options from main
 
 	TestParallelism        int    //glue var to set test parallelism from main
+	TestRetries            int    //glue var to set the number of test retries from main
 	TAPFile                string // if not "", write TAP results here
+	JUnitFile              string // if not "", write JUnit XML results here
 	TorcxManifestFile      string // torcx manifest to expose to tests, if set
 	DevcontainerURL        string // dev container to expose to tests, if set
 	DevcontainerBinhostURL string // dev container binhost URL to use in the devcontainer test
@@ -84,15 +88,32 @@ var (
 	// manifest given to kola.
 	TorcxManifest *torcx.Manifest = nil
 
+	// EventStream is the file or "unix:" socket to stream the events
+	// of the run to as JSON lines, glue var set from main.
+	EventStream string
+
+	// TestTimeout is the timeout of tests which don't set their own,
+	// glue var set from main. Zero means no timeout.
+	TestTimeout time.Duration
+
+	// SkipTests are left out of the run, e.g. because they already
+	// passed in the run being resumed. Glue var set from main.
+	SkipTests map[string]bool
+	// ReportVersion is the version recorded in the reports if it isn't
+	// detected during the run, e.g. the version of the report whose
+	// failed tests are run again. Glue var set from main.
+	ReportVersion string
+
 	UpdatePayloadFile string
 	ForceFlatcarKey   bool
-
-	consoleChecks = []struct {
-		desc        string
-		match       *regexp.Regexp
-		skipIfMatch *regexp.Regexp
-		skipFlag    *register.Flag
-	}{
+	// UpdateChain are the updates applied one after the other to a
+	// machine by cl.update.chain, either payload paths, versions
+	// looked up in UpdateChainDir or VERSION=PATH. Glue vars set from
+	// main.
+	UpdateChain    []string
+	UpdateChainDir string
+
+	consoleChecks = []consoleCheck{
 		{
 			desc:     "emergency shell",
 			match:    regexp.MustCompile("Press Enter for emergency shell|Starting Emergency Shell|You are in emergency mode"),
@@ -368,7 +389,7 @@ func versionOutsideRange(version, minVersion, endVersion semver.Version) bool {
 // outputDir is where various test logs and data will be written for
 // analysis after the test run. If it already exists it will be erased!
 func RunTests(patterns []string, channel, offering, pltfrm, outputDir string, sshKeys *[]agent.Key, remove bool) error {
-	var versionStr string
+	versionStr := ReportVersion
 
 	// Avoid incurring cost of starting machine in getClusterSemver when
 	// either:
@@ -380,6 +401,15 @@ func RunTests(patterns []string, channel, offering, pltfrm, outputDir string, ss
 	if err != nil {
 		plog.Fatal(err)
 	}
+	if ShardCount > 0 {
+		tests, err = ShardTests(tests, ShardIndex, ShardCount, ShardDurations)
+		if err != nil {
+			plog.Fatal(err)
+		}
+	}
+	for name := range SkipTests {
+		delete(tests, name)
+	}
 
 	skipGetVersion := true
 	for name, t := range tests {
@@ -450,16 +480,32 @@ func RunTests(patterns []string, channel, offering, pltfrm, outputDir string, ss
 	opts := harness.Options{
 		OutputDir: outputDir,
 		Parallel:  TestParallelism,
+		Retries:   TestRetries,
 		Verbose:   true,
 		Reporters: reporters.Reporters{
 			reporters.NewJSONReporter("report.json", pltfrm, versionStr),
 		},
 	}
+	if JUnitFile != "" {
+		opts.Reporters = append(opts.Reporters, reporters.NewJUnitReporter("junit.xml", pltfrm, versionStr))
+	}
+	if EventStream != "" {
+		stream, err := reporters.NewStreamReporter(EventStream)
+		if err != nil {
+			return fmt.Errorf("opening event stream: %v", err)
+		}
+		opts.Reporters = append(opts.Reporters, stream)
+	}
+	fixtures, err := newFixtureSet(tests, flight, pltfrm, outputDir, remove)
+	if err != nil {
+		return err
+	}
+
 	var htests harness.Tests
 	for _, test := range tests {
 		test := test // for the closure
 		run := func(h *harness.H) {
-			runTest(h, test, pltfrm, flight, remove)
+			runTest(h, test, pltfrm, flight, fixtures, remove)
 		}
 		htests.Add(test.Name, run)
 	}
@@ -474,6 +520,13 @@ func RunTests(patterns []string, channel, offering, pltfrm, outputDir string, ss
 		}
 	}
 
+	if JUnitFile != "" {
+		src := filepath.Join(outputDir, "reports", "junit.xml")
+		if err2 := system.CopyRegularFile(src, JUnitFile); err == nil && err2 != nil {
+			err = err2
+		}
+	}
+
 	if err != nil {
 		fmt.Printf("FAIL, output in %v\n", outputDir)
 	} else {
@@ -557,59 +610,76 @@ func parseCLVersion(input string) (*semver.Version, error) {
 // runTest is a harness for running a single test.
 // outputDir is where various test logs and data will be written for
 // analysis after the test run. It should already exist.
-func runTest(h *harness.H, t *register.Test, pltfrm string, flight platform.Flight, remove bool) {
+func runTest(h *harness.H, t *register.Test, pltfrm string, flight platform.Flight, fixtures *fixtureSet, remove bool) {
+	if t.NoRetry {
+		h.NoRetry()
+	}
 	h.Parallel()
 
-	rconf := &platform.RuntimeConfig{
-		OutputDir:          h.OutputDir(),
-		NoSSHKeyInUserData: t.HasFlag(register.NoSSHKeyInUserData),
-		NoSSHKeyInMetadata: t.HasFlag(register.NoSSHKeyInMetadata),
-		NoEnableSelinux:    t.HasFlag(register.NoEnableSelinux),
-		SSHRetries:         Options.SSHRetries,
-		SSHTimeout:         Options.SSHTimeout,
-		DefaultUser:        t.DefaultUser,
-	}
-	c, err := flight.NewCluster(rconf)
-	if err != nil {
-		h.Fatalf("Cluster failed: %v", err)
+	timeout := t.Timeout
+	if timeout == 0 {
+		timeout = TestTimeout
 	}
-	defer func() {
-		if remove {
-			c.Destroy()
-		}
-		for id, output := range c.ConsoleOutput() {
-			for _, badness := range CheckConsole([]byte(output), t) {
-				h.Errorf("Found %s on machine %s console", badness, id)
-			}
+	setTimeout := func(cleanup func()) {
+		if timeout > 0 {
+			h.SetTimeout(timeout, cleanup)
 		}
-		for id, output := range c.JournalOutput() {
-			for _, badness := range CheckConsole([]byte(output), t) {
-				h.Errorf("Found %s on machine %s journal", badness, id)
-			}
+	}
+
+	var c platform.Cluster
+	var cleanupOnce sync.Once
+	var cleanup func()
+	if t.Fixture != "" {
+		cleanup = func() {
+			cleanupOnce.Do(func() {
+				fixtures.release(h, t.Fixture)
+			})
 		}
-	}()
+		defer cleanup()
+		// the timeout covers setting up the fixture and waiting for it
+		setTimeout(cleanup)
 
-	if t.ClusterSize > 0 {
-		var userdata *conf.UserData
-		if Options.IgnitionVersion == "v2" {
-			userdata = t.UserData
-		} else if Options.IgnitionVersion == "v3" {
-			userdata = t.UserDataV3
+		var err error
+		c, err = fixtures.acquire(h, t.Fixture)
+		if err != nil {
+			clusterFailed(h, err)
 		}
-		if userdata != nil && userdata.Contains("$discovery") {
-			url, err := c.GetDiscoveryURL(t.ClusterSize)
-			if err != nil {
-				// Skip instead of failing since the harness not being able to
-				// get a discovery url is likely an outage (e.g
-				// 503 Service Unavailable: Back-end server is at capacity)
-				// not a problem with the OS
-				h.Skipf("Failed to create discovery endpoint: %v", err)
-			}
-			userdata = userdata.Subst("$discovery", url)
+	} else {
+		rconf := &platform.RuntimeConfig{
+			OutputDir:          h.OutputDir(),
+			NoSSHKeyInUserData: t.HasFlag(register.NoSSHKeyInUserData),
+			NoSSHKeyInMetadata: t.HasFlag(register.NoSSHKeyInMetadata),
+			NoEnableSelinux:    t.HasFlag(register.NoEnableSelinux),
+			MachinePoolSafe:    t.HasFlag(register.MachinePoolSafe),
+			SSHRetries:         Options.SSHRetries,
+			SSHTimeout:         Options.SSHTimeout,
+			DefaultUser:        t.DefaultUser,
+			Events:             h.Event,
+			MachineOptions:     t.MachineOptions,
+		}
+		var err error
+		c, err = flight.NewCluster(rconf)
+		if err != nil {
+			h.Fatalf("Cluster failed: %v", err)
+		}
+		// The cleanup also runs when the test times out: destroying the
+		// machines unblocks SSH sessions the test may be stuck in and
+		// collects their final console and journal output.
+		cleanup = func() {
+			cleanupOnce.Do(func() {
+				if remove {
+					c.Destroy()
+				}
+				checkConsoles(h, c, t, pltfrm)
+			})
 		}
+		defer cleanup()
+		setTimeout(cleanup)
+	}
 
-		if _, err := platform.NewMachines(c, userdata, t.ClusterSize); err != nil {
-			h.Fatalf("Cluster failed starting machines: %v", err)
+	if t.Fixture == "" && t.ClusterSize > 0 {
+		if err := startMachines(c, t.ClusterSize, t.UserData, t.UserDataV3); err != nil {
+			clusterFailed(h, err)
 		}
 	}
 
@@ -642,6 +712,74 @@ func runTest(h *harness.H, t *register.Test, pltfrm string, flight platform.Flig
 	t.Run(tcluster)
 }
 
+// discoveryError is returned by startMachines if it couldn't create a
+// discovery endpoint.
+type discoveryError struct {
+	err error
+}
+
+func (e *discoveryError) Error() string {
+	return fmt.Sprintf("Failed to create discovery endpoint: %v", e.err)
+}
+
+// startMachines starts size machines in the cluster of a test or fixture
+// with the user data of the Ignition version in use.
+func startMachines(c platform.Cluster, size int, userdataV2, userdataV3 *conf.UserData) error {
+	var userdata *conf.UserData
+	if Options.IgnitionVersion == "v2" {
+		userdata = userdataV2
+	} else if Options.IgnitionVersion == "v3" {
+		userdata = userdataV3
+	}
+	if userdata != nil && userdata.Contains("$discovery") {
+		url, err := c.GetDiscoveryURL(size)
+		if err != nil {
+			return &discoveryError{err}
+		}
+		userdata = userdata.Subst("$discovery", url)
+	}
+
+	if _, err := platform.NewMachines(c, userdata, size); err != nil {
+		return fmt.Errorf("Cluster failed starting machines: %v", err)
+	}
+	return nil
+}
+
+// clusterFailed ends a test whose cluster couldn't be started.
+func clusterFailed(h *harness.H, err error) {
+	if _, ok := err.(*discoveryError); ok {
+		// Skip instead of failing since the harness not being able to
+		// get a discovery url is likely an outage (e.g
+		// 503 Service Unavailable: Back-end server is at capacity)
+		// not a problem with the OS
+		h.Skip(err)
+	}
+	h.Fatal(err)
+}
+
+// checkConsoles reports the badness found in the console and journal
+// output of the machines of the cluster as errors of the test.
+func checkConsoles(h *harness.H, c platform.Cluster, t *register.Test, pltfrm string) {
+	for id, output := range c.ConsoleOutput() {
+		badness, warnings := CheckConsole([]byte(output), t, pltfrm)
+		for _, b := range badness {
+			h.Errorf("Found %s on machine %s console", b, id)
+		}
+		for _, w := range warnings {
+			h.Logf("Warning: found %s on machine %s console", w, id)
+		}
+	}
+	for id, output := range c.JournalOutput() {
+		badness, warnings := CheckConsole([]byte(output), t, pltfrm)
+		for _, b := range badness {
+			h.Errorf("Found %s on machine %s journal", b, id)
+		}
+		for _, w := range warnings {
+			h.Logf("Warning: found %s on machine %s journal", w, id)
+		}
+	}
+}
+
 // architecture returns the machine architecture of the given platform.
 func architecture(pltfrm string) string {
 	nativeArch := "amd64"
@@ -717,14 +855,29 @@ func ScpKolet(c cluster.TestCluster, mArch string) {
 }
 
 // CheckConsole checks some console output for badness and returns short
-// descriptions of any badness it finds. If t is specified, its flags are
-// respected.
-func CheckConsole(output []byte, t *register.Test) []string {
-	var ret []string
-	for _, check := range consoleChecks {
+// descriptions of any badness it finds, as well as of matches of checks
+// which are only warnings. If t is specified, its flags are respected.
+// Checks restricted to some tests only apply if t is one of them, checks
+// restricted to some platforms only apply if pltfrm is one of them.
+func CheckConsole(output []byte, t *register.Test, pltfrm string) (badness, warnings []string) {
+	for i, check := range consoleChecks {
+		if !check.appliesTo(t, pltfrm) || check.severity == SeverityIgnore {
+			continue
+		}
 		if check.skipFlag != nil && t != nil && t.HasFlag(*check.skipFlag) {
 			continue
 		}
+		// a later check with the same description overrides this one
+		overridden := false
+		for _, later := range consoleChecks[i+1:] {
+			if later.desc == check.desc && later.appliesTo(t, pltfrm) {
+				overridden = true
+				break
+			}
+		}
+		if overridden {
+			continue
+		}
 		match := check.match.FindSubmatch(output)
 		if match != nil {
 			if check.skipIfMatch != nil {
@@ -733,15 +886,19 @@ func CheckConsole(output []byte, t *register.Test) []string {
 					continue
 				}
 			}
-			badness := check.desc
+			desc := check.desc
 			if len(match) > 1 {
 				// include first subexpression
-				badness += fmt.Sprintf(" (%s)", match[1])
+				desc += fmt.Sprintf(" (%s)", match[1])
+			}
+			if check.severity == SeverityWarn {
+				warnings = append(warnings, desc)
+			} else {
+				badness = append(badness, desc)
 			}
-			ret = append(ret, badness)
 		}
 	}
-	return ret
+	return badness, warnings
 }
 
 func SetupOutputDir(outputDir, platform string) (string, error) {
@@ -785,3 +942,30 @@ func SetupOutputDir(outputDir, platform string) (string, error) {
 
 	return outputDir, nil
 }
+
+// PassedTests returns the top-level tests which passed in a previous run
+// which wrote its results to outputDir. The JSON report is used if the
+// run completed, the TAP log written while the tests ran otherwise.
+func PassedTests(outputDir string) (map[string]bool, error) {
+	passed := make(map[string]bool)
+	report, err := reporters.ReadJSONReport(filepath.Join(outputDir, "reports", "report.json"))
+	if err == nil {
+		for _, name := range report.Passed() {
+			passed[name] = true
+		}
+		return passed, nil
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	results, err := harness.ReadTAP(filepath.Join(outputDir, "test.tap"))
+	if err != nil {
+		return nil, err
+	}
+	for name, result := range results {
+		if result == testresult.Pass || result == testresult.Flaky {
+			passed[name] = true
+		}
+	}
+	return passed, nil
+}
@@ -17,10 +17,13 @@ package register
 
 import (
 	"fmt"
+	"reflect"
+	"time"
 
 	"github.com/coreos/go-semver/semver"
 
 	"github.com/flatcar/mantle/kola/cluster"
+	"github.com/flatcar/mantle/platform"
 	"github.com/flatcar/mantle/platform/conf"
 )
 
@@ -33,6 +36,7 @@ const (
 	NoEnableSelinux                     // don't enable selinux when starting or rebooting a machine
 	NoKernelPanicCheck                  // don't check console output for kernel panic
 	NoVerityCorruptionCheck             // don't check console output for verity corruption
+	MachinePoolSafe                     // machines may be clones of a machine with the same config which already booted, see qemu.Options.MachinePool
 )
 
 // Test provides the main test abstraction for kola. The run function is
@@ -77,11 +81,60 @@ type Test struct {
 
 	// DefaultUser is the user used for SSH connection, it will be created via Ignition when possible.
 	DefaultUser string
+
+	// NoRetry prevents the test from being run again after a failure
+	// when kola is asked to retry failed tests, e.g. because the test
+	// is destructive or too expensive to repeat.
+	NoRetry bool
+
+	// Timeout fails the test if it runs longer than this, including
+	// the creation of its machines. If zero, the default timeout given
+	// to kola is used.
+	Timeout time.Duration
+
+	// Fixture is the name of a registered fixture whose cluster the test
+	// runs on instead of creating its own, ClusterSize and UserData are
+	// ignored then. The test must not change the state of the cluster in
+	// ways the other tests using the fixture don't expect.
+	Fixture string
+
+	// MachineOptions sizes the machines of the test on the qemu
+	// platforms, e.g. their memory and vCPUs. Options given to
+	// NewMachineWithOptions take precedence. Tests using a Fixture
+	// can't set them, the fixture sizes its machines.
+	MachineOptions platform.MachineOptions
+}
+
+// Fixture is a cluster shared by several tests of a run, for setups too
+// expensive to repeat in every test. The cluster is created when the
+// first test using the fixture runs and destroyed once the last one
+// finished.
+type Fixture struct {
+	Name        string // should be unique
+	UserData    *conf.UserData
+	UserDataV3  *conf.UserData
+	ClusterSize int
+	Flags       []Flag // special-case options for the cluster of this fixture
+
+	// DefaultUser is the user used for SSH connection, it will be created via Ignition when possible.
+	DefaultUser string
+
+	// MachineOptions sizes the machines of the fixture on the qemu
+	// platforms, see Test.MachineOptions.
+	MachineOptions platform.MachineOptions
+
+	// Setup prepares the cluster, it runs as a subtest of the first
+	// test using the fixture. If it fails, all tests using the fixture
+	// fail.
+	Setup func(cluster.TestCluster)
 }
 
 // Registered tests live here. Mapping of names to tests.
 var Tests = map[string]*Test{}
 
+// Registered fixtures live here. Mapping of names to fixtures.
+var Fixtures = map[string]*Fixture{}
+
 // Register is usually called in init() functions and is how kola test
 // harnesses knows which tests it can choose from. Panics if existing
 // name is registered
@@ -95,6 +148,10 @@ func Register(t *Test) {
 		panic(fmt.Sprintf("test %v has an invalid version range", t.Name))
 	}
 
+	if t.Fixture != "" && !reflect.DeepEqual(t.MachineOptions, platform.MachineOptions{}) {
+		panic(fmt.Sprintf("test %v sets machine options, they are taken from fixture %v", t.Name, t.Fixture))
+	}
+
 	Tests[t.Name] = t
 }
 
@@ -106,3 +163,22 @@ func (t *Test) HasFlag(flag Flag) bool {
 	}
 	return false
 }
+
+// HasFlag returns true if this Fixture has the given Flag.
+func (f *Fixture) HasFlag(flag Flag) bool {
+	for _, ff := range f.Flags {
+		if ff == flag {
+			return true
+		}
+	}
+	return false
+}
+
+// RegisterFixture is usually called in init() functions to make a fixture
+// available to tests. Panics if existing name is registered.
+func RegisterFixture(f *Fixture) {
+	if _, ok := Fixtures[f.Name]; ok {
+		panic(fmt.Sprintf("fixture %v already registered", f.Name))
+	}
+	Fixtures[f.Name] = f
+}
@@ -0,0 +1,105 @@
+// Copyright The Mantle Authors.
+// SPDX-License-Identifier: Apache-2.0
+
+package kola
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/flatcar/mantle/harness/reporters"
+	"github.com/flatcar/mantle/kola/register"
+)
+
+var (
+	// ShardIndex and ShardCount split the tests between several kola
+	// invocations, ShardCount zero disables sharding. Glue vars set
+	// from main.
+	ShardIndex int
+	ShardCount int
+	// ShardDurations are the durations of previous runs of the tests,
+	// used to balance the shards. Glue var set from main.
+	ShardDurations map[string]time.Duration
+)
+
+// ReadShardDurations returns the durations of the top-level tests in a
+// report.json of a previous run.
+func ReadShardDurations(path string) (map[string]time.Duration, error) {
+	report, err := reporters.ReadJSONReport(path)
+	if err != nil {
+		return nil, err
+	}
+	durations := make(map[string]time.Duration)
+	for _, t := range report.Tests {
+		if !strings.Contains(t.Name, "/") {
+			durations[t.Name] = t.Duration
+		}
+	}
+	return durations, nil
+}
+
+// ShardTests returns the tests of shard index out of count. Every test
+// is part of exactly one shard, and given the same tests and durations
+// the shards are the same for every invocation. The tests are balanced
+// by their durations, tests without a known duration are assumed to take
+// as long as the average known test.
+func ShardTests(tests map[string]*register.Test, index, count int, durations map[string]time.Duration) (map[string]*register.Test, error) {
+	if count < 1 {
+		return nil, fmt.Errorf("shard count must be positive, is %d", count)
+	}
+	if index < 0 || index >= count {
+		return nil, fmt.Errorf("shard index must be between 0 and %d, is %d", count-1, index)
+	}
+
+	var known int
+	var total time.Duration
+	for name := range tests {
+		if d, ok := durations[name]; ok {
+			known++
+			total += d
+		}
+	}
+	fallback := time.Second
+	if known > 0 && total > 0 {
+		fallback = total / time.Duration(known)
+	}
+
+	type weighted struct {
+		name   string
+		weight time.Duration
+	}
+	var sorted []weighted
+	for name := range tests {
+		w := weighted{name, fallback}
+		if d, ok := durations[name]; ok {
+			w.weight = d
+		}
+		sorted = append(sorted, w)
+	}
+	// Assign the longest tests first, each to the shard with the least
+	// work so far.
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].weight != sorted[j].weight {
+			return sorted[i].weight > sorted[j].weight
+		}
+		return sorted[i].name < sorted[j].name
+	})
+
+	loads := make([]time.Duration, count)
+	r := make(map[string]*register.Test)
+	for _, w := range sorted {
+		shard := 0
+		for i := range loads {
+			if loads[i] < loads[shard] {
+				shard = i
+			}
+		}
+		loads[shard] += w.weight
+		if shard == index {
+			r[w.name] = tests[w.name]
+		}
+	}
+	return r, nil
+}
@@ -0,0 +1,111 @@
+// Copyright The Mantle Authors.
+// SPDX-License-Identifier: Apache-2.0
+
+package kola
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/flatcar/mantle/kola/register"
+)
+
+func shardTestSet(n int) map[string]*register.Test {
+	tests := make(map[string]*register.Test)
+	for i := 0; i < n; i++ {
+		name := fmt.Sprintf("test%02d", i)
+		tests[name] = &register.Test{Name: name}
+	}
+	return tests
+}
+
+func TestShardTestsPartition(t *testing.T) {
+	tests := shardTestSet(25)
+	for count := 1; count <= 7; count++ {
+		seen := make(map[string]int)
+		for index := 0; index < count; index++ {
+			shard, err := ShardTests(tests, index, count, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for name, test := range shard {
+				if tests[name] != test {
+					t.Errorf("shard %d/%d: test %s isn't the registered one", index, count, name)
+				}
+				seen[name]++
+			}
+		}
+		for name := range tests {
+			if seen[name] != 1 {
+				t.Errorf("%d shards: test %s is in %d shards", count, name, seen[name])
+			}
+		}
+		if len(seen) != len(tests) {
+			t.Errorf("%d shards: %d tests instead of %d", count, len(seen), len(tests))
+		}
+	}
+}
+
+func TestShardTestsDeterministic(t *testing.T) {
+	durations := map[string]time.Duration{
+		"test00": time.Minute,
+		"test01": time.Minute,
+		"test02": 2 * time.Minute,
+	}
+	first, err := ShardTests(shardTestSet(20), 1, 3, durations)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		again, err := ShardTests(shardTestSet(20), 1, 3, durations)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(first, again) {
+			t.Fatalf("shard changed between invocations: %v != %v", first, again)
+		}
+	}
+}
+
+func TestShardTestsBalanced(t *testing.T) {
+	tests := shardTestSet(10)
+	// one long test and nine short ones, the long test must get a
+	// shard of its own
+	durations := map[string]time.Duration{"test00": 30 * time.Minute}
+	for i := 1; i < 10; i++ {
+		durations[fmt.Sprintf("test%02d", i)] = time.Minute
+	}
+
+	var loads []time.Duration
+	for index := 0; index < 3; index++ {
+		shard, err := ShardTests(tests, index, 3, durations)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var load time.Duration
+		for name := range shard {
+			load += durations[name]
+		}
+		if _, ok := shard["test00"]; ok && len(shard) != 1 {
+			t.Errorf("the long test shares its shard with %d others", len(shard)-1)
+		}
+		loads = append(loads, load)
+	}
+	// the short tests are split between the two other shards
+	for _, load := range loads {
+		if load != 30*time.Minute && (load < 4*time.Minute || load > 5*time.Minute) {
+			t.Errorf("unbalanced shards: %v", loads)
+		}
+	}
+}
+
+func TestShardTestsInvalid(t *testing.T) {
+	tests := shardTestSet(3)
+	for _, c := range []struct{ index, count int }{{0, 0}, {-1, 2}, {2, 2}} {
+		if _, err := ShardTests(tests, c.index, c.count, nil); err == nil {
+			t.Errorf("shard %d of %d: expected an error", c.index, c.count)
+		}
+	}
+}
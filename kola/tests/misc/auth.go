@@ -21,10 +21,10 @@ import (
 
 func init() {
 	register.Register(&register.Test{
-		Run:         AuthVerify,
-		ClusterSize: 1,
-		Name:        "coreos.auth.verify",
-		Distros:     []string{"cl", "fcos", "rhcos"},
+		Run:     AuthVerify,
+		Fixture: "cl.misc.default",
+		Name:    "coreos.auth.verify",
+		Distros: []string{"cl", "fcos", "rhcos"},
 		// This test is normally not related to the cloud environment
 		Platforms: []string{"qemu", "qemu-unpriv"},
 	})
@@ -23,11 +23,19 @@ import (
 )
 
 func init() {
-	register.Register(&register.Test{
-		Run:         Filesystem,
+	// A machine with the default config, shared by the tests which
+	// only inspect it.
+	register.RegisterFixture(&register.Fixture{
+		Name:        "cl.misc.default",
 		ClusterSize: 1,
-		Name:        "cl.filesystem",
-		Distros:     []string{"cl"},
+		Flags:       []register.Flag{register.MachinePoolSafe},
+	})
+
+	register.Register(&register.Test{
+		Run:     Filesystem,
+		Fixture: "cl.misc.default",
+		Name:    "cl.filesystem",
+		Distros: []string{"cl"},
 		// This test is normally not related to the cloud environment
 		Platforms: []string{"qemu", "qemu-unpriv"},
 	})
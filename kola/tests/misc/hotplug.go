@@ -0,0 +1,104 @@
+// Copyright The Mantle Authors.
+// SPDX-License-Identifier: Apache-2.0
+
+package misc
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/flatcar/mantle/kola/cluster"
+	"github.com/flatcar/mantle/kola/register"
+	"github.com/flatcar/mantle/platform"
+	"github.com/flatcar/mantle/util"
+)
+
+func init() {
+	register.Register(&register.Test{
+		Run:         HardwareEvents,
+		ClusterSize: 1,
+		Name:        "cl.qemu.hardware-events",
+		Distros:     []string{"cl"},
+		Platforms:   []string{"qemu", "qemu-unpriv"},
+	})
+}
+
+// HardwareEvents checks that the machine copes with disks and network
+// interfaces coming and going, link flaps and being frozen.
+func HardwareEvents(c cluster.TestCluster) {
+	m := c.Machines()[0]
+	qc, ok := m.(platform.QEMUController)
+	if !ok {
+		c.Skip("machine isn't controlled through QMP")
+	}
+
+	c.Run("disk-hotplug", func(c cluster.TestCluster) {
+		id, err := qc.HotplugDisk(platform.Disk{
+			Size:       "1G",
+			DeviceOpts: []string{"serial=hotplug"},
+		})
+		if err != nil {
+			c.Fatal(err)
+		}
+		waitForCmd(c, m, "test -b /dev/disk/by-id/virtio-hotplug")
+		c.MustSSH(m, "sudo mkfs.ext4 -q /dev/disk/by-id/virtio-hotplug")
+
+		if err := qc.Unplug(id); err != nil {
+			c.Fatal(err)
+		}
+		waitForCmd(c, m, "! test -e /dev/disk/by-id/virtio-hotplug")
+	})
+
+	c.Run("nic-hotplug", func(c cluster.TestCluster) {
+		id, mac, err := qc.HotplugNIC()
+		if err != nil {
+			c.Fatal(err)
+		}
+		waitForCmd(c, m, fmt.Sprintf("ip -o link | grep -q %s", mac))
+
+		if err := qc.Unplug(id); err != nil {
+			c.Fatal(err)
+		}
+		waitForCmd(c, m, fmt.Sprintf("! ip -o link | grep -q %s", mac))
+	})
+
+	c.Run("link-flap", func(c cluster.TestCluster) {
+		if err := qc.SetLink(false); err != nil {
+			c.Fatal(err)
+		}
+		time.Sleep(5 * time.Second)
+		if err := qc.SetLink(true); err != nil {
+			c.Fatal(err)
+		}
+		waitForCmd(c, m, "journalctl -b -u systemd-networkd | grep -q 'Lost carrier'")
+	})
+
+	c.Run("freeze", func(c cluster.TestCluster) {
+		bootID := c.MustSSH(m, "cat /proc/sys/kernel/random/boot_id")
+		if err := qc.Pause(); err != nil {
+			c.Fatal(err)
+		}
+		time.Sleep(30 * time.Second)
+		if err := qc.Resume(); err != nil {
+			c.Fatal(err)
+		}
+		if out := c.MustSSH(m, "cat /proc/sys/kernel/random/boot_id"); string(out) != string(bootID) {
+			c.Fatal("machine rebooted while frozen")
+		}
+		if out := c.MustSSH(m, "systemctl --no-legend --state failed list-units"); len(strings.TrimSpace(string(out))) > 0 {
+			c.Fatalf("units failed after being frozen: %s", out)
+		}
+	})
+}
+
+// waitForCmd retries cmd until it succeeds.
+func waitForCmd(c cluster.TestCluster, m platform.Machine, cmd string) {
+	err := util.Retry(30, time.Second, func() error {
+		_, err := c.SSH(m, cmd)
+		return err
+	})
+	if err != nil {
+		c.Fatalf("%q didn't succeed: %v", cmd, err)
+	}
+}
@@ -43,6 +43,7 @@ func init() {
     - name: docker.service
       enabled: true`),
 		MinVersion: semver.Version{Major: 1967},
+		Flags:      []register.Flag{register.MachinePoolSafe},
 	})
 	register.Register(&register.Test{
 		Run:         NetworkListeners,
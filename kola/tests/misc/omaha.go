@@ -18,11 +18,10 @@ import (
 	"fmt"
 	"time"
 
-	"github.com/coreos/go-omaha/omaha"
-
 	"github.com/flatcar/mantle/kola/cluster"
 	"github.com/flatcar/mantle/kola/register"
 	"github.com/flatcar/mantle/platform/conf"
+	"github.com/flatcar/mantle/platform/local"
 	"github.com/flatcar/mantle/platform/machine/qemu"
 )
 
@@ -38,29 +37,14 @@ func init() {
 	})
 }
 
-type pingServer struct {
-	omaha.UpdaterStub
-
-	ping chan struct{}
-}
-
-func (ps *pingServer) Ping(req *omaha.Request, app *omaha.AppRequest) {
-	ps.ping <- struct{}{}
-}
-
 func OmahaPing(c cluster.TestCluster) {
 	qc, ok := c.Cluster.(*qemu.Cluster)
 	if !ok {
 		c.Fatal("test only works in qemu")
 	}
 
-	omahaserver := qc.LocalCluster.OmahaServer
-
-	svc := &pingServer{
-		ping: make(chan struct{}),
-	}
-
-	omahaserver.Updater = svc
+	updater := local.NewOmahaUpdater()
+	updater.Install(qc.LocalCluster.OmahaServer.Server)
 
 	hostport, err := qc.GetOmahaHostPort()
 	if err != nil {
@@ -80,11 +64,9 @@ func OmahaPing(c cluster.TestCluster) {
 		c.Fatalf("couldn't check for update: %s, %s, %v", out, stderr, err)
 	}
 
-	tc := time.After(30 * time.Second)
-
-	select {
-	case <-tc:
-		c.Fatal("timed out waiting for omaha ping")
-	case <-svc.ping:
+	if _, err := updater.WaitRecord(0, 30*time.Second, func(r local.OmahaRecord) bool {
+		return r.Kind == local.OmahaPing
+	}); err != nil {
+		c.Fatal(err)
 	}
 }
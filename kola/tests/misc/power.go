@@ -0,0 +1,78 @@
+// Copyright The Mantle Authors.
+// SPDX-License-Identifier: Apache-2.0
+
+package misc
+
+import (
+	"github.com/flatcar/mantle/kola/cluster"
+	"github.com/flatcar/mantle/kola/register"
+	"github.com/flatcar/mantle/platform"
+	"github.com/flatcar/mantle/platform/conf"
+)
+
+var powerConfig = conf.Butane(`---
+variant: flatcar
+version: 1.0.0
+storage:
+  files:
+  - path: /etc/kola-power
+    contents:
+      inline: ignition
+`)
+
+func init() {
+	register.Register(&register.Test{
+		Run:         UncleanShutdown,
+		ClusterSize: 1,
+		Name:        "cl.power.unclean-shutdown",
+		UserData:    powerConfig,
+		Distros:     []string{"cl"},
+	})
+}
+
+// UncleanShutdown checks that the machine recovers from losing power, a
+// reset and a kernel panic, without Ignition running again.
+func UncleanShutdown(c cluster.TestCluster) {
+	m := c.Machines()[0]
+	pc, ok := m.(platform.PowerController)
+	if !ok {
+		c.Skip("power control isn't supported on this platform")
+	}
+
+	c.Run("hard-reset", func(c cluster.TestCluster) {
+		checkUncleanShutdown(c, m, pc.HardReset)
+	})
+	c.Run("power-cycle", func(c cluster.TestCluster) {
+		checkUncleanShutdown(c, m, func() error {
+			if err := pc.PowerOff(); err != nil {
+				return err
+			}
+			return pc.PowerOn()
+		})
+	})
+	c.Run("kernel-crash", func(c cluster.TestCluster) {
+		checkUncleanShutdown(c, m, func() error {
+			if err := pc.TriggerKernelCrash(); err != nil {
+				return err
+			}
+			return pc.HardReset()
+		})
+	})
+}
+
+func checkUncleanShutdown(c cluster.TestCluster, m platform.Machine, shutdown func() error) {
+	// Ignition would overwrite the file if it ran again
+	c.MustSSH(m, "echo modified | sudo tee /etc/kola-power && sync")
+	bootID := c.MustSSH(m, "cat /proc/sys/kernel/random/boot_id")
+
+	if err := shutdown(); err != nil {
+		c.Fatal(err)
+	}
+
+	if newBootID := c.MustSSH(m, "cat /proc/sys/kernel/random/boot_id"); string(newBootID) == string(bootID) {
+		c.Fatal("machine didn't reboot")
+	}
+	if out := c.MustSSH(m, "cat /etc/kola-power"); string(out) != "modified" {
+		c.Fatalf("unexpected /etc/kola-power content %q, did Ignition run again?", out)
+	}
+}
@@ -24,7 +24,7 @@ import (
 func init() {
 	register.Register(&register.Test{
 		Run:              CheckUserShells,
-		ClusterSize:      1,
+		Fixture:          "cl.misc.default",
 		ExcludePlatforms: []string{"gce"},
 		Name:             "cl.users.shells",
 		Distros:          []string{"cl"},
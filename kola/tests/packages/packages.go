@@ -27,6 +27,7 @@ func init() {
 		Distros:     []string{"cl"},
 		// This test is normally not related to the cloud environment
 		Platforms: []string{"qemu", "qemu-unpriv"},
+		Flags:     []register.Flag{register.MachinePoolSafe},
 	})
 }
 
@@ -0,0 +1,146 @@
+// Copyright The Mantle Authors.
+// SPDX-License-Identifier: Apache-2.0
+
+package update
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/coreos/go-semver/semver"
+
+	"github.com/flatcar/mantle/kola"
+	"github.com/flatcar/mantle/kola/cluster"
+	"github.com/flatcar/mantle/kola/register"
+	tutil "github.com/flatcar/mantle/kola/tests/util"
+	"github.com/flatcar/mantle/platform"
+)
+
+func init() {
+	register.Register(&register.Test{
+		Name:        "cl.update.chain",
+		Run:         updateChain,
+		ClusterSize: 1,
+		NativeFuncs: map[string]func() error{
+			"Omaha": Serve,
+		},
+		Distros: []string{"cl"},
+		// This test is normally not related to the cloud environment
+		Platforms: []string{"qemu", "qemu-unpriv"},
+		SkipFunc: func(version semver.Version, channel, arch, platform string) bool {
+			// The booted image is the start of the chain, the
+			// updates to apply must be given.
+			return len(kola.UpdateChain) == 0
+		},
+	})
+}
+
+// updateHop is an update of a chain, version is empty if it isn't known.
+type updateHop struct {
+	version string
+	payload string
+}
+
+func (h updateHop) String() string {
+	if h.version == "" {
+		return h.payload
+	}
+	return h.version
+}
+
+// resolveUpdateChain returns the updates of the entries of
+// kola.UpdateChain, see there.
+func resolveUpdateChain(entries []string, dir string) ([]updateHop, error) {
+	var hops []updateHop
+	for _, entry := range entries {
+		var hop updateHop
+		if version, payload, ok := strings.Cut(entry, "="); ok {
+			hop = updateHop{version, payload}
+		} else if _, err := os.Stat(entry); err == nil {
+			hop = updateHop{payload: entry}
+		} else if _, err := semver.NewVersion(entry); err == nil {
+			if dir == "" {
+				return nil, fmt.Errorf("update %s: no update chain directory given", entry)
+			}
+			hop = updateHop{entry, filepath.Join(dir, entry, "flatcar_production_update.gz")}
+		} else {
+			return nil, fmt.Errorf("update %s is neither a payload nor a version", entry)
+		}
+
+		if _, err := os.Stat(hop.payload); err != nil {
+			return nil, fmt.Errorf("update %s: %v", hop, err)
+		}
+		hops = append(hops, hop)
+	}
+	return hops, nil
+}
+
+func otherUsr(usr string) string {
+	if usr == "USR-A" {
+		return "USR-B"
+	}
+	return "USR-A"
+}
+
+// updateChain updates one machine through all updates of the chain,
+// checking after each of them that the machine booted the updated
+// partition and is healthy.
+func updateChain(c cluster.TestCluster) {
+	hops, err := resolveUpdateChain(kola.UpdateChain, kola.UpdateChainDir)
+	if err != nil {
+		c.Fatal(err)
+	}
+
+	// the machine created by the test registration hosts the
+	// omaha server
+	srv := c.Machines()[0]
+	m, err := c.NewMachine(nil)
+	if err != nil {
+		c.Fatalf("creating test machine: %v", err)
+	}
+
+	usr := "USR-A"
+	tutil.AssertBootedUsr(c, m, usr)
+	c.Logf("Starting update chain at %s", osVersion(c, m))
+
+	testName := c.H.Name()
+	for i, hop := range hops {
+		name := fmt.Sprintf("hop%d-%s", i+1, filepath.Base(hop.String()))
+		ok := c.Run(name, func(c cluster.TestCluster) {
+			addr := startOmahaServer(c, srv, hop.payload, testName)
+
+			// the key is configured again as a previous update
+			// may have replaced it, see payload
+			configureMachineForUpdate(c, m, addr)
+			updateMachine(c, m)
+
+			tutil.AssertBootedUsr(c, m, otherUsr(usr))
+			if version := osVersion(c, m); hop.version != "" && version != hop.version {
+				c.Fatalf("expected version %s after the update but booted %s", hop.version, version)
+			}
+			assertSystemHealthy(c, m)
+
+			// the next update must boot or fail on its own
+			tutil.InvalidateUsrPartition(c, m, usr)
+		})
+		if !ok {
+			c.Fatalf("update chain broke at hop %d of %d: %s", i+1, len(hops), hop)
+		}
+		usr = otherUsr(usr)
+	}
+}
+
+func osVersion(c cluster.TestCluster, m platform.Machine) string {
+	return string(c.MustSSH(m, `set -euo pipefail; grep -m 1 "^VERSION=" /usr/lib/os-release | cut -d = -f 2`))
+}
+
+func assertSystemHealthy(c cluster.TestCluster, m platform.Machine) {
+	// is-system-running fails unless the state is running
+	state, _, err := m.SSH("systemctl is-system-running --wait")
+	if err != nil {
+		failed, _, _ := m.SSH("systemctl --failed --no-legend")
+		c.Fatalf("system is %s after the update, failed units:\n%s", state, failed)
+	}
+}
@@ -139,16 +139,26 @@ func payload(c cluster.TestCluster) {
 }
 
 func configureOmahaServer(c cluster.TestCluster, srv platform.Machine) string {
-	in, err := os.Open(kola.UpdatePayloadFile)
+	return startOmahaServer(c, srv, kola.UpdatePayloadFile, c.H.Name())
+}
+
+// startOmahaServer serves the payload from the Omaha server running on
+// srv, replacing the payload of a previously started server. testName
+// is the name of the test registering the Omaha native function.
+func startOmahaServer(c cluster.TestCluster, srv platform.Machine, payload, testName string) string {
+	in, err := os.Open(payload)
 	if err != nil {
 		c.Fatalf("opening update payload: %v", err)
 	}
 	defer in.Close()
+
+	// the server hashes the payload when it starts
+	c.MustSSH(srv, "sudo systemctl stop kola-omaha.service 2>/dev/null; sudo systemctl reset-failed kola-omaha.service 2>/dev/null; true")
 	if err := platform.InstallFile(in, srv, "/updates/update.gz"); err != nil {
 		c.Fatalf("copying update payload to omaha server: %v", err)
 	}
 
-	c.MustSSH(srv, fmt.Sprintf("sudo systemd-run --quiet ./kolet run %s Omaha", c.H.Name()))
+	c.MustSSH(srv, fmt.Sprintf("sudo systemd-run --quiet --unit=kola-omaha ./kolet run %s Omaha", testName))
 
 	err = util.WaitUntilReady(60*time.Second, 5*time.Second, func() (bool, error) {
 		_, _, err := srv.SSH(fmt.Sprintf("curl %s:34567", srv.PrivateIP()))
@@ -243,6 +243,59 @@ func (a *API) TerminateInstances(ids []string) error {
 	return nil
 }
 
+// StopInstance stops an EC2 instance without shutting down the OS and
+// waits until it is stopped.
+func (a *API) StopInstance(id string) error {
+	_, err := a.ec2.StopInstances(&ec2.StopInstancesInput{
+		InstanceIds: aws.StringSlice([]string{id}),
+		Force:       util.BoolToPtr(true),
+	})
+	if err != nil {
+		return fmt.Errorf("stopping instance %v: %v", id, err)
+	}
+	_, err = a.waitForInstance(id, ec2.InstanceStateNameStopped)
+	return err
+}
+
+// StartInstance starts a stopped EC2 instance and waits until it is running
+// and has a public IP address. The public IP address changes when an
+// instance is started, the updated instance is returned.
+func (a *API) StartInstance(id string) (*ec2.Instance, error) {
+	_, err := a.ec2.StartInstances(&ec2.StartInstancesInput{
+		InstanceIds: aws.StringSlice([]string{id}),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("starting instance %v: %v", id, err)
+	}
+	return a.waitForInstance(id, ec2.InstanceStateNameRunning)
+}
+
+// waitForInstance waits until an instance is in the given state. Running
+// instances must also have a public IP address.
+func (a *API) waitForInstance(id, state string) (*ec2.Instance, error) {
+	var inst *ec2.Instance
+	err := util.WaitUntilReady(10*time.Minute, 10*time.Second, func() (bool, error) {
+		desc, err := a.ec2.DescribeInstances(&ec2.DescribeInstancesInput{
+			InstanceIds: aws.StringSlice([]string{id}),
+		})
+		if err != nil {
+			return false, err
+		}
+		if len(desc.Reservations) == 0 || len(desc.Reservations[0].Instances) == 0 {
+			return false, nil
+		}
+		inst = desc.Reservations[0].Instances[0]
+		if *inst.State.Name != state {
+			return false, nil
+		}
+		return state != ec2.InstanceStateNameRunning || inst.PublicIpAddress != nil, nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("waiting for instance %v to be %v: %v", id, state, err)
+	}
+	return inst, nil
+}
+
 func (a *API) CreateTags(resources []string, tags map[string]string) error {
 	if len(tags) == 0 {
 		return nil
@@ -242,6 +242,35 @@ func (a *API) TerminateInstance(machine *Machine, resourceGroup string) error {
 	return nil
 }
 
+// PowerOffInstance powers off a VM without shutting down the OS. The VM
+// stays allocated, keeping its IP addresses.
+func (a *API) PowerOffInstance(machine *Machine, resourceGroup string) error {
+	skipShutdown := true
+	future, err := a.compClient.PowerOff(context.TODO(), resourceGroup, machine.ID, &skipShutdown)
+	if err != nil {
+		return err
+	}
+	return future.WaitForCompletionRef(context.TODO(), a.compClient.Client)
+}
+
+// StartInstance starts a powered off VM.
+func (a *API) StartInstance(machine *Machine, resourceGroup string) error {
+	future, err := a.compClient.Start(context.TODO(), resourceGroup, machine.ID)
+	if err != nil {
+		return err
+	}
+	return future.WaitForCompletionRef(context.TODO(), a.compClient.Client)
+}
+
+// RestartInstance restarts a VM.
+func (a *API) RestartInstance(machine *Machine, resourceGroup string) error {
+	future, err := a.compClient.Restart(context.TODO(), resourceGroup, machine.ID)
+	if err != nil {
+		return err
+	}
+	return future.WaitForCompletionRef(context.TODO(), a.compClient.Client)
+}
+
 func (a *API) GetConsoleOutput(name, resourceGroup, storageAccount string) ([]byte, error) {
 	kr, err := a.GetStorageServiceKeysARM(storageAccount, resourceGroup)
 	if err != nil {
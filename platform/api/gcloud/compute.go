@@ -143,6 +143,54 @@ func (a *API) TerminateInstance(name string) error {
 	return err
 }
 
+// StopInstance stops a Google Compute Engine instance without shutting
+// down the OS.
+func (a *API) StopInstance(name string) error {
+	plog.Debugf("Stopping instance %q", name)
+
+	op, err := a.compute.Instances.Stop(a.options.Project, a.options.Zone, name).Do()
+	if err != nil {
+		return fmt.Errorf("failed to stop instance %s: %v", name, err)
+	}
+	doable := a.compute.ZoneOperations.Get(a.options.Project, a.options.Zone, op.Name)
+	return a.NewPending(op.Name, doable).Wait()
+}
+
+// StartInstance starts a stopped Google Compute Engine instance. The
+// ephemeral external IP changes when an instance is started, the updated
+// instance is returned.
+func (a *API) StartInstance(name string) (*compute.Instance, error) {
+	plog.Debugf("Starting instance %q", name)
+
+	op, err := a.compute.Instances.Start(a.options.Project, a.options.Zone, name).Do()
+	if err != nil {
+		return nil, fmt.Errorf("failed to start instance %s: %v", name, err)
+	}
+	doable := a.compute.ZoneOperations.Get(a.options.Project, a.options.Zone, op.Name)
+	if err := a.NewPending(op.Name, doable).Wait(); err != nil {
+		return nil, err
+	}
+
+	inst, err := a.compute.Instances.Get(a.options.Project, a.options.Zone, name).Do()
+	if err != nil {
+		return nil, fmt.Errorf("failed getting instance %s details after starting: %v", name, err)
+	}
+	return inst, nil
+}
+
+// ResetInstance resets a Google Compute Engine instance without shutting
+// down the OS.
+func (a *API) ResetInstance(name string) error {
+	plog.Debugf("Resetting instance %q", name)
+
+	op, err := a.compute.Instances.Reset(a.options.Project, a.options.Zone, name).Do()
+	if err != nil {
+		return fmt.Errorf("failed to reset instance %s: %v", name, err)
+	}
+	doable := a.compute.ZoneOperations.Get(a.options.Project, a.options.Zone, op.Name)
+	return a.NewPending(op.Name, doable).Wait()
+}
+
 func (a *API) ListInstances(prefix string) ([]*compute.Instance, error) {
 	var instances []*compute.Instance
 
@@ -16,9 +16,14 @@ package platform
 
 import (
 	"bytes"
+	"context"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
+	"regexp"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
@@ -26,10 +31,13 @@ import (
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/crypto/ssh/agent"
 
+	"github.com/flatcar/mantle/harness/reporters"
 	"github.com/flatcar/mantle/platform/conf"
 	"github.com/flatcar/mantle/util"
 )
 
+var envNameRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
 type BaseCluster struct {
 	machlock   sync.Mutex
 	machmap    map[string]Machine
@@ -83,30 +91,122 @@ func (bc *BaseCluster) PasswordSSHClient(ip string, user string, password string
 	return sshClient, nil
 }
 
+// RunOptions configures a command started with RunContext.
+type RunOptions struct {
+	// Stdin is sent to the command until EOF, if set.
+	Stdin io.Reader
+	// Env is exported in the remote shell before running the command.
+	// Note sudo resets the environment of the commands it runs.
+	Env map[string]string
+	// Stdout and Stderr receive the output while the command runs, in
+	// addition to it being collected in the RunResult.
+	Stdout io.Writer
+	Stderr io.Writer
+}
+
+// RunResult is the outcome of a command started with RunContext.
+type RunResult struct {
+	Stdout []byte
+	Stderr []byte
+	// ExitStatus is the exit status of the command, or -1 if it didn't
+	// exit normally, e.g. because it was killed or the connection failed.
+	ExitStatus int
+}
+
 // SSH executes the given command, cmd, on the given Machine, m. It returns the
 // stdout and stderr of the command and an error.
 // Leading and trailing whitespace is trimmed from each.
 func (bc *BaseCluster) SSH(m Machine, cmd string) ([]byte, []byte, error) {
-	var stdout bytes.Buffer
-	var stderr bytes.Buffer
+	res, err := bc.RunContext(context.Background(), m, cmd, RunOptions{})
+	if res == nil {
+		return nil, nil, err
+	}
+	return bytes.TrimSpace(res.Stdout), bytes.TrimSpace(res.Stderr), err
+}
+
+// RunContext executes the given command, cmd, on the given Machine, m, over
+// a new SSH connection. A non-zero exit status is returned as an
+// *ssh.ExitError along with the result. If ctx is done before the command
+// exits, the remote process is sent SIGKILL, the connection is closed and
+// ctx.Err() is returned with the output collected so far.
+func (bc *BaseCluster) RunContext(ctx context.Context, m Machine, cmd string, opts RunOptions) (*RunResult, error) {
+	prefix, err := envPrefix(opts.Env)
+	if err != nil {
+		return nil, err
+	}
 	client, err := bc.SSHClient(m.IP())
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
 	defer client.Close()
 
 	session, err := client.NewSession()
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
 	defer session.Close()
 
+	var stdout bytes.Buffer
+	var stderr bytes.Buffer
+	session.Stdin = opts.Stdin
 	session.Stdout = &stdout
 	session.Stderr = &stderr
-	err = session.Run(cmd)
-	outBytes := bytes.TrimSpace(stdout.Bytes())
-	errBytes := bytes.TrimSpace(stderr.Bytes())
-	return outBytes, errBytes, err
+	if opts.Stdout != nil {
+		session.Stdout = io.MultiWriter(&stdout, opts.Stdout)
+	}
+	if opts.Stderr != nil {
+		session.Stderr = io.MultiWriter(&stderr, opts.Stderr)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			if err := session.Signal(ssh.SIGKILL); err != nil {
+				plog.Debugf("failed signaling %q on %s: %v", cmd, m.ID(), err)
+			}
+			// unblocks Run even if the signal was ignored
+			client.Close()
+		case <-done:
+		}
+	}()
+	err = session.Run(prefix + cmd)
+	close(done)
+
+	res := &RunResult{
+		Stdout:     stdout.Bytes(),
+		Stderr:     stderr.Bytes(),
+		ExitStatus: -1,
+	}
+	if err == nil {
+		res.ExitStatus = 0
+	} else if exit, ok := err.(*ssh.ExitError); ok {
+		res.ExitStatus = exit.ExitStatus()
+	}
+	if err != nil && ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	return res, err
+}
+
+// envPrefix returns the shell commands exporting env, sorted by name.
+func envPrefix(env map[string]string) (string, error) {
+	names := make([]string, 0, len(env))
+	for name := range env {
+		if !envNameRegexp.MatchString(name) {
+			return "", fmt.Errorf("invalid environment variable name %q", name)
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var prefix strings.Builder
+	for _, name := range names {
+		// single quotes can't be escaped inside single quotes
+		value := strings.Replace(env[name], "'", `'\''`, -1)
+		fmt.Fprintf(&prefix, "export %s='%s'; ", name, value)
+	}
+	return prefix.String(), nil
 }
 
 func (bc *BaseCluster) Machines() []Machine {
@@ -119,15 +219,32 @@ func (bc *BaseCluster) Machines() []Machine {
 	return machs
 }
 
+// AddMach adds a started machine to the cluster. Every platform's
+// NewMachine calls it, so that each machine removed with DelMach was
+// reported as created.
 func (bc *BaseCluster) AddMach(m Machine) {
 	bc.machlock.Lock()
 	defer bc.machlock.Unlock()
+	if _, ok := bc.machmap[m.ID()]; !ok && bc.rconf.Events != nil {
+		bc.rconf.Events(reporters.Event{
+			Type:    reporters.EventMachineCreated,
+			Machine: m.ID(),
+			IP:      m.IP(),
+		})
+	}
 	bc.machmap[m.ID()] = m
 }
 
 func (bc *BaseCluster) DelMach(m Machine) {
 	bc.machlock.Lock()
 	defer bc.machlock.Unlock()
+	if _, ok := bc.machmap[m.ID()]; ok && bc.rconf.Events != nil {
+		bc.rconf.Events(reporters.Event{
+			Type:    reporters.EventMachineDestroyed,
+			Machine: m.ID(),
+			IP:      m.IP(),
+		})
+	}
 	delete(bc.machmap, m.ID())
 	bc.consolemap[m.ID()] = m.ConsoleOutput()
 }
@@ -0,0 +1,361 @@
+// Copyright The Mantle Authors.
+// SPDX-License-Identifier: Apache-2.0
+
+package local
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-omaha/omaha"
+	"github.com/coreos/go-semver/semver"
+)
+
+const omahaCatalogPrefix = "/catalog/"
+
+// Kinds of OmahaRecords.
+const (
+	OmahaUpdateCheck = "updatecheck"
+	OmahaPing        = "ping"
+	OmahaEvent       = "event"
+)
+
+// OmahaVersion is an update in the catalog of an OmahaUpdater.
+type OmahaVersion struct {
+	Version string
+	Payload string // local path of the update payload
+
+	// Rollout is the percentage of machines which are offered the
+	// version, zero offers it to all machines. Machines are assigned
+	// to the rollout by their machine ID, the same machine always
+	// gets the same answer for the same version.
+	Rollout int
+}
+
+// OmahaRecord is a request or event received by an OmahaUpdater.
+type OmahaRecord struct {
+	Time  time.Time
+	Kind  string
+	App   *omaha.AppRequest
+	Event *omaha.EventRequest // set for events
+
+	// Status is the response to an update check, Version the
+	// version it offered if Status is ok.
+	Status  string
+	Version string
+}
+
+func (r OmahaRecord) String() string {
+	s := fmt.Sprintf("%s app=%s track=%s version=%s machine=%s",
+		r.Kind, r.App.ID, r.App.Track, r.App.Version, r.App.MachineID)
+	switch r.Kind {
+	case OmahaUpdateCheck:
+		s += fmt.Sprintf(" status=%s", r.Status)
+		if r.Version != "" {
+			s += fmt.Sprintf(" offered=%s", r.Version)
+		}
+	case OmahaEvent:
+		s += fmt.Sprintf(" type=%s result=%s", r.Event.Type, r.Event.Result)
+		if r.Event.ErrorCode != "" {
+			s += fmt.Sprintf(" errorcode=%s", r.Event.ErrorCode)
+		}
+	}
+	return s
+}
+
+type omahaChannel struct {
+	app   string
+	track string
+}
+
+type omahaChannelState struct {
+	versions []*omahaCatalogVersion // sorted by version
+	target   string                 // version offered regardless of the client version
+	status   error                  // omaha.AppStatus or omaha.UpdateStatus to respond with
+}
+
+type omahaCatalogVersion struct {
+	OmahaVersion
+	semver *semver.Version
+	update omaha.Update
+}
+
+// OmahaUpdater is an omaha.Updater serving a catalog of versions for
+// several app IDs and tracks (groups), and recording every request for
+// later assertions. A client is offered the newest version of its track
+// which is newer than its own version and whose rollout includes it,
+// clients of unknown apps and tracks get no update.
+type OmahaUpdater struct {
+	mu       sync.Mutex
+	channels map[omahaChannel]*omahaChannelState
+	packages map[string]string // URL path to local path
+	records  []OmahaRecord
+	changed  chan struct{} // closed and replaced when a record is added
+}
+
+func NewOmahaUpdater() *OmahaUpdater {
+	return &OmahaUpdater{
+		channels: make(map[omahaChannel]*omahaChannelState),
+		packages: make(map[string]string),
+		changed:  make(chan struct{}),
+	}
+}
+
+// Install makes the Omaha server answer with the updater and serve the
+// payloads of its catalog. A server can only have one updater installed.
+func (u *OmahaUpdater) Install(s *omaha.Server) {
+	s.Updater = u
+	s.Mux.Handle(omahaCatalogPrefix, u)
+}
+
+// ServeHTTP serves the payloads of the catalog.
+func (u *OmahaUpdater) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	u.mu.Lock()
+	file, ok := u.packages[r.URL.Path]
+	u.mu.Unlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	http.ServeFile(w, r, file)
+}
+
+func (u *OmahaUpdater) channel(app, track string) *omahaChannelState {
+	c := omahaChannel{app, track}
+	state, ok := u.channels[c]
+	if !ok {
+		state = &omahaChannelState{}
+		u.channels[c] = state
+	}
+	return state
+}
+
+// AddVersion adds a version to the catalog of the track of an app.
+func (u *OmahaUpdater) AddVersion(app, track string, v OmahaVersion) error {
+	sv, err := semver.NewVersion(v.Version)
+	if err != nil {
+		return fmt.Errorf("invalid version %q: %v", v.Version, err)
+	}
+	if v.Rollout < 0 || v.Rollout > 100 {
+		return fmt.Errorf("version %s: rollout must be between 0 and 100, is %d", v.Version, v.Rollout)
+	}
+
+	cv := &omahaCatalogVersion{
+		OmahaVersion: v,
+		semver:       sv,
+	}
+	name := path.Base(v.Payload)
+	codeBase := fmt.Sprintf("%s%s/%s/%s/", omahaCatalogPrefix, app, track, v.Version)
+	cv.update.URL.CodeBase = codeBase
+	cv.update.Manifest.Version = v.Version
+	pkg, err := cv.update.Manifest.AddPackageFromPath(v.Payload)
+	if err != nil {
+		return err
+	}
+	pkg.Name = name
+	act := cv.update.Manifest.AddAction("postinstall")
+	act.DisablePayloadBackoff = true
+	act.SHA256 = pkg.SHA256
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	state := u.channel(app, track)
+	for _, existing := range state.versions {
+		if existing.semver.Equal(*sv) {
+			return fmt.Errorf("version %s already in track %s of app %s", v.Version, track, app)
+		}
+	}
+	state.versions = append(state.versions, cv)
+	sort.Slice(state.versions, func(i, j int) bool {
+		return state.versions[i].semver.LessThan(*state.versions[j].semver)
+	})
+	u.packages[codeBase+name] = v.Payload
+	return nil
+}
+
+// SetTarget makes the track offer the given version to every client
+// whose version differs, including older versions to test that
+// downgrades are refused. An empty version restores the default.
+func (u *OmahaUpdater) SetTarget(app, track, version string) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	state := u.channel(app, track)
+	if version != "" && state.find(version) == nil {
+		return fmt.Errorf("version %s not in track %s of app %s", version, track, app)
+	}
+	state.target = version
+	return nil
+}
+
+// SetStatus makes the track respond with the given status instead of
+// an update: an omaha.AppStatus answers the whole app with an error, an
+// omaha.UpdateStatus answers only update checks, e.g. with
+// omaha.NoUpdate or omaha.UpdateInternalError. A nil status restores
+// the default.
+func (u *OmahaUpdater) SetStatus(app, track string, status error) error {
+	switch status.(type) {
+	case nil, omaha.AppStatus, omaha.UpdateStatus:
+	default:
+		return fmt.Errorf("unsupported status %T", status)
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.channel(app, track).status = status
+	return nil
+}
+
+func (state *omahaChannelState) find(version string) *omahaCatalogVersion {
+	for _, v := range state.versions {
+		if v.Version == version {
+			return v
+		}
+	}
+	return nil
+}
+
+// offer returns the version the client should update to, if any.
+func (state *omahaChannelState) offer(app *omaha.AppRequest) *omahaCatalogVersion {
+	if state.target != "" {
+		v := state.find(state.target)
+		if v.Version == app.Version {
+			return nil
+		}
+		return v
+	}
+
+	// a client with an unknown version gets the newest one
+	current, _ := semver.NewVersion(app.Version)
+	for i := len(state.versions) - 1; i >= 0; i-- {
+		v := state.versions[i]
+		if current != nil && !current.LessThan(*v.semver) {
+			return nil
+		}
+		if inRollout(app.MachineID, v) {
+			return v
+		}
+	}
+	return nil
+}
+
+// inRollout assigns machines to a bucket from 0 to 99 per version.
+func inRollout(machineID string, v *omahaCatalogVersion) bool {
+	if v.Rollout == 0 || v.Rollout == 100 {
+		return true
+	}
+	sum := sha256.Sum256([]byte(machineID + "\x00" + v.Version))
+	return int(binary.BigEndian.Uint64(sum[:8])%100) < v.Rollout
+}
+
+func (u *OmahaUpdater) record(r OmahaRecord) {
+	r.Time = time.Now()
+	plog.Debugf("omaha: %s", r)
+	u.records = append(u.records, r)
+	close(u.changed)
+	u.changed = make(chan struct{})
+}
+
+func (u *OmahaUpdater) CheckApp(req *omaha.Request, app *omaha.AppRequest) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	state, ok := u.channels[omahaChannel{app.ID, app.Track}]
+	if !ok {
+		return nil
+	}
+	status, ok := state.status.(omaha.AppStatus)
+	if !ok {
+		return nil
+	}
+	// the update check is answered with the app error
+	if app.UpdateCheck != nil {
+		u.record(OmahaRecord{Kind: OmahaUpdateCheck, App: app, Status: string(status)})
+	}
+	return status
+}
+
+func (u *OmahaUpdater) CheckUpdate(req *omaha.Request, app *omaha.AppRequest) (*omaha.Update, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	r := OmahaRecord{
+		Kind:   OmahaUpdateCheck,
+		App:    app,
+		Status: string(omaha.NoUpdate),
+	}
+	defer func() { u.record(r) }()
+
+	state, ok := u.channels[omahaChannel{app.ID, app.Track}]
+	if !ok {
+		return nil, omaha.NoUpdate
+	}
+	if status, ok := state.status.(omaha.UpdateStatus); ok {
+		r.Status = string(status)
+		return nil, status
+	}
+
+	v := state.offer(app)
+	if v == nil {
+		return nil, omaha.NoUpdate
+	}
+	r.Status = string(omaha.UpdateOK)
+	r.Version = v.Version
+	update := v.update
+	update.ID = app.ID
+	return &update, nil
+}
+
+func (u *OmahaUpdater) Event(req *omaha.Request, app *omaha.AppRequest, event *omaha.EventRequest) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.record(OmahaRecord{Kind: OmahaEvent, App: app, Event: event})
+}
+
+func (u *OmahaUpdater) Ping(req *omaha.Request, app *omaha.AppRequest) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.record(OmahaRecord{Kind: OmahaPing, App: app})
+}
+
+// Records returns the requests and events received so far.
+func (u *OmahaUpdater) Records() []OmahaRecord {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return append([]OmahaRecord(nil), u.records...)
+}
+
+// WaitRecord waits until a record received after the first skip records
+// matches, returning its index.
+func (u *OmahaUpdater) WaitRecord(skip int, timeout time.Duration, match func(OmahaRecord) bool) (int, error) {
+	deadline := time.After(timeout)
+	for i := skip; ; {
+		u.mu.Lock()
+		for ; i < len(u.records); i++ {
+			if match(u.records[i]) {
+				u.mu.Unlock()
+				return i, nil
+			}
+		}
+		changed := u.changed
+		u.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-deadline:
+			var seen []string
+			for j, r := range u.Records() {
+				if j >= skip {
+					seen = append(seen, r.String())
+				}
+			}
+			return -1, fmt.Errorf("timed out waiting for Omaha request, received:\n%s",
+				strings.Join(seen, "\n"))
+		}
+	}
+}
@@ -0,0 +1,140 @@
+// Copyright The Mantle Authors.
+// SPDX-License-Identifier: Apache-2.0
+
+package local
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/coreos/go-omaha/omaha"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestOmahaUpdater(t *testing.T) *OmahaUpdater {
+	payload := filepath.Join(t.TempDir(), "update.gz")
+	require.Nil(t, os.WriteFile(payload, []byte("payload"), 0644))
+
+	u := NewOmahaUpdater()
+	for _, v := range []struct {
+		track   string
+		version string
+		rollout int
+	}{
+		{"stable", "3000.0.0", 0},
+		{"stable", "3100.0.0", 0},
+		{"beta", "3200.0.0", 0},
+		{"beta", "3300.0.0", 50},
+	} {
+		require.Nil(t, u.AddVersion("app", v.track, OmahaVersion{
+			Version: v.version,
+			Payload: payload,
+			Rollout: v.rollout,
+		}))
+	}
+	return u
+}
+
+func checkUpdate(t *testing.T, u *OmahaUpdater, app *omaha.AppRequest) (string, error) {
+	app.UpdateCheck = &omaha.UpdateRequest{}
+	req := omaha.NewRequest()
+	if err := u.CheckApp(req, app); err != nil {
+		return "", err
+	}
+	update, err := u.CheckUpdate(req, app)
+	if err != nil {
+		return "", err
+	}
+	assert.Equal(t, "update.gz", update.Manifest.Packages[0].Name)
+	assert.Equal(t, app.ID, update.ID)
+	return update.Manifest.Version, nil
+}
+
+func TestOmahaUpdaterVersions(t *testing.T) {
+	u := newTestOmahaUpdater(t)
+
+	version, err := checkUpdate(t, u, &omaha.AppRequest{ID: "app", Track: "stable", Version: "2900.0.0"})
+	require.Nil(t, err)
+	assert.Equal(t, "3100.0.0", version)
+
+	_, err = checkUpdate(t, u, &omaha.AppRequest{ID: "app", Track: "stable", Version: "3100.0.0"})
+	assert.Equal(t, omaha.NoUpdate, err)
+
+	_, err = checkUpdate(t, u, &omaha.AppRequest{ID: "app", Track: "alpha", Version: "3100.0.0"})
+	assert.Equal(t, omaha.NoUpdate, err)
+
+	require.Nil(t, u.SetStatus("other", "stable", omaha.AppUnknownID))
+	_, err = checkUpdate(t, u, &omaha.AppRequest{ID: "other", Track: "stable", Version: "3100.0.0"})
+	assert.Equal(t, omaha.AppUnknownID, err)
+
+	// a channel switch to beta updates to the newer track
+	version, err = checkUpdate(t, u, &omaha.AppRequest{ID: "app", Track: "beta", FromTrack: "stable", Version: "3100.0.0", MachineID: "m"})
+	require.Nil(t, err)
+	assert.Contains(t, []string{"3200.0.0", "3300.0.0"}, version)
+
+	require.Nil(t, u.SetTarget("app", "stable", "3000.0.0"))
+	version, err = checkUpdate(t, u, &omaha.AppRequest{ID: "app", Track: "stable", Version: "3100.0.0"})
+	require.Nil(t, err)
+	assert.Equal(t, "3000.0.0", version)
+	assert.NotNil(t, u.SetTarget("app", "stable", "1.0.0"))
+
+	require.Nil(t, u.SetStatus("app", "stable", omaha.UpdateInternalError))
+	_, err = checkUpdate(t, u, &omaha.AppRequest{ID: "app", Track: "stable", Version: "2900.0.0"})
+	assert.Equal(t, omaha.UpdateInternalError, err)
+
+	require.Nil(t, u.SetStatus("app", "stable", omaha.AppRestricted))
+	_, err = checkUpdate(t, u, &omaha.AppRequest{ID: "app", Track: "stable", Version: "2900.0.0"})
+	assert.Equal(t, omaha.AppRestricted, err)
+
+	records := u.Records()
+	require.Len(t, records, 8)
+	assert.Equal(t, "3100.0.0", records[0].Version)
+	assert.Equal(t, string(omaha.NoUpdate), records[1].Status)
+	assert.Equal(t, string(omaha.AppUnknownID), records[3].Status)
+	assert.Equal(t, string(omaha.AppRestricted), records[7].Status)
+}
+
+func TestOmahaUpdaterRollout(t *testing.T) {
+	u := newTestOmahaUpdater(t)
+
+	counts := make(map[string]int)
+	for i := 0; i < 1000; i++ {
+		app := &omaha.AppRequest{ID: "app", Track: "beta", Version: "3000.0.0", MachineID: fmt.Sprintf("%032x", i)}
+		version, err := checkUpdate(t, u, app)
+		require.Nil(t, err)
+		counts[version]++
+
+		// the same machine always gets the same answer
+		again, err := checkUpdate(t, u, app)
+		require.Nil(t, err)
+		require.Equal(t, version, again)
+	}
+	assert.InDelta(t, 500, counts["3300.0.0"], 100)
+	assert.Equal(t, 1000, counts["3200.0.0"]+counts["3300.0.0"])
+}
+
+func TestOmahaUpdaterWaitRecord(t *testing.T) {
+	u := NewOmahaUpdater()
+	app := &omaha.AppRequest{ID: "app"}
+
+	go func() {
+		u.Ping(omaha.NewRequest(), app)
+		u.Event(omaha.NewRequest(), app, &omaha.EventRequest{
+			Type:   omaha.EventTypeUpdateComplete,
+			Result: omaha.EventResultSuccessReboot,
+		})
+	}()
+
+	i, err := u.WaitRecord(0, time.Minute, func(r OmahaRecord) bool {
+		return r.Kind == OmahaEvent && r.Event.Type == omaha.EventTypeUpdateComplete
+	})
+	require.Nil(t, err)
+	assert.Equal(t, 1, i)
+
+	_, err = u.WaitRecord(i+1, 10*time.Millisecond, func(r OmahaRecord) bool { return true })
+	assert.NotNil(t, err)
+}
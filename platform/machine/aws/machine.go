@@ -15,6 +15,7 @@
 package aws
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -64,10 +65,41 @@ func (am *machine) SSH(cmd string) ([]byte, []byte, error) {
 	return am.cluster.SSH(am, cmd)
 }
 
+func (am *machine) RunContext(ctx context.Context, cmd string, opts platform.RunOptions) (*platform.RunResult, error) {
+	return am.cluster.RunContext(ctx, am, cmd, opts)
+}
+
 func (am *machine) Reboot() error {
 	return platform.RebootMachine(am, am.journal)
 }
 
+func (am *machine) PowerOff() error {
+	return am.cluster.flight.api.StopInstance(am.ID())
+}
+
+func (am *machine) PowerOn() error {
+	inst, err := am.cluster.flight.api.StartInstance(am.ID())
+	if err != nil {
+		return err
+	}
+	// the public IP address changes
+	am.mach = inst
+	return platform.StartMachine(am, am.journal)
+}
+
+// HardReset stops and starts the instance, since rebooting an EC2
+// instance first asks the OS to shut down.
+func (am *machine) HardReset() error {
+	if err := am.PowerOff(); err != nil {
+		return err
+	}
+	return am.PowerOn()
+}
+
+func (am *machine) TriggerKernelCrash() error {
+	return platform.StartKernelCrash(am)
+}
+
 func (am *machine) Destroy() {
 	origConsole, err := am.cluster.flight.api.GetConsoleOutput(am.ID())
 	if err != nil {
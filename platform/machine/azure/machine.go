@@ -15,6 +15,7 @@
 package azure
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -73,6 +74,10 @@ func (am *machine) SSH(cmd string) ([]byte, []byte, error) {
 	return am.cluster.SSH(am, cmd)
 }
 
+func (am *machine) RunContext(ctx context.Context, cmd string, opts platform.RunOptions) (*platform.RunResult, error) {
+	return am.cluster.RunContext(ctx, am, cmd, opts)
+}
+
 func (am *machine) Reboot() error {
 	err := platform.RebootMachine(am, am.journal)
 	if err != nil {
@@ -87,6 +92,39 @@ func (am *machine) Reboot() error {
 	return nil
 }
 
+func (am *machine) PowerOff() error {
+	return am.cluster.flight.Api.PowerOffInstance(am.mach, am.ResourceGroup())
+}
+
+func (am *machine) PowerOn() error {
+	if err := am.cluster.flight.Api.StartInstance(am.mach, am.ResourceGroup()); err != nil {
+		return err
+	}
+	return am.restarted()
+}
+
+func (am *machine) HardReset() error {
+	if err := am.cluster.flight.Api.RestartInstance(am.mach, am.ResourceGroup()); err != nil {
+		return err
+	}
+	return am.restarted()
+}
+
+// restarted waits for the machine to come back after being started
+// through the API.
+func (am *machine) restarted() error {
+	var err error
+	am.mach.PublicIPAddress, am.mach.PrivateIPAddress, err = am.cluster.flight.Api.GetIPAddresses(am.InterfaceName(), am.PublicIPName(), am.ResourceGroup())
+	if err != nil {
+		return fmt.Errorf("Fetching IP addresses: %v", err)
+	}
+	return platform.StartMachine(am, am.journal)
+}
+
+func (am *machine) TriggerKernelCrash() error {
+	return platform.StartKernelCrash(am)
+}
+
 func (am *machine) Destroy() {
 	if err := am.saveConsole(); err != nil {
 		// log error, but do not fail to terminate instance
@@ -60,6 +60,10 @@ func (dm *machine) SSH(cmd string) ([]byte, []byte, error) {
 	return dm.cluster.SSH(dm, cmd)
 }
 
+func (dm *machine) RunContext(ctx context.Context, cmd string, opts platform.RunOptions) (*platform.RunResult, error) {
+	return dm.cluster.RunContext(ctx, dm, cmd, opts)
+}
+
 func (dm *machine) Reboot() error {
 	return platform.RebootMachine(dm, dm.journal)
 }
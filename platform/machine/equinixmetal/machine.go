@@ -15,6 +15,7 @@
 package equinixmetal
 
 import (
+	"context"
 	"strings"
 
 	"golang.org/x/crypto/ssh"
@@ -60,6 +61,10 @@ func (pm *machine) SSH(cmd string) ([]byte, []byte, error) {
 	return pm.cluster.SSH(pm, cmd)
 }
 
+func (pm *machine) RunContext(ctx context.Context, cmd string, opts platform.RunOptions) (*platform.RunResult, error) {
+	return pm.cluster.RunContext(ctx, pm, cmd, opts)
+}
+
 func (pm *machine) Reboot() error {
 	return platform.RebootMachine(pm, pm.journal)
 }
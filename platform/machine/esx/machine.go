@@ -15,6 +15,7 @@
 package esx
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -62,6 +63,10 @@ func (em *machine) SSH(cmd string) ([]byte, []byte, error) {
 	return em.cluster.SSH(em, cmd)
 }
 
+func (em *machine) RunContext(ctx context.Context, cmd string, opts platform.RunOptions) (*platform.RunResult, error) {
+	return em.cluster.RunContext(ctx, em, cmd, opts)
+}
+
 func (em *machine) Reboot() error {
 	return platform.RebootMachine(em, em.journal)
 }
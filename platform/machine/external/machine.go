@@ -13,6 +13,7 @@
 package external
 
 import (
+	"context"
 	"strings"
 
 	"golang.org/x/crypto/ssh"
@@ -56,6 +57,10 @@ func (pm *machine) SSH(cmd string) ([]byte, []byte, error) {
 	return pm.cluster.SSH(pm, cmd)
 }
 
+func (pm *machine) RunContext(ctx context.Context, cmd string, opts platform.RunOptions) (*platform.RunResult, error) {
+	return pm.cluster.RunContext(ctx, pm, cmd, opts)
+}
+
 func (pm *machine) Reboot() error {
 	return platform.RebootMachine(pm, pm.journal)
 }
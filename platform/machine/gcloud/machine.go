@@ -15,12 +15,14 @@
 package gcloud
 
 import (
+	"context"
 	"os"
 	"path/filepath"
 
 	"golang.org/x/crypto/ssh"
 
 	"github.com/flatcar/mantle/platform"
+	"github.com/flatcar/mantle/platform/api/gcloud"
 )
 
 type machine struct {
@@ -61,10 +63,39 @@ func (gm *machine) SSH(cmd string) ([]byte, []byte, error) {
 	return gm.gc.SSH(gm, cmd)
 }
 
+func (gm *machine) RunContext(ctx context.Context, cmd string, opts platform.RunOptions) (*platform.RunResult, error) {
+	return gm.gc.RunContext(ctx, gm, cmd, opts)
+}
+
 func (gm *machine) Reboot() error {
 	return platform.RebootMachine(gm, gm.journal)
 }
 
+func (gm *machine) PowerOff() error {
+	return gm.gc.flight.api.StopInstance(gm.name)
+}
+
+func (gm *machine) PowerOn() error {
+	inst, err := gm.gc.flight.api.StartInstance(gm.name)
+	if err != nil {
+		return err
+	}
+	// the ephemeral external IP changes
+	gm.intIP, gm.extIP = gcloud.InstanceIPs(inst)
+	return platform.StartMachine(gm, gm.journal)
+}
+
+func (gm *machine) HardReset() error {
+	if err := gm.gc.flight.api.ResetInstance(gm.name); err != nil {
+		return err
+	}
+	return platform.StartMachine(gm, gm.journal)
+}
+
+func (gm *machine) TriggerKernelCrash() error {
+	return platform.StartKernelCrash(gm)
+}
+
 func (gm *machine) Destroy() {
 	if err := gm.saveConsole(); err != nil {
 		plog.Errorf("Error saving console for instance %v: %v", gm.ID(), err)
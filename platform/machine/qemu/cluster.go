@@ -16,6 +16,7 @@ package qemu
 
 import (
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strings"
@@ -38,6 +39,11 @@ type Cluster struct {
 
 	mu sync.Mutex
 	*local.LocalCluster
+
+	// templates are the running template machines of the machine pool,
+	// which aren't part of the cluster but are killed with it.
+	templateMu sync.Mutex
+	templates  map[*machine]bool
 }
 
 func (qc *Cluster) NewMachine(userdata *conf.UserData) (platform.Machine, error) {
@@ -48,11 +54,45 @@ func (qc *Cluster) NewMachine(userdata *conf.UserData) (platform.Machine, error)
 }
 
 func (qc *Cluster) NewMachineWithOptions(userdata *conf.UserData, options platform.MachineOptions) (platform.Machine, error) {
+	options = options.WithDefaults(qc.RuntimeConf().MachineOptions)
+	diskImagePath := qc.flight.diskImagePath
+	if qc.flight.pool != nil && qc.RuntimeConf().MachinePoolSafe && len(options.AdditionalDisks) == 0 {
+		key, err := qc.poolKey(userdata, options)
+		if err != nil {
+			return nil, err
+		}
+		if key != "" {
+			diskImagePath, err = qc.flight.pool.get(key, func() (*os.File, error) {
+				return qc.newPoolDisk(userdata, options)
+			})
+			if err != nil {
+				return nil, err
+			}
+			// the pool disk already has the extra size
+			options.ExtraPrimaryDiskSize = ""
+		}
+	}
+
+	qm, _, err := qc.newMachine(userdata, options, diskImagePath, false)
+	if err != nil {
+		return nil, err
+	}
+
+	qc.AddMach(qm)
+
+	return qm, nil
+}
+
+// newMachine boots a machine from a disk backed by diskImagePath. If
+// keepDisk is set, the machine is a template of the machine pool: its
+// primary disk is returned and must be closed by the caller, and it is
+// tracked until untrackTemplate is called.
+func (qc *Cluster) newMachine(userdata *conf.UserData, options platform.MachineOptions, diskImagePath string, keepDisk bool) (*machine, *os.File, error) {
 	id := uuid.New()
 
 	dir := filepath.Join(qc.RuntimeConf().OutputDir, id)
 	if err := os.Mkdir(dir, 0777); err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	// hacky solution for cloud config ip substitution
@@ -67,7 +107,7 @@ func (qc *Cluster) NewMachineWithOptions(userdata *conf.UserData, options platfo
 	})
 	if err != nil {
 		qc.mu.Unlock()
-		return nil, err
+		return nil, nil, err
 	}
 	qc.mu.Unlock()
 
@@ -89,18 +129,18 @@ ExecStartPost=/usr/bin/ln -fs /run/metadata/flatcar /run/metadata/coreos
 	if conf.IsIgnition() {
 		confPath = filepath.Join(dir, "ignition.json")
 		if err := conf.WriteFile(confPath); err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 	} else {
 		confPath, err = local.MakeConfigDrive(conf, dir)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 	}
 
 	journal, err := platform.NewJournal(dir)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	qm := &machine{
@@ -109,15 +149,52 @@ ExecStartPost=/usr/bin/ln -fs /run/metadata/flatcar /run/metadata/coreos
 		netif:       netif,
 		journal:     journal,
 		consolePath: filepath.Join(dir, "console.txt"),
+		QMPController: platform.QMPController{
+			Board:    qc.flight.opts.Board,
+			NetdevID: "tap",
+			Ports:    platform.HotplugPorts(qc.flight.opts.Board, qc.flight.opts.Firmware()),
+		},
 	}
 
-	qmCmd, extraFiles, err := platform.CreateQEMUCommand(qc.flight.opts.Board, qm.id, qc.flight.opts.BIOSImage, qm.consolePath, confPath, qc.flight.diskImagePath, conf.IsIgnition(), options)
+	// unix socket paths are limited to 108 bytes, too short for the
+	// output directory
+	qm.runDir, err = ioutil.TempDir("", "mantle-qemu-run")
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
+	qm.QMPPath = filepath.Join(qm.runDir, "qmp.sock")
 
+	var tpmSocket string
+	if qc.flight.opts.TPM || options.EnableTPM {
+		qm.swtpm, tpmSocket, err = platform.StartSwtpm(qm.runDir)
+		if err != nil {
+			qm.cleanup()
+			return nil, nil, err
+		}
+	}
+
+	qmCmd, extraFiles, err := platform.CreateQEMUCommand(qc.flight.opts.Board, qm.id, qc.flight.opts.Firmware(), qm.consolePath, qm.QMPPath, tpmSocket, confPath, diskImagePath, conf.IsIgnition(), options)
+	if err != nil {
+		qm.cleanup()
+		return nil, nil, err
+	}
+
+	// the primary disk comes first
+	var disk *os.File
+	if keepDisk {
+		disk = extraFiles[0]
+	}
 	for _, file := range extraFiles {
-		defer file.Close()
+		if file != disk {
+			defer file.Close()
+		}
+	}
+	fail := func(err error) (*machine, *os.File, error) {
+		if disk != nil {
+			disk.Close()
+		}
+		qm.cleanup()
+		return nil, nil, err
 	}
 	qmMac := qm.netif.HardwareAddr.String()
 
@@ -126,7 +203,7 @@ ExecStartPost=/usr/bin/ln -fs /run/metadata/flatcar /run/metadata/coreos
 	tap, err := qc.NewTap("br0")
 	if err != nil {
 		qc.mu.Unlock()
-		return nil, err
+		return fail(err)
 	}
 	defer tap.Close()
 	fdnum := 3 + len(extraFiles)
@@ -147,22 +224,54 @@ ExecStartPost=/usr/bin/ln -fs /run/metadata/flatcar /run/metadata/coreos
 	cmd.ExtraFiles = append(cmd.ExtraFiles, extraFiles...)
 
 	if err = qm.qemu.Start(); err != nil {
-		return nil, err
+		return fail(err)
 	}
 
 	plog.Debugf("qemu PID (manual cleanup needed if --remove=false): %v", qm.qemu.Pid())
 
+	if keepDisk {
+		qc.trackTemplate(qm)
+	}
 	if err := platform.StartMachine(qm, qm.journal); err != nil {
+		qc.untrackTemplate(qm)
+		// Destroy already cleaned up the machine
 		qm.Destroy()
-		return nil, err
+		if disk != nil {
+			disk.Close()
+		}
+		return nil, nil, err
 	}
 
-	qc.AddMach(qm)
+	return qm, disk, nil
+}
 
-	return qm, nil
+// trackTemplate makes Destroy kill the template machine m.
+func (qc *Cluster) trackTemplate(m *machine) {
+	qc.templateMu.Lock()
+	defer qc.templateMu.Unlock()
+	if qc.templates == nil {
+		qc.templates = make(map[*machine]bool)
+	}
+	qc.templates[m] = true
+}
+
+func (qc *Cluster) untrackTemplate(m *machine) {
+	qc.templateMu.Lock()
+	defer qc.templateMu.Unlock()
+	delete(qc.templates, m)
 }
 
 func (qc *Cluster) Destroy() {
+	// The templates are only killed, whoever is booting or shutting
+	// them down notices and cleans up.
+	qc.templateMu.Lock()
+	for m := range qc.templates {
+		if err := m.qemu.(*ns.Cmd).Process.Kill(); err != nil && err != os.ErrProcessDone {
+			plog.Errorf("Error killing template %v: %v", m.ID(), err)
+		}
+	}
+	qc.templateMu.Unlock()
+
 	qc.LocalCluster.Destroy()
 	qc.flight.DelCluster(qc)
 }
@@ -39,20 +39,49 @@ type Options struct {
 	// It can be a plain name, or a full path.
 	BIOSImage string
 
+	// UEFICode and UEFIVars are the OVMF or AAVMF code and variables
+	// images. If UEFICode is set, the machines boot with UEFI from
+	// pflash devices instead of BIOSImage.
+	UEFICode string
+	UEFIVars string
+
+	// SecureBoot enables Secure Boot, UEFIVars must have the keys
+	// enrolled.
+	SecureBoot bool
+
+	// TPM attaches a TPM2 device emulated by swtpm to every machine.
+	TPM bool
+
 	// Don't modify CL disk images to add console logging
 	UseVanillaImage bool
 
 	ExtraBaseDiskSize string
 
+	// MachinePool boots machines of tests which allow it from
+	// snapshots of machines with the same config.
+	MachinePool bool
+
 	*platform.Options
 }
 
+// Firmware returns the firmware configuration for the machines.
+func (o *Options) Firmware() platform.Firmware {
+	return platform.Firmware{
+		BIOSImage:  o.BIOSImage,
+		UEFICode:   o.UEFICode,
+		UEFIVars:   o.UEFIVars,
+		SecureBoot: o.SecureBoot,
+	}
+}
+
 type flight struct {
 	*local.LocalFlight
 	opts *Options
 
 	diskImagePath string
 	diskImageFile *os.File
+
+	pool *machinePool
 }
 
 var (
@@ -102,6 +131,10 @@ func NewFlight(opts *Options) (platform.Flight, error) {
 		qf.diskImagePath = fmt.Sprintf("/proc/%d/fd/%d", os.Getpid(), qf.diskImageFile.Fd())
 	}
 
+	if opts.MachinePool {
+		qf.pool = newMachinePool()
+	}
+
 	return qf, nil
 }
 
@@ -125,6 +158,9 @@ func (qf *flight) NewCluster(rconf *platform.RuntimeConfig) (platform.Cluster, e
 
 func (qf *flight) Destroy() {
 	qf.LocalFlight.Destroy()
+	if qf.pool != nil {
+		qf.pool.Destroy()
+	}
 	if qf.diskImageFile != nil {
 		qf.diskImageFile.Close()
 	}
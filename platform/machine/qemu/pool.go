@@ -0,0 +1,173 @@
+// Copyright The Mantle Authors.
+// SPDX-License-Identifier: Apache-2.0
+
+package qemu
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/flatcar/mantle/platform"
+	"github.com/flatcar/mantle/platform/conf"
+)
+
+// poolShutdownTimeout is how long a template machine may take to power
+// off before its disk is snapshotted.
+const poolShutdownTimeout = 2 * time.Minute
+
+// machinePool holds snapshots of the disks of machines which completed
+// their first boot, keyed by the hash of their rendered config. Machines
+// with the same config boot from copy-on-write clones of the snapshot
+// instead of going through Ignition and the first boot again.
+type machinePool struct {
+	mu    sync.Mutex
+	disks map[string]*poolDisk
+}
+
+type poolDisk struct {
+	ready chan struct{} // closed once file or err is set
+	file  *os.File
+	err   error
+}
+
+func newMachinePool() *machinePool {
+	return &machinePool{
+		disks: make(map[string]*poolDisk),
+	}
+}
+
+// get returns the path of the snapshot for key, calling create to make
+// it if there is none yet. Concurrent callers with the same key wait
+// for the first one to create the snapshot.
+func (p *machinePool) get(key string, create func() (*os.File, error)) (string, error) {
+	p.mu.Lock()
+	d, ok := p.disks[key]
+	if !ok {
+		d = &poolDisk{ready: make(chan struct{})}
+		p.disks[key] = d
+	}
+	p.mu.Unlock()
+
+	if ok {
+		<-d.ready
+	} else {
+		d.file, d.err = create()
+		if d.err != nil {
+			// let the next machine try again
+			p.mu.Lock()
+			delete(p.disks, key)
+			p.mu.Unlock()
+		}
+		close(d.ready)
+	}
+	if d.err != nil {
+		return "", fmt.Errorf("creating machine pool snapshot: %v", d.err)
+	}
+
+	// The snapshot has already been deleted, like the disk template
+	// of the flight use a path which remains stable while it is open.
+	return fmt.Sprintf("/proc/%d/fd/%d", os.Getpid(), d.file.Fd()), nil
+}
+
+func (p *machinePool) Destroy() {
+	p.mu.Lock()
+	disks := p.disks
+	p.disks = make(map[string]*poolDisk)
+	p.mu.Unlock()
+
+	for _, d := range disks {
+		<-d.ready
+		if d.file != nil {
+			d.file.Close()
+		}
+	}
+}
+
+// poolKey returns the key of the snapshot machines with the given config
+// and options can be cloned from, or "" if they can't be pooled.
+func (qc *Cluster) poolKey(userdata *conf.UserData, options platform.MachineOptions) (string, error) {
+	// the TPM state of the template isn't cloned
+	if qc.flight.opts.TPM || options.EnableTPM {
+		return "", nil
+	}
+
+	// The IP address variables are left as they are, they are
+	// substituted in the same way for every machine.
+	qc.mu.Lock()
+	conf, err := qc.RenderUserData(userdata, map[string]string{
+		"$public_ipv4":  "${COREOS_CUSTOM_PUBLIC_IPV4}",
+		"$private_ipv4": "${COREOS_CUSTOM_PRIVATE_IPV4}",
+	})
+	qc.mu.Unlock()
+	if err != nil {
+		return "", err
+	}
+	// Only Ignition is guaranteed to run on the first boot alone.
+	if !conf.IsIgnition() {
+		return "", nil
+	}
+
+	h := sha256.New()
+	// the firmware config and extra arguments may change the first boot
+	fmt.Fprintf(h, "%s\x00%s\x00%v\x00%q", conf.String(), options.ExtraPrimaryDiskSize, options.FirmwareConfig, options.ExtraArgs)
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// newPoolDisk boots a template machine, waits for its first boot to
+// complete and powers it off. The returned disk of the template is used
+// as the backing file of the machines cloned from it.
+func (qc *Cluster) newPoolDisk(userdata *conf.UserData, options platform.MachineOptions) (*os.File, error) {
+	qm, disk, err := qc.newMachine(userdata, options, qc.flight.diskImagePath, true)
+	if err != nil {
+		return nil, err
+	}
+	plog.Infof("Creating machine pool snapshot from %v", qm.ID())
+
+	if err := qm.shutdownTemplate(); err != nil {
+		disk.Close()
+		return nil, fmt.Errorf("machine %v: %v", qm.ID(), err)
+	}
+	return disk, nil
+}
+
+// shutdownTemplate resets the identity of a template machine, so that
+// each clone generates its own machine ID and SSH host keys, and powers
+// it off cleanly to leave a consistent disk behind.
+func (m *machine) shutdownTemplate() error {
+	defer m.journal.Destroy()
+	defer m.cleanup()
+	defer m.qc.untrackTemplate(m)
+
+	// wait the exit of the qemu process ourselves, Destroy would kill it
+	exited := make(chan error, 1)
+	go func() {
+		exited <- m.qemu.Wait()
+	}()
+
+	if _, stderr, err := m.SSH("sudo truncate --size=0 /etc/machine-id && sudo rm -f /etc/ssh/ssh_host_*"); err != nil {
+		syscall.Kill(m.qemu.Pid(), syscall.SIGKILL)
+		<-exited
+		return fmt.Errorf("resetting machine identity: %v: %s", err, stderr)
+	}
+	if _, stderr, err := m.SSH("sudo systemctl --no-block poweroff"); err != nil {
+		syscall.Kill(m.qemu.Pid(), syscall.SIGKILL)
+		<-exited
+		return fmt.Errorf("powering off: %v: %s", err, stderr)
+	}
+
+	select {
+	case err := <-exited:
+		if err != nil {
+			return fmt.Errorf("qemu: %v", err)
+		}
+		return nil
+	case <-time.After(poolShutdownTimeout):
+		syscall.Kill(m.qemu.Pid(), syscall.SIGKILL)
+		<-exited
+		return fmt.Errorf("timed out waiting for power off")
+	}
+}
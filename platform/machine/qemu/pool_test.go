@@ -0,0 +1,123 @@
+// Copyright The Mantle Authors.
+// SPDX-License-Identifier: Apache-2.0
+
+package qemu
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func tempSnapshot(t *testing.T) *os.File {
+	f, err := ioutil.TempFile("", "mantle-pool-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(f.Name())
+	return f
+}
+
+func TestMachinePoolConcurrent(t *testing.T) {
+	p := newMachinePool()
+	defer p.Destroy()
+
+	var creates int32
+	create := func() (*os.File, error) {
+		atomic.AddInt32(&creates, 1)
+		// let the other callers wait for the snapshot
+		time.Sleep(50 * time.Millisecond)
+		return tempSnapshot(t), nil
+	}
+
+	const callers = 10
+	paths := make([]string, callers)
+	errs := make([]error, callers)
+	var wg sync.WaitGroup
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			paths[i], errs[i] = p.get("key", create)
+		}(i)
+	}
+	wg.Wait()
+
+	if n := atomic.LoadInt32(&creates); n != 1 {
+		t.Errorf("snapshot created %d times", n)
+	}
+	for i := range paths {
+		if errs[i] != nil {
+			t.Fatalf("caller %d: %v", i, errs[i])
+		}
+		if paths[i] != paths[0] {
+			t.Errorf("caller %d got %q instead of %q", i, paths[i], paths[0])
+		}
+	}
+	if _, err := os.Stat(paths[0]); err != nil {
+		t.Errorf("snapshot isn't accessible: %v", err)
+	}
+
+	// other keys get their own snapshot
+	other, err := p.get("other", create)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other == paths[0] || atomic.LoadInt32(&creates) != 2 {
+		t.Errorf("key other reused the snapshot %q", other)
+	}
+}
+
+func TestMachinePoolRetry(t *testing.T) {
+	p := newMachinePool()
+	defer p.Destroy()
+
+	failed := errors.New("template failed to boot")
+	started := make(chan struct{})
+	release := make(chan struct{})
+	fail := func() (*os.File, error) {
+		close(started)
+		<-release
+		return nil, failed
+	}
+
+	// a caller waiting for the failing snapshot gets the error too
+	errs := make(chan error, 2)
+	go func() {
+		_, err := p.get("key", fail)
+		errs <- err
+	}()
+	<-started
+	go func() {
+		_, err := p.get("key", func() (*os.File, error) {
+			t.Error("waiting caller created a snapshot")
+			return nil, errors.New("unexpected")
+		})
+		errs <- err
+	}()
+	// give the second caller time to find the pending snapshot
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err == nil {
+			t.Errorf("caller %d: expected an error", i)
+		}
+	}
+
+	// the next caller tries again
+	var creates int
+	path, err := p.get("key", func() (*os.File, error) {
+		creates++
+		return tempSnapshot(t), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if creates != 1 || path == "" {
+		t.Errorf("snapshot not created again after failure: %d creates, path %q", creates, path)
+	}
+}
@@ -54,6 +54,7 @@ func (qc *Cluster) NewMachine(userdata *conf.UserData) (platform.Machine, error)
 }
 
 func (qc *Cluster) NewMachineWithOptions(userdata *conf.UserData, options platform.MachineOptions) (platform.Machine, error) {
+	options = options.WithDefaults(qc.RuntimeConf().MachineOptions)
 	id := uuid.New()
 
 	dir := filepath.Join(qc.RuntimeConf().OutputDir, id)
@@ -125,13 +126,36 @@ LinkLocalAddressing=no
 		id:          id,
 		journal:     journal,
 		consolePath: filepath.Join(dir, "console.txt"),
+		QMPController: platform.QMPController{
+			Board:    qc.flight.opts.Board,
+			NetdevID: "eth0",
+			Ports:    platform.HotplugPorts(qc.flight.opts.Board, qc.flight.opts.Firmware()),
+		},
 		privateAddr: privateAddr,
 	}
 
-	qmCmd, extraFiles, err := platform.CreateQEMUCommand(qc.flight.opts.Board, qm.id, qc.flight.opts.BIOSImage, qm.consolePath, confPath, qc.flight.diskImagePath, conf.IsIgnition(), options)
+	// unix socket paths are limited to 108 bytes, too short for the
+	// output directory
+	qm.runDir, err = ioutil.TempDir("", "mantle-qemu-run")
 	if err != nil {
 		return nil, err
 	}
+	qm.QMPPath = filepath.Join(qm.runDir, "qmp.sock")
+
+	var tpmSocket string
+	if qc.flight.opts.TPM || options.EnableTPM {
+		qm.swtpm, tpmSocket, err = platform.StartSwtpm(qm.runDir)
+		if err != nil {
+			qm.cleanup()
+			return nil, err
+		}
+	}
+
+	qmCmd, extraFiles, err := platform.CreateQEMUCommand(qc.flight.opts.Board, qm.id, qc.flight.opts.Firmware(), qm.consolePath, qm.QMPPath, tpmSocket, confPath, qc.flight.diskImagePath, conf.IsIgnition(), options)
+	if err != nil {
+		qm.cleanup()
+		return nil, err
+	}
 
 	for _, file := range extraFiles {
 		defer file.Close()
@@ -156,6 +180,7 @@ LinkLocalAddressing=no
 	cmd.ExtraFiles = append(cmd.ExtraFiles, extraFiles...)
 
 	if err = qm.qemu.Start(); err != nil {
+		qm.cleanup()
 		return nil, err
 	}
 
@@ -15,7 +15,9 @@
 package unprivqemu
 
 import (
+	"context"
 	"io/ioutil"
+	"os"
 
 	"golang.org/x/crypto/ssh"
 
@@ -30,6 +32,9 @@ type machine struct {
 	journal     *platform.Journal
 	consolePath string
 	console     string
+	runDir      string // sockets of qemu and swtpm
+	swtpm       *exec.ExecCmd
+	platform.QMPController
 	ip          string
 	privateAddr string
 }
@@ -62,14 +67,51 @@ func (m *machine) SSH(cmd string) ([]byte, []byte, error) {
 	return m.qc.SSH(m, cmd)
 }
 
+func (m *machine) RunContext(ctx context.Context, cmd string, opts platform.RunOptions) (*platform.RunResult, error) {
+	return m.qc.RunContext(ctx, m, cmd, opts)
+}
+
 func (m *machine) Reboot() error {
 	return platform.RebootMachine(m, m.journal)
 }
 
+func (m *machine) PowerOff() error {
+	return platform.QMPPowerOff(m.QMPPath)
+}
+
+func (m *machine) PowerOn() error {
+	if err := platform.QMPPowerOn(m.QMPPath); err != nil {
+		return err
+	}
+	return platform.StartMachine(m, m.journal)
+}
+
+func (m *machine) HardReset() error {
+	if err := platform.QMPHardReset(m.QMPPath); err != nil {
+		return err
+	}
+	return platform.StartMachine(m, m.journal)
+}
+
+func (m *machine) TriggerKernelCrash() error {
+	return platform.StartKernelCrash(m)
+}
+
+// HotplugNIC attaches a network interface with its own user mode network.
+func (m *machine) HotplugNIC() (string, string, error) {
+	mac, _, err := m.qc.newAddresses()
+	if err != nil {
+		return "", "", err
+	}
+	id, err := m.AddNIC(map[string]interface{}{"type": "user"}, nil, mac)
+	return id, mac, err
+}
+
 func (m *machine) Destroy() {
 	if err := m.qemu.Kill(); err != nil {
 		plog.Errorf("Error killing instance %v: %v", m.ID(), err)
 	}
+	m.cleanup()
 
 	m.journal.Destroy()
 
@@ -82,6 +124,16 @@ func (m *machine) Destroy() {
 	m.qc.DelMach(m)
 }
 
+// cleanup stops swtpm and removes the sockets of the machine.
+func (m *machine) cleanup() {
+	if m.swtpm != nil {
+		if err := m.swtpm.Kill(); err != nil {
+			plog.Errorf("Error killing swtpm of instance %v: %v", m.ID(), err)
+		}
+	}
+	os.RemoveAll(m.runDir)
+}
+
 func (m *machine) ConsoleOutput() string {
 	return m.console
 }
@@ -27,6 +27,7 @@ import (
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/net/context"
 
+	"github.com/flatcar/mantle/harness/reporters"
 	"github.com/flatcar/mantle/platform/conf"
 	"github.com/flatcar/mantle/util"
 )
@@ -61,6 +62,10 @@ type Machine interface {
 	// SSH runs a single command over a new SSH connection.
 	SSH(cmd string) ([]byte, []byte, error)
 
+	// RunContext runs a single command over a new SSH connection,
+	// killing it when ctx is done.
+	RunContext(ctx context.Context, cmd string, opts RunOptions) (*RunResult, error)
+
 	// Reboot restarts the machine and waits for it to come back.
 	Reboot() error
 
@@ -80,6 +85,27 @@ type Machine interface {
 	Board() string
 }
 
+// PowerController is implemented by machines whose power can be controlled
+// from outside the guest, to test recovery from unclean shutdowns. Tests
+// check for support with a type assertion.
+type PowerController interface {
+	// PowerOff turns the machine off without shutting down the OS.
+	PowerOff() error
+
+	// PowerOn turns a powered off machine on and waits for it to come
+	// back.
+	PowerOn() error
+
+	// HardReset resets the machine without shutting down the OS and waits
+	// for it to come back.
+	HardReset() error
+
+	// TriggerKernelCrash makes the kernel panic. The machine only comes
+	// back if the kernel is configured to reboot on panic, otherwise it
+	// has to be reset.
+	TriggerKernelCrash() error
+}
+
 // Cluster represents a cluster of machines within a single Flight.
 type Cluster interface {
 	// Platform returns the name of the platform.
@@ -176,11 +202,20 @@ type RuntimeConfig struct {
 	NoSSHKeyInMetadata bool          // don't add SSH key to platform metadata
 	NoEnableSelinux    bool          // don't enable selinux when starting or rebooting a machine
 	AllowFailedUnits   bool          // don't fail CheckMachine if a systemd unit has failed
+	MachinePoolSafe    bool          // machines may be cloned from a machine pool snapshot
 	SSHRetries         int           // see SSHRetries field in Options
 	SSHTimeout         time.Duration // see SSHTimeout field in Options
 
 	// DefaultUser is the user used for SSH connection, it will be created via Ignition when possible.
 	DefaultUser string
+
+	// Events, if set, is called when machines of the cluster are
+	// created or destroyed.
+	Events func(reporters.Event)
+
+	// MachineOptions are the defaults for the options of the machines
+	// of qemu clusters, other platforms ignore them.
+	MachineOptions MachineOptions
 }
 
 // Wrap a StdoutPipe as a io.ReadCloser
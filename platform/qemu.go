@@ -17,12 +17,14 @@ package platform
 import (
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	origExec "os/exec"
 	"path/filepath"
 	"regexp"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -36,6 +38,133 @@ import (
 type MachineOptions struct {
 	AdditionalDisks      []Disk
 	ExtraPrimaryDiskSize string
+	EnableTPM            bool // attach a TPM2 device emulated by swtpm
+
+	MemoryMiB int // guest memory, defaults to 2512
+	VCPUs     int // number of virtual CPUs, defaults to 4
+	NUMANodes int // memory and CPUs are split evenly across the nodes if set
+
+	// FirmwareConfig adds string entries to fw_cfg, the guest finds
+	// them in /sys/firmware/qemu_fw_cfg/by_name. The names should
+	// start with "opt/".
+	FirmwareConfig map[string]string
+
+	// ExtraArgs are appended to the qemu command line as they are.
+	ExtraArgs []string
+}
+
+const (
+	defaultMemoryMiB = 2512
+	defaultVCPUs     = 4
+)
+
+// WithDefaults returns the options with the fields which aren't set
+// taken from defaults. The disks, firmware config entries and extra
+// arguments of both are combined, the defaults come first.
+func (o MachineOptions) WithDefaults(defaults MachineOptions) MachineOptions {
+	o.AdditionalDisks = append(append([]Disk{}, defaults.AdditionalDisks...), o.AdditionalDisks...)
+	if o.ExtraPrimaryDiskSize == "" {
+		o.ExtraPrimaryDiskSize = defaults.ExtraPrimaryDiskSize
+	}
+	o.EnableTPM = o.EnableTPM || defaults.EnableTPM
+	if o.MemoryMiB == 0 {
+		o.MemoryMiB = defaults.MemoryMiB
+	}
+	if o.VCPUs == 0 {
+		o.VCPUs = defaults.VCPUs
+	}
+	if o.NUMANodes == 0 {
+		o.NUMANodes = defaults.NUMANodes
+	}
+	if len(defaults.FirmwareConfig) > 0 {
+		fwCfg := make(map[string]string)
+		for name, value := range defaults.FirmwareConfig {
+			fwCfg[name] = value
+		}
+		for name, value := range o.FirmwareConfig {
+			fwCfg[name] = value
+		}
+		o.FirmwareConfig = fwCfg
+	}
+	o.ExtraArgs = append(append([]string{}, defaults.ExtraArgs...), o.ExtraArgs...)
+	return o
+}
+
+// resourceArgs returns the memory, CPU and NUMA arguments for qemu.
+func (o MachineOptions) resourceArgs() ([]string, error) {
+	memory, vcpus := o.MemoryMiB, o.VCPUs
+	if memory == 0 {
+		memory = defaultMemoryMiB
+	}
+	if vcpus == 0 {
+		vcpus = defaultVCPUs
+	}
+	if memory < 0 || vcpus < 0 || o.NUMANodes < 0 {
+		return nil, fmt.Errorf("negative machine resources: %d MiB, %d vCPUs, %d NUMA nodes", memory, vcpus, o.NUMANodes)
+	}
+	if o.NUMANodes > vcpus {
+		return nil, fmt.Errorf("%d NUMA nodes need at least as many vCPUs, not %d", o.NUMANodes, vcpus)
+	}
+
+	args := []string{
+		"-m", strconv.Itoa(memory),
+		"-smp", strconv.Itoa(vcpus),
+	}
+	cpu := 0
+	for node := 0; node < o.NUMANodes; node++ {
+		// the first nodes get the remainder
+		nodeMemory := memory / o.NUMANodes
+		if node < memory%o.NUMANodes {
+			nodeMemory++
+		}
+		nodeCPUs := vcpus / o.NUMANodes
+		if node < vcpus%o.NUMANodes {
+			nodeCPUs++
+		}
+		args = append(args,
+			"-object", fmt.Sprintf("memory-backend-ram,id=numa%d,size=%dM", node, nodeMemory),
+			"-numa", fmt.Sprintf("node,nodeid=%d,cpus=%d-%d,memdev=numa%d", node, cpu, cpu+nodeCPUs-1, node))
+		cpu += nodeCPUs
+	}
+	return args, nil
+}
+
+// firmwareConfigArgs returns the -fw_cfg arguments for the entries of
+// FirmwareConfig, sorted by name.
+func (o MachineOptions) firmwareConfigArgs() []string {
+	names := make([]string, 0, len(o.FirmwareConfig))
+	for name := range o.FirmwareConfig {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// commas in option values are escaped by doubling them
+	escape := strings.NewReplacer(",", ",,")
+	var args []string
+	for _, name := range names {
+		args = append(args, "-fw_cfg",
+			fmt.Sprintf("name=%s,string=%s", escape.Replace(name), escape.Replace(o.FirmwareConfig[name])))
+	}
+	return args
+}
+
+// Firmware configures how qemu boots the machines.
+type Firmware struct {
+	// BIOSImage is passed with -bios unless UEFICode is set.
+	BIOSImage string
+
+	// UEFICode is the OVMF or AAVMF code image, which is booted from
+	// a pflash device if set.
+	UEFICode string
+
+	// UEFIVars is the raw image of the UEFI variables, every machine
+	// writes to its own copy.
+	UEFIVars string
+
+	// SecureBoot protects the UEFI variables with SMM. UEFICode must
+	// be built with SMM support and UEFIVars must have the Secure Boot
+	// keys enrolled. Only supported on amd64-usr.
+	SecureBoot bool
 }
 
 type Disk struct {
@@ -290,55 +419,80 @@ func mkpath(basedir string) (string, error) {
 	return f.Name(), nil
 }
 
-func CreateQEMUCommand(board, uuid, biosImage, consolePath, confPath, diskImagePath string, isIgnition bool, options MachineOptions) ([]string, []*os.File, error) {
-	var qmCmd []string
+// hotplugPorts is the number of PCIe root ports added for hotplugged
+// devices.
+const hotplugPorts = 4
 
+// qemuMachine returns the qemu binary, machine type and CPU of the board
+// on this host, and whether the machine type is PCIe based.
+func qemuMachine(board string, firmware Firmware) (binary, machine, cpu string, pcie bool) {
 	// As we expand this list of supported native + board
 	// archs combos we should coordinate with the
 	// coreos-assembler folks as they utilize something
 	// similar in cosa run
-	var qmBinary string
 	combo := runtime.GOARCH + "--" + board
 	switch combo {
 	case "amd64--amd64-usr":
-		qmBinary = "qemu-system-x86_64"
-		qmCmd = []string{
-			"qemu-system-x86_64",
-			"-machine", "accel=kvm",
-			"-cpu", "host",
-			"-m", "2512",
+		if firmware.UEFICode != "" {
+			// OVMF needs q35 for SMM
+			return "qemu-system-x86_64", "q35,accel=kvm", "host", true
 		}
+		return "qemu-system-x86_64", "accel=kvm", "host", false
 	case "amd64--arm64-usr":
-		qmBinary = "qemu-system-aarch64"
-		qmCmd = []string{
-			"qemu-system-aarch64",
-			"-machine", "virt",
-			"-cpu", "cortex-a57",
-			"-m", "2512",
-		}
+		return "qemu-system-aarch64", "virt", "cortex-a57", true
 	case "arm64--amd64-usr":
-		qmBinary = "qemu-system-x86_64"
-		qmCmd = []string{
-			"qemu-system-x86_64",
-			"-machine", "pc-q35-2.8",
-			"-cpu", "kvm64",
-			"-m", "2512",
-		}
+		return "qemu-system-x86_64", "pc-q35-2.8", "kvm64", true
 	case "arm64--arm64-usr":
-		qmBinary = "qemu-system-aarch64"
-		qmCmd = []string{
-			"qemu-system-aarch64",
-			"-machine", "virt,accel=kvm,gic-version=3",
-			"-cpu", "host",
-			"-m", "2512",
-		}
+		return "qemu-system-aarch64", "virt,accel=kvm,gic-version=3", "host", true
 	default:
 		panic("host-guest combo not supported: " + combo)
 	}
+}
+
+// HotplugPorts returns the IDs of the PCIe root ports CreateQEMUCommand
+// adds for hotplugged devices. There are none if the machine type of the
+// board isn't PCIe based, its root bus supports hotplugging then.
+func HotplugPorts(board string, firmware Firmware) []string {
+	if _, _, _, pcie := qemuMachine(board, firmware); !pcie {
+		return nil
+	}
+	ports := make([]string, hotplugPorts)
+	for i := range ports {
+		ports[i] = fmt.Sprintf("hotplug-port%d", i)
+	}
+	return ports
+}
+
+func CreateQEMUCommand(board, uuid string, firmware Firmware, consolePath, qmpPath, tpmSocket, confPath, diskImagePath string, isIgnition bool, options MachineOptions) ([]string, []*os.File, error) {
+	qmBinary, qmMachine, qmCPU, _ := qemuMachine(board, firmware)
+	qmCmd := []string{
+		qmBinary,
+		"-cpu", qmCPU,
+	}
+
+	resourceArgs, err := options.resourceArgs()
+	if err != nil {
+		return nil, nil, err
+	}
+	qmCmd = append(qmCmd, resourceArgs...)
+
+	if firmware.SecureBoot {
+		if board != "amd64-usr" {
+			return nil, nil, fmt.Errorf("Secure Boot is not supported on %s", board)
+		}
+		// keep the OS from writing the variables directly
+		qmMachine += ",smm=on"
+		qmCmd = append(qmCmd, "-global", "driver=cfi.pflash01,property=secure,value=on")
+	}
+	qmCmd = append(qmCmd, "-machine", qmMachine)
+
+	if firmware.UEFICode == "" {
+		qmCmd = append(qmCmd, "-bios", firmware.BIOSImage)
+	} else {
+		qmCmd = append(qmCmd, "-drive", "if=pflash,format=raw,unit=0,readonly=on,file="+firmware.UEFICode)
+	}
 
 	qmCmd = append(qmCmd,
-		"-bios", biosImage,
-		"-smp", "4",
 		"-uuid", uuid,
 		"-display", "none",
 		"-chardev", "file,id=log,path="+consolePath,
@@ -347,6 +501,22 @@ func CreateQEMUCommand(board, uuid, biosImage, consolePath, confPath, diskImageP
 		"-device", "virtio-rng-pci,rng=rng0",
 	)
 
+	// the root bus of PCIe machines doesn't support hotplugging
+	for i, port := range HotplugPorts(board, firmware) {
+		qmCmd = append(qmCmd, "-device", fmt.Sprintf("pcie-root-port,id=%s,chassis=%d", port, i+1))
+	}
+
+	if tpmSocket != "" {
+		tpmDevice := "tpm-tis"
+		if board == "arm64-usr" {
+			tpmDevice = "tpm-tis-device"
+		}
+		qmCmd = append(qmCmd,
+			"-chardev", "socket,id=chrtpm,path="+tpmSocket,
+			"-tpmdev", "emulator,id=tpm0,chardev=chrtpm",
+			"-device", tpmDevice+",tpmdev=tpm0")
+	}
+
 	if isIgnition {
 		qmCmd = append(qmCmd,
 			"-fw_cfg", "name=opt/org.flatcar-linux/config,file="+confPath)
@@ -355,6 +525,7 @@ func CreateQEMUCommand(board, uuid, biosImage, consolePath, confPath, diskImageP
 			"-fsdev", "local,id=cfg,security_model=none,readonly=on,path="+confPath,
 			"-device", Virtio(board, "9p", "fsdev=cfg,mount_tag=config-2"))
 	}
+	qmCmd = append(qmCmd, options.firmwareConfigArgs()...)
 
 	// auto-read-only is only available in 3.1.0 & greater versions of QEMU
 	var autoReadOnly string
@@ -376,6 +547,15 @@ func CreateQEMUCommand(board, uuid, biosImage, consolePath, confPath, diskImageP
 		plog.Debugf("disabling auto-read-only for QEMU drives")
 	}
 
+	if qmpPath != "" {
+		// the short boolean options are deprecated since QEMU 6.0
+		serverOpts := ",server,nowait"
+		if !qmSemver.LessThan(*semver.New("6.0.0")) {
+			serverOpts = ",server=on,wait=off"
+		}
+		qmCmd = append(qmCmd, "-qmp", "unix:"+qmpPath+serverOpts)
+	}
+
 	allDisks := append([]Disk{
 		{
 			BackingFile:   diskImagePath,
@@ -404,12 +584,84 @@ func CreateQEMUCommand(board, uuid, biosImage, consolePath, confPath, diskImageP
 		fdset += 1
 	}
 
+	if firmware.UEFIVars != "" {
+		varsFile, err := setupVars(firmware.UEFIVars)
+		if err != nil {
+			return nil, nil, err
+		}
+		extraFiles = append(extraFiles, varsFile)
+
+		qmCmd = append(qmCmd, "-add-fd", fmt.Sprintf("fd=%d,set=%d", fdnum, fdset),
+			"-drive", fmt.Sprintf("if=pflash,format=raw,unit=1,file=/dev/fdset/%d", fdset))
+	}
+
+	qmCmd = append(qmCmd, options.ExtraArgs...)
+
 	return qmCmd, extraFiles, nil
 }
 
+// setupVars creates a nameless writable copy of the UEFI variables.
+func setupVars(template string) (*os.File, error) {
+	src, err := os.Open(template)
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+
+	dstFileName, err := mkpath("")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(dstFileName)
+
+	dst, err := os.OpenFile(dstFileName, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return nil, fmt.Errorf("copying UEFI variables: %v", err)
+	}
+	return dst, nil
+}
+
+// StartSwtpm starts a swtpm process emulating a TPM2 device, keeping its
+// state in dir, and returns it along with the control socket for qemu.
+func StartSwtpm(dir string) (*exec.ExecCmd, string, error) {
+	state := filepath.Join(dir, "tpm")
+	if err := os.Mkdir(state, 0700); err != nil {
+		return nil, "", err
+	}
+	socket := filepath.Join(dir, "swtpm.sock")
+
+	swtpm := exec.Command("swtpm", "socket", "--tpm2",
+		"--tpmstate", "dir="+state,
+		"--ctrl", "type=unixio,path="+socket)
+	swtpm.Stderr = os.Stderr
+	if err := swtpm.Start(); err != nil {
+		return nil, "", fmt.Errorf("starting swtpm: %v", err)
+	}
+
+	// qemu fails if the socket doesn't exist yet
+	err := util.Retry(50, 100*time.Millisecond, func() error {
+		_, err := os.Stat(socket)
+		return err
+	})
+	if err != nil {
+		swtpm.Kill()
+		return nil, "", fmt.Errorf("waiting for swtpm: %v", err)
+	}
+	return swtpm, socket, nil
+}
+
 // The virtio device name differs between machine types but otherwise
 // configuration is the same. Use this to help construct device args.
 func Virtio(board, device, args string) string {
+	return fmt.Sprintf("%s,%s", virtioDriver(board, device), args)
+}
+
+// virtioDriver returns the name of the virtio device for the board.
+func virtioDriver(board, device string) string {
 	var suffix string
 	switch board {
 	case "amd64-usr":
@@ -419,5 +671,5 @@ func Virtio(board, device, args string) string {
 	default:
 		panic(board)
 	}
-	return fmt.Sprintf("virtio-%s-%s,%s", device, suffix, args)
+	return fmt.Sprintf("virtio-%s-%s", device, suffix)
 }
@@ -0,0 +1,163 @@
+// Copyright The Mantle Authors.
+// SPDX-License-Identifier: Apache-2.0
+
+package platform
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMachineOptionsResourceArgs(t *testing.T) {
+	for _, c := range []struct {
+		name    string
+		options MachineOptions
+		args    []string
+	}{
+		{
+			name: "defaults",
+			args: []string{"-m", "2512", "-smp", "4"},
+		},
+		{
+			name:    "sized",
+			options: MachineOptions{MemoryMiB: 1024, VCPUs: 1},
+			args:    []string{"-m", "1024", "-smp", "1"},
+		},
+		{
+			name:    "even NUMA split",
+			options: MachineOptions{MemoryMiB: 2048, VCPUs: 4, NUMANodes: 2},
+			args: []string{"-m", "2048", "-smp", "4",
+				"-object", "memory-backend-ram,id=numa0,size=1024M",
+				"-numa", "node,nodeid=0,cpus=0-1,memdev=numa0",
+				"-object", "memory-backend-ram,id=numa1,size=1024M",
+				"-numa", "node,nodeid=1,cpus=2-3,memdev=numa1"},
+		},
+		{
+			// the first nodes get the remaining MiB and vCPUs
+			name:    "NUMA split with remainder",
+			options: MachineOptions{MemoryMiB: 1001, VCPUs: 5, NUMANodes: 3},
+			args: []string{"-m", "1001", "-smp", "5",
+				"-object", "memory-backend-ram,id=numa0,size=334M",
+				"-numa", "node,nodeid=0,cpus=0-1,memdev=numa0",
+				"-object", "memory-backend-ram,id=numa1,size=334M",
+				"-numa", "node,nodeid=1,cpus=2-3,memdev=numa1",
+				"-object", "memory-backend-ram,id=numa2,size=333M",
+				"-numa", "node,nodeid=2,cpus=4-4,memdev=numa2"},
+		},
+		{
+			name:    "one vCPU per node",
+			options: MachineOptions{NUMANodes: 4},
+			args: []string{"-m", "2512", "-smp", "4",
+				"-object", "memory-backend-ram,id=numa0,size=628M",
+				"-numa", "node,nodeid=0,cpus=0-0,memdev=numa0",
+				"-object", "memory-backend-ram,id=numa1,size=628M",
+				"-numa", "node,nodeid=1,cpus=1-1,memdev=numa1",
+				"-object", "memory-backend-ram,id=numa2,size=628M",
+				"-numa", "node,nodeid=2,cpus=2-2,memdev=numa2",
+				"-object", "memory-backend-ram,id=numa3,size=628M",
+				"-numa", "node,nodeid=3,cpus=3-3,memdev=numa3"},
+		},
+		{
+			name:    "more nodes than vCPUs",
+			options: MachineOptions{VCPUs: 2, NUMANodes: 3},
+		},
+		{
+			name:    "negative memory",
+			options: MachineOptions{MemoryMiB: -1},
+		},
+		{
+			name:    "negative nodes",
+			options: MachineOptions{NUMANodes: -1},
+		},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			args, err := c.options.resourceArgs()
+			if c.args == nil {
+				if err == nil {
+					t.Errorf("expected an error, got %q", args)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(args, c.args) {
+				t.Errorf("got %q, expected %q", args, c.args)
+			}
+		})
+	}
+}
+
+func TestMachineOptionsWithDefaults(t *testing.T) {
+	defaults := MachineOptions{
+		AdditionalDisks:      []Disk{{Size: "1G"}},
+		ExtraPrimaryDiskSize: "5G",
+		MemoryMiB:            4096,
+		VCPUs:                2,
+		FirmwareConfig:       map[string]string{"opt/a": "default", "opt/b": "default"},
+		ExtraArgs:            []string{"-default"},
+	}
+	for _, c := range []struct {
+		name     string
+		options  MachineOptions
+		defaults MachineOptions
+		expected MachineOptions
+	}{
+		{
+			name:     "no defaults",
+			options:  MachineOptions{MemoryMiB: 1024, ExtraArgs: []string{"-arg"}},
+			expected: MachineOptions{MemoryMiB: 1024, AdditionalDisks: []Disk{}, ExtraArgs: []string{"-arg"}},
+		},
+		{
+			name:     "unset",
+			defaults: defaults,
+			expected: MachineOptions{
+				AdditionalDisks:      []Disk{{Size: "1G"}},
+				ExtraPrimaryDiskSize: "5G",
+				MemoryMiB:            4096,
+				VCPUs:                2,
+				FirmwareConfig:       map[string]string{"opt/a": "default", "opt/b": "default"},
+				ExtraArgs:            []string{"-default"},
+			},
+		},
+		{
+			name: "set",
+			options: MachineOptions{
+				AdditionalDisks:      []Disk{{Size: "2G"}},
+				ExtraPrimaryDiskSize: "10G",
+				EnableTPM:            true,
+				MemoryMiB:            1024,
+				NUMANodes:            2,
+				FirmwareConfig:       map[string]string{"opt/b": "test", "opt/c": "test"},
+				ExtraArgs:            []string{"-arg"},
+			},
+			defaults: defaults,
+			expected: MachineOptions{
+				AdditionalDisks:      []Disk{{Size: "1G"}, {Size: "2G"}},
+				ExtraPrimaryDiskSize: "10G",
+				EnableTPM:            true,
+				MemoryMiB:            1024,
+				VCPUs:                2,
+				NUMANodes:            2,
+				FirmwareConfig:       map[string]string{"opt/a": "default", "opt/b": "test", "opt/c": "test"},
+				ExtraArgs:            []string{"-default", "-arg"},
+			},
+		},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			if got := c.options.WithDefaults(c.defaults); !reflect.DeepEqual(got, c.expected) {
+				t.Errorf("got %+v, expected %+v", got, c.expected)
+			}
+		})
+	}
+
+	// the defaults are not modified
+	MachineOptions{
+		AdditionalDisks: []Disk{{Size: "2G"}},
+		FirmwareConfig:  map[string]string{"opt/a": "test"},
+		ExtraArgs:       []string{"-arg"},
+	}.WithDefaults(defaults)
+	if len(defaults.AdditionalDisks) != 1 || defaults.FirmwareConfig["opt/a"] != "default" || len(defaults.ExtraArgs) != 1 {
+		t.Errorf("defaults modified: %+v", defaults)
+	}
+}
@@ -0,0 +1,647 @@
+// Copyright The Mantle Authors.
+// SPDX-License-Identifier: Apache-2.0
+
+package platform
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// qmpTimeout limits how long a QMP command may take.
+const qmpTimeout = 30 * time.Second
+
+// QMPClient is a connection to the QEMU Machine Protocol socket of a qemu
+// process. qemu accepts one connection at a time.
+type QMPClient struct {
+	mu     sync.Mutex
+	conn   *net.UnixConn
+	dec    *json.Decoder
+	events []QMPEvent // received while waiting for a response
+}
+
+// QMPEvent is an asynchronous event emitted by qemu.
+type QMPEvent struct {
+	Event string          `json:"event"`
+	Data  json.RawMessage `json:"data"`
+}
+
+// QMPError is an error returned by qemu for a QMP command.
+type QMPError struct {
+	Class string `json:"class"`
+	Desc  string `json:"desc"`
+}
+
+func (e *QMPError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Class, e.Desc)
+}
+
+type qmpRequest struct {
+	Execute   string      `json:"execute"`
+	Arguments interface{} `json:"arguments,omitempty"`
+}
+
+type qmpResponse struct {
+	Greeting json.RawMessage `json:"QMP"`
+	Return   json.RawMessage `json:"return"`
+	Error    *QMPError       `json:"error"`
+	Event    string          `json:"event"`
+	Data     json.RawMessage `json:"data"`
+}
+
+// DialQMP connects to the QMP socket at path and enables the commands.
+func DialQMP(path string) (*QMPClient, error) {
+	conn, err := net.DialUnix("unix", nil, &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return nil, fmt.Errorf("connecting to QMP: %v", err)
+	}
+	c := &QMPClient{
+		conn: conn,
+		dec:  json.NewDecoder(conn),
+	}
+
+	var greeting qmpResponse
+	conn.SetDeadline(time.Now().Add(qmpTimeout))
+	if err := c.dec.Decode(&greeting); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("reading QMP greeting: %v", err)
+	}
+	if greeting.Greeting == nil {
+		conn.Close()
+		return nil, fmt.Errorf("unexpected QMP greeting")
+	}
+	if err := c.Execute("qmp_capabilities", nil, nil); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// Close closes the connection.
+func (c *QMPClient) Close() error {
+	return c.conn.Close()
+}
+
+// Execute runs a QMP command with the given arguments and decodes its
+// return value into result, if not nil. Events received meanwhile are kept
+// for WaitEvent. Errors reported by qemu are returned as *QMPError.
+func (c *QMPClient) Execute(command string, args, result interface{}) error {
+	return c.ExecuteFile(command, args, nil, result)
+}
+
+// ExecuteFile runs a QMP command like Execute, passing file to qemu along
+// with it, as needed by the getfd and add-fd commands.
+func (c *QMPClient) ExecuteFile(command string, args interface{}, file *os.File, result interface{}) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	req, err := json.Marshal(&qmpRequest{command, args})
+	if err != nil {
+		return err
+	}
+	var rights []byte
+	if file != nil {
+		rights = syscall.UnixRights(int(file.Fd()))
+	}
+	c.conn.SetDeadline(time.Now().Add(qmpTimeout))
+	if _, _, err := c.conn.WriteMsgUnix(req, rights, nil); err != nil {
+		return fmt.Errorf("sending QMP command %s: %v", command, err)
+	}
+	for {
+		var resp qmpResponse
+		if err := c.dec.Decode(&resp); err != nil {
+			return fmt.Errorf("reading QMP response to %s: %v", command, err)
+		}
+		if resp.Event != "" {
+			c.events = append(c.events, QMPEvent{resp.Event, resp.Data})
+			continue
+		}
+		if resp.Error != nil {
+			return resp.Error
+		}
+		if result == nil || resp.Return == nil {
+			return nil
+		}
+		if err := json.Unmarshal(resp.Return, result); err != nil {
+			return fmt.Errorf("decoding QMP response to %s: %v", command, err)
+		}
+		return nil
+	}
+}
+
+// WaitEvent waits for an event with the given name for which match returns
+// true, if not nil. Only events received since the connection was opened
+// are seen.
+func (c *QMPClient) WaitEvent(name string, match func(data json.RawMessage) bool, timeout time.Duration) (*QMPEvent, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	matches := func(e QMPEvent) bool {
+		return e.Event == name && (match == nil || match(e.Data))
+	}
+	for i, e := range c.events {
+		if matches(e) {
+			c.events = append(c.events[:i], c.events[i+1:]...)
+			return &e, nil
+		}
+	}
+	c.conn.SetDeadline(time.Now().Add(timeout))
+	for {
+		var resp qmpResponse
+		if err := c.dec.Decode(&resp); err != nil {
+			return nil, fmt.Errorf("waiting for QMP event %s: %v", name, err)
+		}
+		e := QMPEvent{resp.Event, resp.Data}
+		if resp.Event == "" {
+			continue
+		}
+		if matches(e) {
+			return &e, nil
+		}
+		c.events = append(c.events, e)
+	}
+}
+
+// Pause stops the virtual CPUs, freezing the guest.
+func (c *QMPClient) Pause() error {
+	return c.Execute("stop", nil, nil)
+}
+
+// Resume continues a paused guest.
+func (c *QMPClient) Resume() error {
+	return c.Execute("cont", nil, nil)
+}
+
+// Status returns the run state of the machine, e.g. "running" or "paused".
+func (c *QMPClient) Status() (string, error) {
+	var status struct {
+		Status string `json:"status"`
+	}
+	if err := c.Execute("query-status", nil, &status); err != nil {
+		return "", err
+	}
+	return status.Status, nil
+}
+
+// SetLink sets the link state of a network device or backend.
+func (c *QMPClient) SetLink(name string, up bool) error {
+	return c.Execute("set_link", map[string]interface{}{
+		"name": name,
+		"up":   up,
+	}, nil)
+}
+
+// Screendump saves the screen of the machine as a PPM image. The file is
+// written by the qemu process.
+func (c *QMPClient) Screendump(path string) error {
+	return c.Execute("screendump", map[string]interface{}{
+		"filename": path,
+	}, nil)
+}
+
+// HumanMonitorCommand runs a command of the human monitor, for features
+// without a QMP command, returning its output.
+func (c *QMPClient) HumanMonitorCommand(cmd string) (string, error) {
+	var out string
+	err := c.Execute("human-monitor-command", map[string]interface{}{
+		"command-line": cmd,
+	}, &out)
+	return out, err
+}
+
+// humanMonitorCommand runs a human monitor command which prints nothing
+// unless it fails.
+func (c *QMPClient) humanMonitorCommand(cmd string) error {
+	out, err := c.HumanMonitorCommand(cmd)
+	if err != nil {
+		return err
+	}
+	if out = strings.TrimSpace(out); out != "" {
+		return fmt.Errorf("%s: %s", cmd, out)
+	}
+	return nil
+}
+
+// SaveSnapshot saves the state of the running machine, including its
+// memory, as an internal snapshot of its disks.
+func (c *QMPClient) SaveSnapshot(name string) error {
+	return c.humanMonitorCommand("savevm " + name)
+}
+
+// LoadSnapshot restores a snapshot saved by SaveSnapshot.
+func (c *QMPClient) LoadSnapshot(name string) error {
+	return c.humanMonitorCommand("loadvm " + name)
+}
+
+// DeleteSnapshot deletes a snapshot saved by SaveSnapshot.
+func (c *QMPClient) DeleteSnapshot(name string) error {
+	return c.humanMonitorCommand("delvm " + name)
+}
+
+// AddFd passes file to qemu in a new file descriptor set, returning its
+// ID. The file can be opened by qemu as /dev/fdset/ID.
+func (c *QMPClient) AddFd(file *os.File) (int, error) {
+	var fdset struct {
+		ID int `json:"fdset-id"`
+	}
+	if err := c.ExecuteFile("add-fd", nil, file, &fdset); err != nil {
+		return 0, err
+	}
+	return fdset.ID, nil
+}
+
+// RemoveFd closes the file descriptors of a set added by AddFd once they
+// are not in use anymore.
+func (c *QMPClient) RemoveFd(fdset int) error {
+	return c.Execute("remove-fd", map[string]interface{}{
+		"fdset-id": fdset,
+	}, nil)
+}
+
+// GetFd passes file to qemu under the given name, for netdevs.
+func (c *QMPClient) GetFd(name string, file *os.File) error {
+	return c.ExecuteFile("getfd", map[string]interface{}{
+		"fdname": name,
+	}, file, nil)
+}
+
+// CloseFd closes a file passed by GetFd which wasn't used by a netdev.
+func (c *QMPClient) CloseFd(name string) error {
+	return c.Execute("closefd", map[string]interface{}{
+		"fdname": name,
+	}, nil)
+}
+
+// BlockdevAdd adds a block backend for the image at path.
+func (c *QMPClient) BlockdevAdd(nodeName, path, format string) error {
+	return c.Execute("blockdev-add", map[string]interface{}{
+		"driver":    format,
+		"node-name": nodeName,
+		"file": map[string]interface{}{
+			"driver":   "file",
+			"filename": path,
+		},
+	}, nil)
+}
+
+// BlockdevDel removes a block backend which isn't used by a device.
+func (c *QMPClient) BlockdevDel(nodeName string) error {
+	return c.Execute("blockdev-del", map[string]interface{}{
+		"node-name": nodeName,
+	}, nil)
+}
+
+// NetdevAdd adds a network backend, props contains at least its type.
+func (c *QMPClient) NetdevAdd(id string, props map[string]interface{}) error {
+	args := map[string]interface{}{"id": id}
+	for k, v := range props {
+		args[k] = v
+	}
+	return c.Execute("netdev_add", args, nil)
+}
+
+// NetdevDel removes a network backend which isn't used by a device.
+func (c *QMPClient) NetdevDel(id string) error {
+	return c.Execute("netdev_del", map[string]interface{}{
+		"id": id,
+	}, nil)
+}
+
+// DeviceAdd hotplugs a device of the given driver.
+func (c *QMPClient) DeviceAdd(driver, id string, props map[string]interface{}) error {
+	args := map[string]interface{}{
+		"driver": driver,
+		"id":     id,
+	}
+	for k, v := range props {
+		args[k] = v
+	}
+	return c.Execute("device_add", args, nil)
+}
+
+// DeviceDel unplugs a device and waits until the guest released it.
+func (c *QMPClient) DeviceDel(id string) error {
+	if err := c.Execute("device_del", map[string]interface{}{
+		"id": id,
+	}, nil); err != nil {
+		return err
+	}
+	_, err := c.WaitEvent("DEVICE_DELETED", func(data json.RawMessage) bool {
+		var dev struct {
+			Device string `json:"device"`
+		}
+		return json.Unmarshal(data, &dev) == nil && dev.Device == id
+	}, qmpTimeout)
+	return err
+}
+
+// qmpExecute runs QMP commands without arguments over a new connection.
+func qmpExecute(path string, commands ...string) error {
+	c, err := DialQMP(path)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	for _, command := range commands {
+		if err := c.Execute(command, nil, nil); err != nil {
+			return fmt.Errorf("QMP %s: %v", command, err)
+		}
+	}
+	return nil
+}
+
+// QMPPowerOff stops the virtual CPUs of a qemu process and resets the
+// machine, so it starts from scratch on QMPPowerOn, as if the power had
+// been cut.
+func QMPPowerOff(path string) error {
+	return qmpExecute(path, "stop", "system_reset")
+}
+
+// QMPPowerOn resumes a machine stopped by QMPPowerOff.
+func QMPPowerOn(path string) error {
+	return qmpExecute(path, "cont")
+}
+
+// QMPHardReset resets a machine without shutting down the OS, resuming it
+// if it was stopped.
+func QMPHardReset(path string) error {
+	return qmpExecute(path, "system_reset", "cont")
+}
+
+// QEMUController is implemented by machines running in a local qemu
+// process, to simulate hardware events. Tests check for support with a
+// type assertion.
+type QEMUController interface {
+	// QMP connects to the QMP socket of the machine. The connection
+	// must be closed after use, qemu accepts one at a time.
+	QMP() (*QMPClient, error)
+
+	// HotplugDisk attaches a new disk, returning the ID of its device.
+	HotplugDisk(disk Disk) (string, error)
+
+	// HotplugNIC attaches a new network interface to the network of the
+	// primary one, returning the ID of its device and its MAC address.
+	HotplugNIC() (id, mac string, err error)
+
+	// Unplug removes a hotplugged disk or network interface.
+	Unplug(id string) error
+
+	// SetLink sets the link of the primary network interface up or down.
+	SetLink(up bool) error
+
+	// Pause freezes the machine until Resume is called.
+	Pause() error
+	Resume() error
+
+	// SaveSnapshot saves the state of the running machine, including its
+	// memory, and LoadSnapshot restores it.
+	SaveSnapshot(name string) error
+	LoadSnapshot(name string) error
+
+	// Screendump saves the screen as a PPM image to an absolute path.
+	Screendump(path string) error
+}
+
+// QMPController implements QEMUController for the qemu platforms, except
+// for HotplugNIC which depends on their network setup.
+type QMPController struct {
+	QMPPath string
+	Board   string
+	// NetdevID is the ID of the network backend of the primary interface.
+	NetdevID string
+	// Ports are the PCIe root ports hotplugged devices are plugged into,
+	// see HotplugPorts. If empty, they are plugged into the root bus.
+	Ports []string
+
+	mu         sync.Mutex
+	counter    int
+	hotplugged map[string]hotplugDevice
+}
+
+type hotplugDevice struct {
+	netdev bool
+	fdset  int
+	port   string // root port the device is plugged into, if any
+}
+
+func (q *QMPController) QMP() (*QMPClient, error) {
+	return DialQMP(q.QMPPath)
+}
+
+// qmp runs f with a new QMP connection.
+func (q *QMPController) qmp(f func(c *QMPClient) error) error {
+	c, err := q.QMP()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	return f(c)
+}
+
+// newDevice reserves an ID and a free root port, if needed, for a
+// hotplugged device. props are the properties of the device, the port is
+// added to them.
+func (q *QMPController) newDevice(prefix string, dev hotplugDevice, props map[string]interface{}) (string, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.Ports) > 0 {
+		used := make(map[string]bool)
+		for _, other := range q.hotplugged {
+			used[other.port] = true
+		}
+		for _, port := range q.Ports {
+			if !used[port] {
+				dev.port = port
+				break
+			}
+		}
+		if dev.port == "" {
+			return "", fmt.Errorf("all %d PCIe root ports for hotplugging are in use", len(q.Ports))
+		}
+		props["bus"] = dev.port
+	}
+
+	if q.hotplugged == nil {
+		q.hotplugged = make(map[string]hotplugDevice)
+	}
+	q.counter++
+	id := fmt.Sprintf("%s-hotplug%d", prefix, q.counter)
+	q.hotplugged[id] = dev
+	return id, nil
+}
+
+func (q *QMPController) forgetDevice(id string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.hotplugged, id)
+}
+
+func (q *QMPController) HotplugDisk(disk Disk) (string, error) {
+	f, err := disk.setupFile()
+	if err != nil {
+		return "", err
+	}
+	// qemu keeps its own copy
+	defer f.Close()
+
+	return q.addDisk(f, disk.DeviceOpts)
+}
+
+// addDisk hotplugs the qcow2 image file as a disk with the given device
+// options. What was added is removed again if a step fails.
+func (q *QMPController) addDisk(f *os.File, deviceOpts []string) (string, error) {
+	props := make(map[string]interface{})
+	for _, opt := range deviceOpts {
+		kv := strings.SplitN(opt, "=", 2)
+		if len(kv) != 2 {
+			return "", fmt.Errorf("hotplugging disk: invalid device option %q", opt)
+		}
+		props[kv[0]] = kv[1]
+	}
+
+	var id string
+	err := q.qmp(func(c *QMPClient) error {
+		fdset, err := c.AddFd(f)
+		if err != nil {
+			return err
+		}
+		id, err = q.newDevice("disk", hotplugDevice{fdset: fdset}, props)
+		if err != nil {
+			if err := c.RemoveFd(fdset); err != nil {
+				plog.Warningf("Removing fdset %d of failed disk: %v", fdset, err)
+			}
+			return err
+		}
+
+		if err := c.BlockdevAdd(id, fmt.Sprintf("/dev/fdset/%d", fdset), "qcow2"); err != nil {
+			q.forgetDevice(id)
+			if err := c.RemoveFd(fdset); err != nil {
+				plog.Warningf("Removing fdset %d of failed disk %s: %v", fdset, id, err)
+			}
+			return err
+		}
+		props["drive"] = id
+		if err := c.DeviceAdd(virtioDriver(q.Board, "blk"), id, props); err != nil {
+			q.forgetDevice(id)
+			if err := c.BlockdevDel(id); err != nil {
+				plog.Warningf("Removing block backend of failed disk %s: %v", id, err)
+			}
+			if err := c.RemoveFd(fdset); err != nil {
+				plog.Warningf("Removing fdset %d of failed disk %s: %v", fdset, id, err)
+			}
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("hotplugging disk: %v", err)
+	}
+	return id, nil
+}
+
+// AddNIC hotplugs a network interface with the given MAC address, backed
+// by a netdev with the given properties, which include its type. If file
+// is set, it is passed to qemu as the fd property of the netdev. What was
+// added is removed again if a step fails.
+func (q *QMPController) AddNIC(netdev map[string]interface{}, file *os.File, mac string) (string, error) {
+	props := map[string]interface{}{"mac": mac}
+	id, err := q.newDevice("nic", hotplugDevice{netdev: true}, props)
+	if err != nil {
+		return "", fmt.Errorf("hotplugging network interface: %v", err)
+	}
+	err = q.qmp(func(c *QMPClient) error {
+		if file != nil {
+			if err := c.GetFd(id, file); err != nil {
+				return err
+			}
+			netdev["fd"] = id
+		}
+		if err := c.NetdevAdd(id, netdev); err != nil {
+			// the netdev takes over the file only once it is added
+			if file != nil {
+				if err := c.CloseFd(id); err != nil {
+					plog.Warningf("Closing file of failed network interface %s: %v", id, err)
+				}
+			}
+			return err
+		}
+		props["netdev"] = id
+		if err := c.DeviceAdd(virtioDriver(q.Board, "net"), id, props); err != nil {
+			if err := c.NetdevDel(id); err != nil {
+				plog.Warningf("Removing netdev of failed network interface %s: %v", id, err)
+			}
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		q.forgetDevice(id)
+		return "", fmt.Errorf("hotplugging network interface: %v", err)
+	}
+	return id, nil
+}
+
+func (q *QMPController) Unplug(id string) error {
+	q.mu.Lock()
+	dev, ok := q.hotplugged[id]
+	q.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("no hotplugged device %q", id)
+	}
+
+	err := q.qmp(func(c *QMPClient) error {
+		if err := c.DeviceDel(id); err != nil {
+			return err
+		}
+		if dev.netdev {
+			return c.NetdevDel(id)
+		}
+		if err := c.BlockdevDel(id); err != nil {
+			return err
+		}
+		return c.RemoveFd(dev.fdset)
+	})
+	if err != nil {
+		return fmt.Errorf("unplugging %s: %v", id, err)
+	}
+	q.forgetDevice(id)
+	return nil
+}
+
+func (q *QMPController) SetLink(up bool) error {
+	return q.qmp(func(c *QMPClient) error {
+		return c.SetLink(q.NetdevID, up)
+	})
+}
+
+func (q *QMPController) Pause() error {
+	return q.qmp((*QMPClient).Pause)
+}
+
+func (q *QMPController) Resume() error {
+	return q.qmp((*QMPClient).Resume)
+}
+
+func (q *QMPController) SaveSnapshot(name string) error {
+	return q.qmp(func(c *QMPClient) error {
+		return c.SaveSnapshot(name)
+	})
+}
+
+func (q *QMPController) LoadSnapshot(name string) error {
+	return q.qmp(func(c *QMPClient) error {
+		return c.LoadSnapshot(name)
+	})
+}
+
+func (q *QMPController) Screendump(path string) error {
+	return q.qmp(func(c *QMPClient) error {
+		return c.Screendump(path)
+	})
+}
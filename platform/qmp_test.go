@@ -0,0 +1,410 @@
+// Copyright The Mantle Authors.
+// SPDX-License-Identifier: Apache-2.0
+
+package platform
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeQMP is a QMP server answering commands with the messages returned
+// by its handler, e.g. events followed by the response.
+type fakeQMP struct {
+	path    string
+	handler func(command string, args map[string]interface{}) []interface{}
+
+	mu       sync.Mutex
+	commands []string
+}
+
+func newFakeQMP(t *testing.T, handler func(command string, args map[string]interface{}) []interface{}) *fakeQMP {
+	dir, err := ioutil.TempDir("", "mantle-qmp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	s := &fakeQMP{
+		path:    filepath.Join(dir, "qmp.sock"),
+		handler: handler,
+	}
+	l, err := net.Listen("unix", s.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *fakeQMP) serve(conn net.Conn) {
+	defer conn.Close()
+	enc := json.NewEncoder(conn)
+	dec := json.NewDecoder(conn)
+	enc.Encode(map[string]interface{}{
+		"QMP": map[string]interface{}{
+			"version":      map[string]interface{}{"package": "fake"},
+			"capabilities": []string{},
+		},
+	})
+	for {
+		var req struct {
+			Execute   string                 `json:"execute"`
+			Arguments map[string]interface{} `json:"arguments"`
+		}
+		if err := dec.Decode(&req); err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.commands = append(s.commands, req.Execute)
+		s.mu.Unlock()
+
+		msgs := []interface{}{qmpReturn(struct{}{})}
+		if req.Execute != "qmp_capabilities" && s.handler != nil {
+			msgs = s.handler(req.Execute, req.Arguments)
+		}
+		for _, msg := range msgs {
+			enc.Encode(msg)
+		}
+	}
+}
+
+// executed returns the commands received since the last call, except
+// qmp_capabilities.
+func (s *fakeQMP) executed() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var commands []string
+	for _, command := range s.commands {
+		if command != "qmp_capabilities" {
+			commands = append(commands, command)
+		}
+	}
+	s.commands = nil
+	return commands
+}
+
+func qmpReturn(v interface{}) map[string]interface{} {
+	return map[string]interface{}{"return": v}
+}
+
+func qmpEvent(name string, data interface{}) map[string]interface{} {
+	return map[string]interface{}{"event": name, "data": data}
+}
+
+func qmpErr(class, desc string) map[string]interface{} {
+	return map[string]interface{}{"error": map[string]string{"class": class, "desc": desc}}
+}
+
+func TestQMPExecute(t *testing.T) {
+	s := newFakeQMP(t, func(command string, args map[string]interface{}) []interface{} {
+		switch command {
+		case "query-status":
+			// an event may arrive before the response
+			return []interface{}{
+				qmpEvent("RESUME", nil),
+				qmpReturn(map[string]interface{}{"status": "running", "running": true}),
+			}
+		case "stop":
+			return []interface{}{qmpErr("GenericError", "cannot stop")}
+		}
+		return []interface{}{qmpReturn(struct{}{})}
+	})
+
+	c, err := DialQMP(s.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	status, err := c.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != "running" {
+		t.Errorf("got status %q, expected running", status)
+	}
+
+	err = c.Pause()
+	if qerr, ok := err.(*QMPError); !ok || qerr.Class != "GenericError" || qerr.Desc != "cannot stop" {
+		t.Errorf("expected a GenericError, got %v", err)
+	}
+
+	// the event received with the response was kept
+	e, err := c.WaitEvent("RESUME", nil, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Event != "RESUME" {
+		t.Errorf("got event %s instead of RESUME", e.Event)
+	}
+	if _, err := c.WaitEvent("RESUME", nil, 10*time.Millisecond); err == nil {
+		t.Errorf("the event was returned twice")
+	}
+
+	if commands := s.executed(); !reflect.DeepEqual(commands, []string{"query-status", "stop"}) {
+		t.Errorf("unexpected commands %v", commands)
+	}
+}
+
+func TestQMPGreeting(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mantle-qmp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "qmp.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		json.NewEncoder(conn).Encode(qmpReturn(struct{}{}))
+	}()
+
+	if c, err := DialQMP(path); err == nil {
+		c.Close()
+		t.Errorf("connected to a server without greeting")
+	}
+}
+
+func TestQMPWaitEvent(t *testing.T) {
+	deleted := func(dev string) map[string]interface{} {
+		return qmpEvent("DEVICE_DELETED", map[string]string{"device": dev})
+	}
+	s := newFakeQMP(t, func(command string, args map[string]interface{}) []interface{} {
+		if command == "device_del" {
+			// the other device is released before the one deleted
+			return []interface{}{
+				qmpReturn(struct{}{}),
+				deleted("other"),
+				qmpEvent("STOP", nil),
+				deleted(args["id"].(string)),
+			}
+		}
+		return []interface{}{qmpReturn(struct{}{})}
+	})
+
+	c, err := DialQMP(s.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if err := c.DeviceDel("disk-hotplug1"); err != nil {
+		t.Fatal(err)
+	}
+
+	// events skipped while waiting are kept, in order
+	if e, err := c.WaitEvent("DEVICE_DELETED", nil, time.Second); err != nil {
+		t.Fatal(err)
+	} else if string(e.Data) != `{"device":"other"}` {
+		t.Errorf("unexpected event data %s", e.Data)
+	}
+	if _, err := c.WaitEvent("STOP", nil, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.WaitEvent("DEVICE_DELETED", nil, 10*time.Millisecond); err == nil {
+		t.Errorf("the event of the deleted device was kept")
+	}
+}
+
+func TestQMPHotplugDiskRollback(t *testing.T) {
+	f, err := ioutil.TempFile("", "mantle-qmp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	for _, c := range []struct {
+		name     string
+		failing  string
+		opts     []string
+		commands []string
+	}{
+		{
+			name:     "success",
+			commands: []string{"add-fd", "blockdev-add", "device_add"},
+		},
+		{
+			name:     "blockdev-add",
+			failing:  "blockdev-add",
+			commands: []string{"add-fd", "blockdev-add", "remove-fd"},
+		},
+		{
+			name:     "device_add",
+			failing:  "device_add",
+			commands: []string{"add-fd", "blockdev-add", "device_add", "blockdev-del", "remove-fd"},
+		},
+		{
+			name: "invalid option",
+			opts: []string{"serial"},
+		},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			s := newFakeQMP(t, func(command string, args map[string]interface{}) []interface{} {
+				if command == c.failing {
+					return []interface{}{qmpErr("GenericError", command+" failed")}
+				}
+				if command == "add-fd" {
+					return []interface{}{qmpReturn(map[string]int{"fdset-id": 3})}
+				}
+				return []interface{}{qmpReturn(struct{}{})}
+			})
+			q := &QMPController{QMPPath: s.path, Board: "amd64-usr"}
+
+			id, err := q.addDisk(f, c.opts)
+			success := c.failing == "" && c.opts == nil
+			if success && err != nil {
+				t.Fatal(err)
+			} else if !success && err == nil {
+				t.Fatal("expected an error")
+			}
+			if commands := s.executed(); !reflect.DeepEqual(commands, c.commands) {
+				t.Errorf("got commands %v, expected %v", commands, c.commands)
+			}
+			if success && len(q.hotplugged) != 1 {
+				t.Errorf("disk %s not tracked", id)
+			} else if !success && len(q.hotplugged) != 0 {
+				t.Errorf("failed disk still tracked: %v", q.hotplugged)
+			}
+		})
+	}
+}
+
+func TestQMPHotplugNICRollback(t *testing.T) {
+	f, err := ioutil.TempFile("", "mantle-qmp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	for _, c := range []struct {
+		name     string
+		failing  string
+		commands []string
+	}{
+		{
+			name:     "success",
+			commands: []string{"getfd", "netdev_add", "device_add"},
+		},
+		{
+			name:     "getfd",
+			failing:  "getfd",
+			commands: []string{"getfd"},
+		},
+		{
+			name:     "netdev_add",
+			failing:  "netdev_add",
+			commands: []string{"getfd", "netdev_add", "closefd"},
+		},
+		{
+			name:     "device_add",
+			failing:  "device_add",
+			commands: []string{"getfd", "netdev_add", "device_add", "netdev_del"},
+		},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			s := newFakeQMP(t, func(command string, args map[string]interface{}) []interface{} {
+				if command == c.failing {
+					return []interface{}{qmpErr("GenericError", command+" failed")}
+				}
+				return []interface{}{qmpReturn(struct{}{})}
+			})
+			q := &QMPController{QMPPath: s.path, Board: "amd64-usr"}
+
+			id, err := q.AddNIC(map[string]interface{}{"type": "tap"}, f, "52:54:00:12:34:56")
+			success := c.failing == ""
+			if success && err != nil {
+				t.Fatal(err)
+			} else if !success && err == nil {
+				t.Fatal("expected an error")
+			}
+			if commands := s.executed(); !reflect.DeepEqual(commands, c.commands) {
+				t.Errorf("got commands %v, expected %v", commands, c.commands)
+			}
+			if success && len(q.hotplugged) != 1 {
+				t.Errorf("network interface %s not tracked", id)
+			} else if !success && len(q.hotplugged) != 0 {
+				t.Errorf("failed network interface still tracked: %v", q.hotplugged)
+			}
+		})
+	}
+}
+
+func TestQMPHotplugPorts(t *testing.T) {
+	f, err := ioutil.TempFile("", "mantle-qmp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	var mu sync.Mutex
+	var buses []interface{}
+	s := newFakeQMP(t, func(command string, args map[string]interface{}) []interface{} {
+		switch command {
+		case "device_add":
+			mu.Lock()
+			buses = append(buses, args["bus"])
+			mu.Unlock()
+		case "device_del":
+			return []interface{}{
+				qmpReturn(struct{}{}),
+				qmpEvent("DEVICE_DELETED", map[string]interface{}{"device": args["id"]}),
+			}
+		}
+		return []interface{}{qmpReturn(struct{}{})}
+	})
+	q := &QMPController{QMPPath: s.path, Board: "amd64-usr", Ports: []string{"port0", "port1"}}
+
+	disk, err := q.addDisk(f, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := q.AddNIC(map[string]interface{}{"type": "user"}, nil, "52:54:00:12:34:56"); err != nil {
+		t.Fatal(err)
+	}
+	// all ports are in use
+	if _, err := q.addDisk(f, nil); err == nil {
+		t.Errorf("hotplugged a third device into two ports")
+	}
+	// the port of an unplugged device is free again
+	if err := q.Unplug(disk); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := q.addDisk(f, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if expected := []interface{}{"port0", "port1", "port0"}; !reflect.DeepEqual(buses, expected) {
+		t.Errorf("devices plugged into %v, expected %v", buses, expected)
+	}
+}
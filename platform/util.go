@@ -20,11 +20,16 @@ import (
 	"crypto/rsa"
 	"fmt"
 	"os"
+	"time"
 
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/crypto/ssh/terminal"
 )
 
+// kernelCrashTimeout is how long a machine may keep answering after the
+// crash was triggered.
+const kernelCrashTimeout = 10 * time.Second
+
 // Manhole connects os.Stdin, os.Stdout, and os.Stderr to an interactive shell
 // session on the Machine m. Manhole blocks until the shell session has ended.
 // If os.Stdin does not refer to a TTY, Manhole returns immediately with a nil
@@ -113,6 +118,26 @@ func StartReboot(m Machine) error {
 	return nil
 }
 
+// StartKernelCrash makes the kernel of a machine panic using the sysrq
+// trigger, which works regardless of the kernel.sysrq setting.
+func StartKernelCrash(m Machine) error {
+	// the command never returns if the kernel panics
+	ctx, cancel := context.WithTimeout(context.Background(), kernelCrashTimeout)
+	defer cancel()
+	res, err := m.RunContext(ctx, "sudo sh -c 'echo c > /proc/sysrq-trigger'", RunOptions{})
+	if _, ok := err.(*ssh.ExitMissingError); ok || err == context.DeadlineExceeded {
+		return nil
+	}
+	if err != nil {
+		var stderr []byte
+		if res != nil {
+			stderr = res.Stderr
+		}
+		return fmt.Errorf("issuing crash command failed: %v: %s", err, stderr)
+	}
+	return fmt.Errorf("machine %q didn't crash", m.ID())
+}
+
 // RebootMachine will reboot a given machine, provided the machine's journal.
 func RebootMachine(m Machine, j *Journal) error {
 	if err := StartReboot(m); err != nil {
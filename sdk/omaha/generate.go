@@ -18,13 +18,14 @@ import (
 	"encoding/xml"
 	"fmt"
 	"os"
-	"os/exec"
 	"path/filepath"
 
 	"github.com/coreos/go-omaha/omaha"
 	"github.com/coreos/pkg/capnslog"
 
 	"github.com/flatcar/mantle/sdk"
+	"github.com/flatcar/mantle/update/generator"
+	"github.com/flatcar/mantle/update/signature"
 )
 
 const (
@@ -34,13 +35,6 @@ const (
 
 var plog = capnslog.NewPackageLogger("github.com/flatcar/mantle", "sdk/omaha")
 
-func run(name string, arg ...string) error {
-	cmd := exec.Command(name, arg...)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	return cmd.Run()
-}
-
 func xmlMarshalFile(path string, v interface{}) error {
 	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
 	if err != nil {
@@ -82,6 +76,35 @@ func checkUpdate(dir, update_xml string) error {
 	return u.Packages[0].Verify(pkgdir)
 }
 
+// generateFullPayload writes a payload updating /usr and the kernel to
+// path, signed by signers.
+func generateFullPayload(path, usr, kernel string, signers []signature.Signer) error {
+	g := generator.Generator{
+		Signers: signers,
+	}
+	defer g.Destroy()
+
+	usrProc, err := generator.FullUpdate(usr)
+	if err != nil {
+		return err
+	}
+	if err := g.Partition(usrProc); err != nil {
+		usrProc.Close()
+		return err
+	}
+
+	kernelProc, err := generator.KernelUpdate(kernel)
+	if err != nil {
+		return err
+	}
+	if err := g.Kernel(kernelProc); err != nil {
+		kernelProc.Close()
+		return err
+	}
+
+	return g.Write(path)
+}
+
 func GenerateFullUpdate(dir string) error {
 	var (
 		update_prefix = filepath.Join(dir, "flatcar_production_update")
@@ -96,12 +119,15 @@ func GenerateFullUpdate(dir string) error {
 		return nil
 	}
 
+	// sign with the developer key of the SDK
+	key, err := signature.ReadPrivateKey(privateKey)
+	if err != nil {
+		return err
+	}
+
 	plog.Noticef("Generating update payload: %s", update_gz)
-	if err := run("delta_generator",
-		"-new_image", update_bin,
-		"-new_kernel", vmlinuz,
-		"-out_file", update_gz,
-		"-private_key", privateKey); err != nil {
+	signers := []signature.Signer{signature.NewKeySigner(key)}
+	if err := generateFullPayload(update_gz, update_bin, vmlinuz, signers); err != nil {
 		return err
 	}
 
@@ -124,3 +150,17 @@ func GenerateFullUpdate(dir string) error {
 
 	return xmlMarshalFile(update_xml, &update)
 }
+
+// GenerateSignedPayload writes a full update payload of the image in dir
+// to path, signed by signers instead of the developer key of the SDK.
+// Unlike GenerateFullUpdate, it always generates the payload and doesn't
+// write an update manifest.
+func GenerateSignedPayload(dir, path string, signers ...signature.Signer) error {
+	var (
+		update_bin = filepath.Join(dir, "flatcar_production_update.bin")
+		vmlinuz    = filepath.Join(dir, "flatcar_production_image.vmlinuz")
+	)
+
+	plog.Noticef("Generating signed update payload: %s", path)
+	return generateFullPayload(path, update_bin, vmlinuz, signers)
+}
@@ -1,18 +1,45 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"os"
 
 	"github.com/flatcar/mantle/update"
+	"github.com/flatcar/mantle/update/signature"
 )
 
 func main() {
 	u := update.Updater{
 		DstPartition: "out",
+		DstKernel:    "out.vmlinuz",
 	}
 
-	if err := u.OpenPayload(os.Args[1]); err != nil {
+	flag.Func("public-key", "PEM `file` of a key the payload may be signed with, may be repeated (default developer key)", func(path string) error {
+		key, err := signature.ReadPublicKey(path)
+		if err != nil {
+			return err
+		}
+		u.Verifiers = append(u.Verifiers, signature.NewKeyVerifier(path, key))
+		return nil
+	})
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] payload [source-partition]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() < 1 || flag.NArg() > 2 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	// delta payloads are applied to a source partition
+	if flag.NArg() > 1 {
+		u.SrcPartition = flag.Arg(1)
+	}
+
+	if err := u.OpenPayload(flag.Arg(0)); err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
@@ -0,0 +1,101 @@
+// Copyright The Mantle Authors.
+// SPDX-License-Identifier: Apache-2.0
+
+// Package bsdiff implements the BSDIFF40 binary diff format used by the
+// BSDIFF operation of update payloads.
+package bsdiff
+
+import (
+	"bytes"
+	"compress/bzip2"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	magic      = "BSDIFF40"
+	headerSize = 32
+)
+
+var (
+	InvalidMagic   = errors.New("bsdiff: patch missing magic prefix")
+	CorruptedPatch = errors.New("bsdiff: corrupted patch")
+)
+
+// offtin decodes the sign-magnitude integers used by the patch format.
+func offtin(b []byte) int64 {
+	y := int64(binary.LittleEndian.Uint64(b) &^ (1 << 63))
+	if b[7]&0x80 != 0 {
+		y = -y
+	}
+	return y
+}
+
+// Patch applies a patch to old and returns the new data.
+//
+// The patch starts with a header of the magic, the lengths of the
+// compressed control and diff blocks and the length of the new data,
+// followed by the bzip2 compressed control, diff and extra blocks. The
+// control block is a sequence of triples: the number of bytes to add from
+// the diff block to old, the number of bytes to copy from the extra block
+// and the number of bytes to seek forward (or backward) in old.
+func Patch(old, patch []byte) ([]byte, error) {
+	if len(patch) < headerSize {
+		return nil, CorruptedPatch
+	}
+	if string(patch[:8]) != magic {
+		return nil, InvalidMagic
+	}
+
+	ctrlLen := offtin(patch[8:])
+	diffLen := offtin(patch[16:])
+	newSize := offtin(patch[24:])
+	if ctrlLen < 0 || diffLen < 0 || newSize < 0 ||
+		headerSize+ctrlLen+diffLen > int64(len(patch)) {
+		return nil, CorruptedPatch
+	}
+
+	body := patch[headerSize:]
+	ctrl := bzip2.NewReader(bytes.NewReader(body[:ctrlLen]))
+	diff := bzip2.NewReader(bytes.NewReader(body[ctrlLen : ctrlLen+diffLen]))
+	extra := bzip2.NewReader(bytes.NewReader(body[ctrlLen+diffLen:]))
+
+	newData := make([]byte, newSize)
+	var oldPos, newPos int64
+	var buf [24]byte
+	for newPos < newSize {
+		if _, err := io.ReadFull(ctrl, buf[:]); err != nil {
+			return nil, fmt.Errorf("bsdiff: reading control block: %v", err)
+		}
+		addLen := offtin(buf[0:])
+		copyLen := offtin(buf[8:])
+		seekLen := offtin(buf[16:])
+
+		if addLen < 0 || newPos+addLen > newSize {
+			return nil, CorruptedPatch
+		}
+		if _, err := io.ReadFull(diff, newData[newPos:newPos+addLen]); err != nil {
+			return nil, fmt.Errorf("bsdiff: reading diff block: %v", err)
+		}
+		for i := int64(0); i < addLen; i++ {
+			if oldPos+i >= 0 && oldPos+i < int64(len(old)) {
+				newData[newPos+i] += old[oldPos+i]
+			}
+		}
+		newPos += addLen
+		oldPos += addLen
+
+		if copyLen < 0 || newPos+copyLen > newSize {
+			return nil, CorruptedPatch
+		}
+		if _, err := io.ReadFull(extra, newData[newPos:newPos+copyLen]); err != nil {
+			return nil, fmt.Errorf("bsdiff: reading extra block: %v", err)
+		}
+		newPos += copyLen
+		oldPos += seekLen
+	}
+
+	return newData, nil
+}
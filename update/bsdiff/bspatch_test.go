@@ -0,0 +1,120 @@
+// Copyright The Mantle Authors.
+// SPDX-License-Identifier: Apache-2.0
+
+package bsdiff
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/flatcar/mantle/system/exec"
+)
+
+func compress(t *testing.T, data []byte) []byte {
+	var out bytes.Buffer
+	cmd := exec.Command("bzip2", "-c")
+	cmd.Stdin = bytes.NewReader(data)
+	cmd.Stdout = &out
+	if err := cmd.Run(); err != nil {
+		if exec.IsCmdNotFound(err) {
+			t.Skip(err)
+		}
+		t.Fatal(err)
+	}
+	return out.Bytes()
+}
+
+func offtout(x int64) []byte {
+	b := make([]byte, 8)
+	if x < 0 {
+		binary.LittleEndian.PutUint64(b, uint64(-x))
+		b[7] |= 0x80
+	} else {
+		binary.LittleEndian.PutUint64(b, uint64(x))
+	}
+	return b
+}
+
+// makePatch assembles a patch from control triples and uncompressed
+// diff and extra blocks.
+func makePatch(t *testing.T, newSize int64, ctrl [][3]int64, diff, extra []byte) []byte {
+	var rawCtrl []byte
+	for _, c := range ctrl {
+		for _, x := range c {
+			rawCtrl = append(rawCtrl, offtout(x)...)
+		}
+	}
+	zCtrl := compress(t, rawCtrl)
+	zDiff := compress(t, diff)
+
+	patch := []byte(magic)
+	patch = append(patch, offtout(int64(len(zCtrl)))...)
+	patch = append(patch, offtout(int64(len(zDiff)))...)
+	patch = append(patch, offtout(newSize)...)
+	patch = append(patch, zCtrl...)
+	patch = append(patch, zDiff...)
+	return append(patch, compress(t, extra)...)
+}
+
+func TestOfftin(t *testing.T) {
+	for _, x := range []int64{0, 1, -1, 4096, -4096, 1 << 40, -(1 << 40)} {
+		if y := offtin(offtout(x)); y != x {
+			t.Errorf("offtin(offtout(%d)) = %d", x, y)
+		}
+	}
+}
+
+func TestPatch(t *testing.T) {
+	old := []byte("hello, old world")
+	want := []byte("jello, new world!!")
+
+	// add the first 16 bytes of old with differences, then append
+	// "!!" from the extra block
+	diff := make([]byte, 16)
+	for i := range diff {
+		diff[i] = want[i] - old[i]
+	}
+	patch := makePatch(t, int64(len(want)), [][3]int64{{16, 2, 0}}, diff, []byte("!!"))
+
+	got, err := Patch(old, patch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestPatchSeek(t *testing.T) {
+	old := []byte("0123456789")
+	want := []byte("789-012")
+
+	// seek to "789", then back from its end to "012"
+	patch := makePatch(t, int64(len(want)),
+		[][3]int64{{0, 0, 7}, {3, 1, -10}, {3, 0, 0}},
+		make([]byte, 6), []byte("-"))
+
+	got, err := Patch(old, patch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestPatchCorrupted(t *testing.T) {
+	if _, err := Patch(nil, []byte("BSDIFF39")); err != CorruptedPatch {
+		t.Errorf("short patch: got %v", err)
+	}
+	if _, err := Patch(nil, make([]byte, headerSize)); err != InvalidMagic {
+		t.Errorf("bad magic: got %v", err)
+	}
+
+	// the control block adds more bytes than the new size
+	patch := makePatch(t, 2, [][3]int64{{3, 0, 0}}, make([]byte, 3), nil)
+	if _, err := Patch(nil, patch); err != CorruptedPatch {
+		t.Errorf("overflowing control: got %v", err)
+	}
+}
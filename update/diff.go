@@ -0,0 +1,262 @@
+// Copyright The Mantle Authors.
+// SPDX-License-Identifier: Apache-2.0
+
+package update
+
+import (
+	"bytes"
+	"compress/bzip2"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/ulikunitz/xz"
+
+	"github.com/flatcar/mantle/update/metadata"
+)
+
+// maxDiffRanges limits the divergent block ranges reported per procedure.
+const maxDiffRanges = 10
+
+// PayloadDiff describes how two payloads differ.
+type PayloadDiff struct {
+	// Differences are the fields of the header, manifest, operations
+	// and signatures which differ, as "path: a != b".
+	Differences []string `json:"differences"`
+	// Blocks describes the destination blocks whose content differs,
+	// for each procedure both payloads contain.
+	Blocks []BlockDiff `json:"blocks"`
+}
+
+// BlockDiff lists the first ranges of destination blocks of a procedure
+// whose content differs. Blocks written by MOVE, BSDIFF and DISCARD
+// operations depend on the source and can't be compared.
+type BlockDiff struct {
+	Procedure string       `json:"procedure"`
+	Ranges    []ExtentInfo `json:"ranges,omitempty"`
+	Divergent uint64       `json:"divergent"`
+	Unknown   uint64       `json:"unknown"`
+}
+
+// Equal reports whether no differences were found.
+func (d *PayloadDiff) Equal() bool {
+	if len(d.Differences) != 0 {
+		return false
+	}
+	for _, b := range d.Blocks {
+		if b.Divergent != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// blockSums holds the hash of every destination block of a procedure
+// known from the payload alone.
+type blockSums struct {
+	sums    map[uint64][sha256.Size]byte
+	unknown map[uint64]bool
+}
+
+// DiffPayloads reads both payloads entirely and compares them.
+func DiffPayloads(a, b *Payload) (*PayloadDiff, error) {
+	aSums, err := a.blockSums()
+	if err != nil {
+		return nil, fmt.Errorf("first payload: %v", err)
+	}
+	bSums, err := b.blockSums()
+	if err != nil {
+		return nil, fmt.Errorf("second payload: %v", err)
+	}
+
+	// Load the signatures, whether they are valid doesn't matter.
+	a.VerifySignature()
+	b.VerifySignature()
+
+	diff := &PayloadDiff{}
+	diffValues(&diff.Differences, "", reflect.ValueOf(a.Info()), reflect.ValueOf(b.Info()))
+	for i := range a.Signatures.Signatures {
+		if i < len(b.Signatures.Signatures) &&
+			!bytes.Equal(a.Signatures.Signatures[i].Data, b.Signatures.Signatures[i].Data) {
+			diff.Differences = append(diff.Differences, fmt.Sprintf("signatures[%d].data differs", i))
+		}
+	}
+
+	aProcs, bProcs := a.Procedures(), b.Procedures()
+	for i := 0; i < len(aProcs) && i < len(bProcs); i++ {
+		if aProcs[i].GetType() != bProcs[i].GetType() {
+			continue
+		}
+		diff.Blocks = append(diff.Blocks, diffBlocks(procedureName(aProcs[i].GetType()), aSums[i], bSums[i]))
+	}
+	return diff, nil
+}
+
+func diffBlocks(name string, a, b blockSums) BlockDiff {
+	d := BlockDiff{Procedure: name}
+	blocks := make(map[uint64]bool)
+	for block := range a.sums {
+		blocks[block] = true
+	}
+	for block := range b.sums {
+		blocks[block] = true
+	}
+	for block := range a.unknown {
+		blocks[block] = true
+	}
+	for block := range b.unknown {
+		blocks[block] = true
+	}
+	sorted := make([]uint64, 0, len(blocks))
+	for block := range blocks {
+		sorted = append(sorted, block)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	for _, block := range sorted {
+		if a.unknown[block] || b.unknown[block] {
+			d.Unknown++
+			continue
+		}
+		aSum, aOk := a.sums[block]
+		bSum, bOk := b.sums[block]
+		if aOk == bOk && aSum == bSum {
+			continue
+		}
+		d.Divergent++
+		if n := len(d.Ranges); n > 0 && d.Ranges[n-1].StartBlock+d.Ranges[n-1].NumBlocks == block {
+			d.Ranges[n-1].NumBlocks++
+		} else if n < maxDiffRanges {
+			d.Ranges = append(d.Ranges, ExtentInfo{StartBlock: block, NumBlocks: 1})
+		}
+	}
+	return d
+}
+
+// diffValues compares the fields of two PayloadInfo values.
+func diffValues(diffs *[]string, path string, a, b reflect.Value) {
+	switch a.Kind() {
+	case reflect.Ptr:
+		if a.IsNil() || b.IsNil() {
+			if a.IsNil() != b.IsNil() {
+				*diffs = append(*diffs, fmt.Sprintf("%s: %s != %s", path, formatValue(a), formatValue(b)))
+			}
+			return
+		}
+		diffValues(diffs, path, a.Elem(), b.Elem())
+	case reflect.Struct:
+		for i := 0; i < a.NumField(); i++ {
+			name := strings.Split(a.Type().Field(i).Tag.Get("json"), ",")[0]
+			if name == "" || name == "-" || name == "verified" || name == "error" {
+				continue
+			}
+			if path != "" {
+				name = path + "." + name
+			}
+			diffValues(diffs, name, a.Field(i), b.Field(i))
+		}
+	case reflect.Slice:
+		if a.Len() != b.Len() {
+			*diffs = append(*diffs, fmt.Sprintf("%s: %d != %d entries", path, a.Len(), b.Len()))
+		}
+		for i := 0; i < a.Len() && i < b.Len(); i++ {
+			diffValues(diffs, fmt.Sprintf("%s[%d]", path, i), a.Index(i), b.Index(i))
+		}
+	default:
+		if !reflect.DeepEqual(a.Interface(), b.Interface()) {
+			*diffs = append(*diffs, fmt.Sprintf("%s: %s != %s", path, formatValue(a), formatValue(b)))
+		}
+	}
+}
+
+func formatValue(v reflect.Value) string {
+	if v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return "none"
+		}
+		v = v.Elem()
+	}
+	return fmt.Sprint(v.Interface())
+}
+
+// blockSums reads the data of all operations, returning the hashes of
+// the destination blocks of each procedure.
+func (p *Payload) blockSums() ([]blockSums, error) {
+	var procs []blockSums
+	bs := uint64(p.Manifest.GetBlockSize())
+	zeroSum := sha256.Sum256(make([]byte, bs))
+	for _, proc := range p.Procedures() {
+		sums := blockSums{
+			sums:    make(map[uint64][sha256.Size]byte),
+			unknown: make(map[uint64]bool),
+		}
+		for i, op := range p.Operations(proc) {
+			data, err := op.content()
+			if err != nil {
+				return nil, fmt.Errorf("%s operation %d: %v", procedureName(proc.GetType()), i+1, err)
+			}
+			block := make([]byte, bs)
+			for _, extent := range op.Operation.DstExtents {
+				for j := uint64(0); j < extent.GetNumBlocks(); j++ {
+					n := extent.GetStartBlock() + j
+					if op.Operation.GetType() == metadata.InstallOperation_ZERO {
+						sums.sums[n] = zeroSum
+						continue
+					}
+					if data == nil {
+						sums.unknown[n] = true
+						continue
+					}
+					// the last block of the content may be short
+					block = block[:copy(block[:bs], data)]
+					data = data[len(block):]
+					sums.sums[n] = sha256.Sum256(block)
+				}
+			}
+		}
+		procs = append(procs, sums)
+	}
+	return procs, nil
+}
+
+// content reads the operation's data, returning what it writes to its
+// destination extents, or nil if that depends on the source or isn't
+// stored in the payload.
+func (op *Operation) content() ([]byte, error) {
+	var r io.Reader
+	switch op.Operation.GetType() {
+	case metadata.InstallOperation_REPLACE:
+		r = op
+	case metadata.InstallOperation_REPLACE_BZ:
+		r = bzip2.NewReader(op)
+	case metadata.InstallOperation_REPLACE_XZ:
+		xzr, err := xz.NewReader(op)
+		if err != nil {
+			return nil, err
+		}
+		r = xzr
+	}
+
+	var data []byte
+	if r != nil {
+		var err error
+		if data, err = ioutil.ReadAll(r); err != nil {
+			return nil, err
+		}
+	}
+	// skip what wasn't read, e.g. the data of BSDIFF operations
+	if _, err := io.Copy(ioutil.Discard, op); err != nil {
+		return nil, err
+	}
+	if r == nil {
+		return nil, nil
+	}
+	if data == nil {
+		data = []byte{}
+	}
+	return data, nil
+}
@@ -0,0 +1,156 @@
+// Copyright The Mantle Authors.
+// SPDX-License-Identifier: Apache-2.0
+
+package disk
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/flatcar/mantle/update"
+	"github.com/flatcar/mantle/update/metadata"
+	"github.com/flatcar/mantle/update/signature"
+)
+
+const (
+	espLabel  = "EFI-SYSTEM"
+	kernelDir = "/flatcar"
+)
+
+var usrLabels = []string{"USR-A", "USR-B"}
+
+// kernelPath returns the path on the EFI system partition of the kernel
+// booted with a /usr partition.
+func kernelPath(usr *Partition) string {
+	slot := strings.ToLower(strings.TrimPrefix(usr.Label, "USR-"))
+	return kernelDir + "/vmlinuz-" + slot
+}
+
+// usrPartitions returns the /usr partitions of the disk, the one booted
+// next first.
+func (d *Disk) usrPartitions() (active, inactive *Partition, err error) {
+	var parts []*Partition
+	for _, label := range usrLabels {
+		p, err := d.GPT.Partition(label)
+		if err != nil {
+			return nil, nil, err
+		}
+		parts = append(parts, p)
+	}
+
+	active = NextBoot(parts)
+	if active == nil {
+		return nil, nil, fmt.Errorf("%s: no bootable /usr partition", d.path)
+	}
+	if active == parts[0] {
+		return parts[0], parts[1], nil
+	}
+	return parts[1], parts[0], nil
+}
+
+// Apply applies an update payload to the /usr partition which isn't
+// booted next, writes the kernel of the payload to the EFI system
+// partition and makes the updated partition the next one to boot, the
+// way update_engine and its postinstall do on a running system. The
+// updated partition is returned.
+func (d *Disk) Apply(payloadPath string, verifiers []signature.Verifier) (*Partition, error) {
+	active, target, err := d.usrPartitions()
+	if err != nil {
+		return nil, err
+	}
+	plog.Infof("Updating %s from %s", target.Label, active.Label)
+
+	f, err := os.Open(payloadPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	payload, err := update.NewPayloadFrom(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", payloadPath, err)
+	}
+	if _, err := f.Seek(0, os.SEEK_SET); err != nil {
+		return nil, err
+	}
+
+	// The updater works on files, the partitions are copied in and
+	// out of a temporary directory.
+	dir, err := ioutil.TempDir("", "update-disk-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	updater := update.Updater{
+		SrcPartition: filepath.Join(dir, "src.usr"),
+		DstPartition: filepath.Join(dir, "dst.usr"),
+		SrcKernel:    filepath.Join(dir, "src.vmlinuz"),
+		DstKernel:    filepath.Join(dir, "dst.vmlinuz"),
+		Verifiers:    verifiers,
+	}
+
+	var esp *Partition
+	for _, proc := range payload.Procedures() {
+		if proc.GetType() == metadata.InstallProcedure_KERNEL {
+			if esp, err = d.GPT.Partition(espLabel); err != nil {
+				return nil, err
+			}
+		}
+		if proc.OldInfo.GetSize() == 0 {
+			continue
+		}
+		// delta updates need the content of the active partition
+		if proc.GetType() == metadata.InstallProcedure_KERNEL {
+			err = d.CopyFromFAT(esp, kernelPath(active), updater.SrcKernel)
+		} else {
+			err = d.extractPartition(active, updater.SrcPartition)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err := updater.UsePayload(f); err != nil {
+		return nil, err
+	}
+	if err := updater.Update(); err != nil {
+		return nil, err
+	}
+
+	dst, err := os.Open(updater.DstPartition)
+	if err != nil {
+		return nil, err
+	}
+	defer dst.Close()
+	if err := d.WritePartition(target, dst); err != nil {
+		return nil, err
+	}
+
+	if esp != nil {
+		if err := d.CopyToFAT(esp, updater.DstKernel, kernelPath(target)); err != nil {
+			return nil, err
+		}
+	}
+
+	// like cgpt add -S0 -T1 and cgpt prioritize in the postinstall
+	target.SetSuccessful(false)
+	target.SetTries(1)
+	Prioritize(target, []*Partition{active, target})
+	if err := d.WriteGPT(); err != nil {
+		return nil, err
+	}
+	return target, nil
+}
+
+func (d *Disk) extractPartition(p *Partition, path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return d.ReadPartition(p, f)
+}
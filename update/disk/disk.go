@@ -0,0 +1,183 @@
+// Copyright The Mantle Authors.
+// SPDX-License-Identifier: Apache-2.0
+
+package disk
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/coreos/pkg/capnslog"
+
+	"github.com/flatcar/mantle/system/exec"
+	"github.com/flatcar/mantle/util"
+)
+
+var plog = capnslog.NewPackageLogger("github.com/flatcar/mantle", "update/disk")
+
+// Disk is a disk image opened for writing. Raw images are used
+// directly, other formats are attached with qemu-nbd, which requires
+// root and the nbd kernel module.
+type Disk struct {
+	*os.File
+	GPT *GPT
+
+	path string
+	nbd  string // attached nbd device, if any
+}
+
+// Open opens a disk image and reads its partition table.
+func Open(path string) (*Disk, error) {
+	format := "raw"
+	if info, err := util.GetImageInfo(path); err == nil {
+		format = info.Format
+	} else if exec.IsCmdNotFound(err) {
+		plog.Warningf("qemu-img not found, assuming %s is a raw image", path)
+	} else {
+		return nil, fmt.Errorf("%s: qemu-img info: %v", path, err)
+	}
+
+	var err error
+	d := &Disk{path: path}
+	dev := path
+	if format != "raw" {
+		if d.nbd, err = attachNBD(path, format); err != nil {
+			return nil, err
+		}
+		dev = d.nbd
+	}
+
+	if d.File, err = os.OpenFile(dev, os.O_RDWR, 0); err != nil {
+		d.detach()
+		return nil, err
+	}
+	if d.GPT, err = ReadGPT(d.File); err != nil {
+		d.Close()
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return d, nil
+}
+
+// Close flushes and closes the disk, detaching it from qemu-nbd.
+func (d *Disk) Close() error {
+	err := d.File.Sync()
+	if e := d.File.Close(); err == nil {
+		err = e
+	}
+	if e := d.detach(); err == nil {
+		err = e
+	}
+	return err
+}
+
+// WriteGPT writes the changes to the partition table.
+func (d *Disk) WriteGPT() error {
+	return d.GPT.Write(d.File)
+}
+
+// ReadPartition copies the content of a partition to w.
+func (d *Disk) ReadPartition(p *Partition, w io.Writer) error {
+	_, err := io.Copy(w, io.NewSectionReader(d.File, p.Offset(), p.Size()))
+	return err
+}
+
+// WritePartition replaces the beginning of a partition with the content
+// of r, the rest of the partition is left as it is.
+func (d *Disk) WritePartition(p *Partition, r io.Reader) error {
+	if _, err := d.File.Seek(p.Offset(), io.SeekStart); err != nil {
+		return err
+	}
+	// read one byte more than fits to detect oversized data
+	n, err := io.Copy(d.File, io.LimitReader(r, p.Size()+1))
+	if err != nil {
+		return err
+	}
+	if n > p.Size() {
+		return fmt.Errorf("%w %s", ErrPartitionSize, p.Label)
+	}
+	return nil
+}
+
+// CopyToFAT copies a file into the FAT filesystem of a partition using
+// mtools, replacing an existing file.
+func (d *Disk) CopyToFAT(p *Partition, src, dst string) error {
+	image := fmt.Sprintf("%s@@%d", d.File.Name(), p.Offset())
+	if err := d.File.Sync(); err != nil {
+		return err
+	}
+	if dir := filepath.Dir(dst); dir != "/" {
+		// mmd fails if the directory exists
+		exec.Command("mmd", "-D", "s", "-i", image, "::"+dir).Run()
+	}
+	cmd := exec.Command("mcopy", "-o", "-i", image, src, "::"+dst)
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("mcopy %s: %v", dst, err)
+	}
+	return nil
+}
+
+// CopyFromFAT copies a file out of the FAT filesystem of a partition
+// using mtools.
+func (d *Disk) CopyFromFAT(p *Partition, src, dst string) error {
+	image := fmt.Sprintf("%s@@%d", d.File.Name(), p.Offset())
+	cmd := exec.Command("mcopy", "-n", "-i", image, "::"+src, dst)
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("mcopy %s: %v", src, err)
+	}
+	return nil
+}
+
+// attachNBD attaches the image to the first free nbd device.
+func attachNBD(path, format string) (string, error) {
+	devices, err := filepath.Glob("/sys/block/nbd*")
+	if err != nil {
+		return "", err
+	}
+	if len(devices) == 0 {
+		return "", fmt.Errorf("no nbd devices, is the nbd module loaded?")
+	}
+
+	for _, sys := range devices {
+		// the pid file exists while a device is connected
+		if _, err := os.Stat(filepath.Join(sys, "pid")); err == nil {
+			continue
+		}
+		dev := filepath.Join("/dev", filepath.Base(sys))
+		cmd := exec.Command("qemu-nbd", "--connect="+dev, "--format="+format, path)
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			return "", fmt.Errorf("qemu-nbd: %v", err)
+		}
+		plog.Infof("Attached %s to %s", path, dev)
+
+		// the device size is only set once the connection is up
+		err := util.Retry(50, 100*time.Millisecond, func() error {
+			if _, err := os.Stat(filepath.Join(sys, "pid")); err != nil {
+				return fmt.Errorf("%s not connected", dev)
+			}
+			return nil
+		})
+		if err != nil {
+			exec.Command("qemu-nbd", "--disconnect", dev).Run()
+			return "", err
+		}
+		return dev, nil
+	}
+	return "", fmt.Errorf("no free nbd device")
+}
+
+func (d *Disk) detach() error {
+	if d.nbd == "" {
+		return nil
+	}
+	if err := exec.Command("qemu-nbd", "--disconnect", d.nbd).Run(); err != nil {
+		return fmt.Errorf("qemu-nbd --disconnect %s: %v", d.nbd, err)
+	}
+	d.nbd = ""
+	return nil
+}
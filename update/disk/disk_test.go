@@ -0,0 +1,221 @@
+// Copyright The Mantle Authors.
+// SPDX-License-Identifier: Apache-2.0
+
+package disk
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"testing"
+	"unicode/utf16"
+
+	"github.com/flatcar/mantle/system/exec"
+	"github.com/flatcar/mantle/update/generator"
+)
+
+const (
+	testDiskSectors = 16384
+	testPartSectors = 2048
+)
+
+// writeTestDisk creates a disk with a GPT containing a bootable USR-A and
+// an empty USR-B partition.
+func writeTestDisk(t *testing.T) string {
+	f, err := ioutil.TempFile("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := f.Truncate(testDiskSectors * SectorSize); err != nil {
+		t.Fatal(err)
+	}
+
+	var entries bytes.Buffer
+	for i := 0; i < 128; i++ {
+		var e gptEntry
+		if i < len(usrLabels) {
+			e.TypeGUID = [16]byte{1}
+			e.GUID = [16]byte{2, byte(i)}
+			e.FirstLBA = uint64(2048 + i*testPartSectors)
+			e.LastLBA = e.FirstLBA + testPartSectors - 1
+			copy(e.Name[:], utf16.Encode([]rune(usrLabels[i])))
+		}
+		if i == 0 {
+			e.Attributes = 1<<successfulShift | 1<<priorityShift
+		}
+		if err := binary.Write(&entries, binary.LittleEndian, &e); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	h := gptHeader{
+		Revision:       0x10000,
+		HeaderSize:     gptHeaderSize,
+		MyLBA:          1,
+		AlternateLBA:   testDiskSectors - 1,
+		FirstUsableLBA: 34,
+		LastUsableLBA:  testDiskSectors - 34,
+		EntriesLBA:     2,
+		NumEntries:     128,
+		EntrySize:      gptEntrySize,
+	}
+	copy(h.Signature[:], gptSignature)
+	backup := h
+	backup.MyLBA, backup.AlternateLBA = h.AlternateLBA, h.MyLBA
+	backup.EntriesLBA = testDiskSectors - 33
+
+	// Write computes the checksums
+	g := GPT{primary: h, backup: backup, entries: entries.Bytes()}
+	if err := g.Write(f); err != nil {
+		t.Fatal(err)
+	}
+	return f.Name()
+}
+
+func TestGPT(t *testing.T) {
+	path := writeTestDisk(t)
+	defer os.Remove(path)
+
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	g, err := ReadGPT(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(g.Partitions) != 2 {
+		t.Fatalf("expected 2 partitions, got %d", len(g.Partitions))
+	}
+	a, err := g.Partition("USR-A")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := g.Partition("USR-B")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := g.Partition("ROOT"); err == nil {
+		t.Error("found missing partition")
+	}
+	if a.Offset() != 2048*SectorSize || a.Size() != testPartSectors*SectorSize {
+		t.Errorf("unexpected USR-A offset %d size %d", a.Offset(), a.Size())
+	}
+	if NextBoot(g.Partitions) != a {
+		t.Errorf("USR-A isn't booted next")
+	}
+
+	b.SetTries(1)
+	Prioritize(b, g.Partitions)
+	if err := g.Write(f); err != nil {
+		t.Fatal(err)
+	}
+
+	g, err = ReadGPT(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, b = g.Partitions[0], g.Partitions[1]
+	if a.Priority() != 1 || !a.Successful() || b.Priority() != 2 || b.Tries() != 1 || b.Successful() {
+		t.Errorf("unexpected attributes %x %x", a.Attributes, b.Attributes)
+	}
+	if NextBoot(g.Partitions) != b {
+		t.Errorf("USR-B isn't booted next")
+	}
+
+	// the backup table must match the primary one
+	var backup gptHeader
+	if err := readHeader(f, testDiskSectors-1, &backup); err != nil {
+		t.Fatal(err)
+	}
+	entries := make([]byte, len(g.entries))
+	if _, err := f.ReadAt(entries, int64(backup.EntriesLBA)*SectorSize); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(entries, g.entries) || crc32.ChecksumIEEE(entries) != backup.EntriesCRC32 {
+		t.Errorf("backup entries differ from the primary entries")
+	}
+
+	// a damaged primary header is detected
+	if _, err := f.WriteAt([]byte{0xff}, SectorSize+24); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadGPT(f); err != ErrCorruptedGPT {
+		t.Errorf("expected %v, got %v", ErrCorruptedGPT, err)
+	}
+}
+
+func TestApply(t *testing.T) {
+	path := writeTestDisk(t)
+	defer os.Remove(path)
+
+	usr := make([]byte, testPartSectors*SectorSize/2)
+	rand.New(rand.NewSource(0)).Read(usr)
+	usrFile, err := ioutil.TempFile("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(usrFile.Name())
+	defer usrFile.Close()
+	if _, err := usrFile.Write(usr); err != nil {
+		t.Fatal(err)
+	}
+
+	proc, err := generator.FullUpdate(usrFile.Name())
+	if exec.IsCmdNotFound(err) {
+		t.Skip(err)
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	g := generator.Generator{}
+	defer g.Destroy()
+	if err := g.Partition(proc); err != nil {
+		t.Fatal(err)
+	}
+	payload := usrFile.Name() + ".gz"
+	defer os.Remove(payload)
+	if err := g.Write(payload); err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	target, err := d.Apply(payload, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if target.Label != "USR-B" {
+		t.Errorf("updated %s instead of USR-B", target.Label)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	d, err = Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	active, _, err := d.usrPartitions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if active.Label != "USR-B" {
+		t.Errorf("%s is booted next instead of USR-B", active.Label)
+	}
+	var written bytes.Buffer
+	if err := d.ReadPartition(active, &written); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(written.Bytes()[:len(usr)], usr) {
+		t.Errorf("USR-B doesn't contain the update")
+	}
+}
@@ -0,0 +1,267 @@
+// Copyright The Mantle Authors.
+// SPDX-License-Identifier: Apache-2.0
+
+package disk
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"sort"
+	"unicode/utf16"
+)
+
+const (
+	SectorSize = 512
+
+	gptSignature  = "EFI PART"
+	gptHeaderSize = 92
+	gptEntrySize  = 128
+
+	// The ChromeOS attributes used by update_engine and GRUB to pick
+	// the /usr partition to boot.
+	priorityShift   = 48
+	priorityMask    = 0xf
+	triesShift      = 52
+	triesMask       = 0xf
+	successfulShift = 56
+)
+
+var (
+	ErrNoGPT         = errors.New("disk: no GUID partition table")
+	ErrCorruptedGPT  = errors.New("disk: corrupted GUID partition table")
+	ErrNoPartition   = errors.New("disk: partition not found")
+	ErrPartitionSize = errors.New("disk: data exceeds partition")
+)
+
+type gptHeader struct {
+	Signature      [8]byte
+	Revision       uint32
+	HeaderSize     uint32
+	HeaderCRC32    uint32
+	Reserved       uint32
+	MyLBA          uint64
+	AlternateLBA   uint64
+	FirstUsableLBA uint64
+	LastUsableLBA  uint64
+	DiskGUID       [16]byte
+	EntriesLBA     uint64
+	NumEntries     uint32
+	EntrySize      uint32
+	EntriesCRC32   uint32
+}
+
+type gptEntry struct {
+	TypeGUID   [16]byte
+	GUID       [16]byte
+	FirstLBA   uint64
+	LastLBA    uint64
+	Attributes uint64
+	Name       [36]uint16
+}
+
+// Partition is an entry of a GPT. Only the attributes are written back.
+type Partition struct {
+	Number     int // starting at 1
+	Label      string
+	TypeGUID   [16]byte
+	GUID       [16]byte
+	FirstLBA   uint64
+	LastLBA    uint64
+	Attributes uint64
+}
+
+// Offset returns the offset of the partition on the disk in bytes.
+func (p *Partition) Offset() int64 {
+	return int64(p.FirstLBA) * SectorSize
+}
+
+// Size returns the size of the partition in bytes.
+func (p *Partition) Size() int64 {
+	return int64(p.LastLBA-p.FirstLBA+1) * SectorSize
+}
+
+func (p *Partition) Priority() int {
+	return int(p.Attributes >> priorityShift & priorityMask)
+}
+
+func (p *Partition) Tries() int {
+	return int(p.Attributes >> triesShift & triesMask)
+}
+
+func (p *Partition) Successful() bool {
+	return p.Attributes>>successfulShift&1 != 0
+}
+
+func (p *Partition) SetPriority(priority int) {
+	p.Attributes &^= priorityMask << priorityShift
+	p.Attributes |= uint64(priority&priorityMask) << priorityShift
+}
+
+func (p *Partition) SetTries(tries int) {
+	p.Attributes &^= triesMask << triesShift
+	p.Attributes |= uint64(tries&triesMask) << triesShift
+}
+
+func (p *Partition) SetSuccessful(successful bool) {
+	p.Attributes &^= 1 << successfulShift
+	if successful {
+		p.Attributes |= 1 << successfulShift
+	}
+}
+
+// GPT is a GUID partition table. The primary and the backup table are
+// read from the primary header and updated together.
+type GPT struct {
+	Partitions []*Partition
+
+	primary gptHeader
+	backup  gptHeader
+	entries []byte // raw entries, to keep fields we don't know about
+}
+
+// ReadGPT reads the primary partition table of a disk.
+func ReadGPT(r io.ReaderAt) (*GPT, error) {
+	var g GPT
+	if err := readHeader(r, 1, &g.primary); err != nil {
+		return nil, err
+	}
+	if err := readHeader(r, g.primary.AlternateLBA, &g.backup); err != nil {
+		return nil, fmt.Errorf("backup header: %v", err)
+	}
+	if g.primary.EntrySize < gptEntrySize || g.primary.NumEntries == 0 {
+		return nil, ErrCorruptedGPT
+	}
+
+	g.entries = make([]byte, int(g.primary.NumEntries)*int(g.primary.EntrySize))
+	if _, err := r.ReadAt(g.entries, int64(g.primary.EntriesLBA)*SectorSize); err != nil {
+		return nil, err
+	}
+	if crc32.ChecksumIEEE(g.entries) != g.primary.EntriesCRC32 {
+		return nil, ErrCorruptedGPT
+	}
+
+	for i := 0; i < int(g.primary.NumEntries); i++ {
+		var e gptEntry
+		raw := g.entries[i*int(g.primary.EntrySize):]
+		if err := binary.Read(bytes.NewReader(raw), binary.LittleEndian, &e); err != nil {
+			return nil, err
+		}
+		if e.TypeGUID == [16]byte{} {
+			continue
+		}
+		name := e.Name[:]
+		for len(name) > 0 && name[len(name)-1] == 0 {
+			name = name[:len(name)-1]
+		}
+		g.Partitions = append(g.Partitions, &Partition{
+			Number:     i + 1,
+			Label:      string(utf16.Decode(name)),
+			TypeGUID:   e.TypeGUID,
+			GUID:       e.GUID,
+			FirstLBA:   e.FirstLBA,
+			LastLBA:    e.LastLBA,
+			Attributes: e.Attributes,
+		})
+	}
+	return &g, nil
+}
+
+func readHeader(r io.ReaderAt, lba uint64, h *gptHeader) error {
+	buf := make([]byte, SectorSize)
+	if _, err := r.ReadAt(buf, int64(lba)*SectorSize); err != nil {
+		return err
+	}
+	if err := binary.Read(bytes.NewReader(buf), binary.LittleEndian, h); err != nil {
+		return err
+	}
+	if string(h.Signature[:]) != gptSignature {
+		return ErrNoGPT
+	}
+	if h.HeaderSize < gptHeaderSize || h.HeaderSize > SectorSize {
+		return ErrCorruptedGPT
+	}
+	crc := h.HeaderCRC32
+	binary.LittleEndian.PutUint32(buf[16:], 0)
+	if crc32.ChecksumIEEE(buf[:h.HeaderSize]) != crc {
+		return ErrCorruptedGPT
+	}
+	return nil
+}
+
+// Partition returns the partition with the given label.
+func (g *GPT) Partition(label string) (*Partition, error) {
+	for _, p := range g.Partitions {
+		if p.Label == label {
+			return p, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %s", ErrNoPartition, label)
+}
+
+// Write writes the attributes of the partitions to the primary and the
+// backup table.
+func (g *GPT) Write(w io.WriterAt) error {
+	for _, p := range g.Partitions {
+		raw := g.entries[(p.Number-1)*int(g.primary.EntrySize):]
+		binary.LittleEndian.PutUint64(raw[48:], p.Attributes)
+	}
+	crc := crc32.ChecksumIEEE(g.entries)
+
+	for _, h := range []*gptHeader{&g.backup, &g.primary} {
+		h.EntriesCRC32 = crc
+		h.HeaderCRC32 = 0
+		var buf bytes.Buffer
+		if err := binary.Write(&buf, binary.LittleEndian, h); err != nil {
+			return err
+		}
+		h.HeaderCRC32 = crc32.ChecksumIEEE(buf.Bytes()[:gptHeaderSize])
+		binary.LittleEndian.PutUint32(buf.Bytes()[16:], h.HeaderCRC32)
+
+		if _, err := w.WriteAt(g.entries, int64(h.EntriesLBA)*SectorSize); err != nil {
+			return err
+		}
+		if _, err := w.WriteAt(buf.Bytes()[:gptHeaderSize], int64(h.MyLBA)*SectorSize); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Prioritize gives the partition the highest priority of the given
+// partitions and lowers the others, keeping their order, like cgpt
+// prioritize does.
+func Prioritize(target *Partition, parts []*Partition) {
+	var others []*Partition
+	for _, p := range parts {
+		if p != target && p.Priority() > 0 {
+			others = append(others, p)
+		}
+	}
+	sort.SliceStable(others, func(i, j int) bool {
+		return others[i].Priority() > others[j].Priority()
+	})
+
+	target.SetPriority(len(others) + 1)
+	for i, p := range others {
+		p.SetPriority(len(others) - i)
+	}
+}
+
+// NextBoot returns the partition GRUB boots next: the one with the
+// highest priority which either booted successfully or has tries left.
+func NextBoot(parts []*Partition) *Partition {
+	var next *Partition
+	for _, p := range parts {
+		if p.Priority() == 0 || (!p.Successful() && p.Tries() == 0) {
+			continue
+		}
+		if next == nil || p.Priority() > next.Priority() {
+			next = p
+		}
+	}
+	return next
+}
@@ -0,0 +1,308 @@
+// Copyright The Mantle Authors.
+// SPDX-License-Identifier: Apache-2.0
+
+package generator
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// Bsdiff creates a BSDIFF40 patch which turns old into new, as applied
+// by the BSDIFF operation. The control, diff and extra blocks of the
+// patch are compressed with Bzip2.
+func Bsdiff(old, new []byte) ([]byte, error) {
+	sa := suffixArray(old)
+
+	var ctrl, diff, extra bytes.Buffer
+	var scan, pos, length int
+	var lastScan, lastPos, lastOffset int
+	for scan < len(new) {
+		oldScore := 0
+		scan += length
+		for scsc := scan; scan < len(new); scan++ {
+			pos, length = search(sa, old, new[scan:], 0, len(old))
+
+			for ; scsc < scan+length; scsc++ {
+				if scsc+lastOffset < len(old) && old[scsc+lastOffset] == new[scsc] {
+					oldScore++
+				}
+			}
+
+			if (length == oldScore && length != 0) || length > oldScore+8 {
+				break
+			}
+
+			if scan+lastOffset < len(old) && old[scan+lastOffset] == new[scan] {
+				oldScore--
+			}
+		}
+
+		if length == oldScore && scan != len(new) {
+			continue
+		}
+
+		// extend the previous match forwards...
+		var lenf int
+		for i, s, sf := 0, 0, 0; lastScan+i < scan && lastPos+i < len(old); {
+			if old[lastPos+i] == new[lastScan+i] {
+				s++
+			}
+			i++
+			if s*2-i > sf*2-lenf {
+				sf = s
+				lenf = i
+			}
+		}
+
+		// ...and the new match backwards
+		var lenb int
+		if scan < len(new) {
+			for i, s, sb := 1, 0, 0; scan >= lastScan+i && pos >= i; i++ {
+				if old[pos-i] == new[scan-i] {
+					s++
+				}
+				if s*2-i > sb*2-lenb {
+					sb = s
+					lenb = i
+				}
+			}
+		}
+
+		// split any overlap between the two extensions
+		if lastScan+lenf > scan-lenb {
+			overlap := (lastScan + lenf) - (scan - lenb)
+			var lens int
+			for i, s, ss := 0, 0, 0; i < overlap; i++ {
+				if new[lastScan+lenf-overlap+i] == old[lastPos+lenf-overlap+i] {
+					s++
+				}
+				if new[scan-lenb+i] == old[pos-lenb+i] {
+					s--
+				}
+				if s > ss {
+					ss = s
+					lens = i + 1
+				}
+			}
+			lenf += lens - overlap
+			lenb -= lens
+		}
+
+		for i := 0; i < lenf; i++ {
+			diff.WriteByte(new[lastScan+i] - old[lastPos+i])
+		}
+		extra.Write(new[lastScan+lenf : scan-lenb])
+
+		ctrl.Write(offtout(int64(lenf)))
+		ctrl.Write(offtout(int64((scan - lenb) - (lastScan + lenf))))
+		ctrl.Write(offtout(int64((pos - lenb) - (lastPos + lenf))))
+
+		lastScan = scan - lenb
+		lastPos = pos - lenb
+		lastOffset = pos - scan
+	}
+
+	zCtrl, err := Bzip2(ctrl.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	zDiff, err := Bzip2(diff.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	zExtra, err := Bzip2(extra.Bytes())
+	if err != nil {
+		return nil, err
+	}
+
+	patch := bytes.NewBufferString("BSDIFF40")
+	patch.Write(offtout(int64(len(zCtrl))))
+	patch.Write(offtout(int64(len(zDiff))))
+	patch.Write(offtout(int64(len(new))))
+	patch.Write(zCtrl)
+	patch.Write(zDiff)
+	patch.Write(zExtra)
+	return patch.Bytes(), nil
+}
+
+// offtout encodes the sign-magnitude integers used by the patch format.
+func offtout(x int64) []byte {
+	b := make([]byte, 8)
+	if x < 0 {
+		binary.LittleEndian.PutUint64(b, uint64(-x))
+		b[7] |= 0x80
+	} else {
+		binary.LittleEndian.PutUint64(b, uint64(x))
+	}
+	return b
+}
+
+func matchLen(a, b []byte) int {
+	i := 0
+	for i < len(a) && i < len(b) && a[i] == b[i] {
+		i++
+	}
+	return i
+}
+
+// search returns the position and length of the longest match of new in
+// old, looking at the suffixes sa[st:en+1].
+func search(sa []int, old, new []byte, st, en int) (int, int) {
+	for en-st >= 2 {
+		x := st + (en-st)/2
+		n := len(old) - sa[x]
+		if n > len(new) {
+			n = len(new)
+		}
+		if bytes.Compare(old[sa[x]:sa[x]+n], new[:n]) < 0 {
+			st = x
+		} else {
+			en = x
+		}
+	}
+
+	x := matchLen(old[sa[st]:], new)
+	y := matchLen(old[sa[en]:], new)
+	if x > y {
+		return sa[st], x
+	}
+	return sa[en], y
+}
+
+// suffixArray sorts the suffixes of old, including the empty one, with
+// the qsufsort algorithm of Larsson and Sadakane used by bsdiff.
+func suffixArray(old []byte) []int {
+	n := len(old)
+	I := make([]int, n+1)
+	V := make([]int, n+1)
+
+	var buckets [256]int
+	for _, c := range old {
+		buckets[c]++
+	}
+	for i := 1; i < 256; i++ {
+		buckets[i] += buckets[i-1]
+	}
+	for i := 255; i > 0; i-- {
+		buckets[i] = buckets[i-1]
+	}
+	buckets[0] = 0
+
+	for i, c := range old {
+		buckets[c]++
+		I[buckets[c]] = i
+	}
+	I[0] = n
+	for i, c := range old {
+		V[i] = buckets[c]
+	}
+	V[n] = 0
+	for i := 1; i < 256; i++ {
+		if buckets[i] == buckets[i-1]+1 {
+			I[buckets[i]] = -1
+		}
+	}
+	I[0] = -1
+
+	for h := 1; I[0] != -(n + 1); h += h {
+		length := 0
+		i := 0
+		for i < n+1 {
+			if I[i] < 0 {
+				length -= I[i]
+				i -= I[i]
+			} else {
+				if length != 0 {
+					I[i-length] = -length
+				}
+				length = V[I[i]] + 1 - i
+				split(I, V, i, length, h)
+				i += length
+				length = 0
+			}
+		}
+		if length != 0 {
+			I[i-length] = -length
+		}
+	}
+
+	for i := 0; i < n+1; i++ {
+		I[V[i]] = i
+	}
+	return I
+}
+
+func split(I, V []int, start, length, h int) {
+	if length < 16 {
+		for k := start; k < start+length; {
+			j := 1
+			x := V[I[k]+h]
+			for i := 1; k+i < start+length; i++ {
+				if V[I[k+i]+h] < x {
+					x = V[I[k+i]+h]
+					j = 0
+				}
+				if V[I[k+i]+h] == x {
+					I[k+j], I[k+i] = I[k+i], I[k+j]
+					j++
+				}
+			}
+			for i := 0; i < j; i++ {
+				V[I[k+i]] = k + j - 1
+			}
+			if j == 1 {
+				I[k] = -1
+			}
+			k += j
+		}
+		return
+	}
+
+	x := V[I[start+length/2]+h]
+	var jj, kk int
+	for i := start; i < start+length; i++ {
+		if V[I[i]+h] < x {
+			jj++
+		}
+		if V[I[i]+h] == x {
+			kk++
+		}
+	}
+	jj += start
+	kk += jj
+
+	i, j, k := start, 0, 0
+	for i < jj {
+		if V[I[i]+h] < x {
+			i++
+		} else if V[I[i]+h] == x {
+			I[i], I[jj+j] = I[jj+j], I[i]
+			j++
+		} else {
+			I[i], I[kk+k] = I[kk+k], I[i]
+			k++
+		}
+	}
+	for jj+j < kk {
+		if V[I[jj+j]+h] == x {
+			j++
+		} else {
+			I[jj+j], I[kk+k] = I[kk+k], I[jj+j]
+			k++
+		}
+	}
+
+	if jj > start {
+		split(I, V, start, jj-start, h)
+	}
+	for i := 0; i < kk-jj; i++ {
+		V[I[jj+i]] = kk - 1
+	}
+	if jj == kk-1 {
+		I[jj] = -1
+	}
+	if start+length > kk {
+		split(I, V, kk, start+length-kk, h)
+	}
+}
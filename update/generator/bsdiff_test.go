@@ -0,0 +1,67 @@
+// Copyright The Mantle Authors.
+// SPDX-License-Identifier: Apache-2.0
+
+package generator
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/flatcar/mantle/system/exec"
+	"github.com/flatcar/mantle/update/bsdiff"
+)
+
+func checkBsdiff(t *testing.T, old, new []byte) []byte {
+	patch, err := Bsdiff(old, new)
+	if err != nil {
+		if exec.IsCmdNotFound(err) {
+			t.Skip(err)
+		}
+
+		t.Fatal(err)
+	}
+
+	patched, err := bsdiff.Patch(old, patch)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(patched, new) {
+		t.Errorf("patch did not reproduce the new data")
+	}
+
+	return patch
+}
+
+func TestBsdiffEmpty(t *testing.T) {
+	checkBsdiff(t, nil, nil)
+	checkBsdiff(t, nil, testRand)
+	checkBsdiff(t, testRand, nil)
+}
+
+func TestBsdiffSame(t *testing.T) {
+	patch := checkBsdiff(t, testRand, testRand)
+	if len(patch) >= len(testRand)/4 {
+		t.Errorf("patch of identical data is %d bytes", len(patch))
+	}
+}
+
+func TestBsdiffChanged(t *testing.T) {
+	new := append([]byte{}, testRand...)
+	copy(new[100:], "some changed bytes")
+	new = append(new[:2000], new[2100:]...)
+	new = append(new, testOnes[:500]...)
+
+	patch := checkBsdiff(t, testRand, new)
+	if len(patch) >= len(testRand)/4 {
+		t.Errorf("patch of mostly identical data is %d bytes", len(patch))
+	}
+}
+
+func TestBsdiffRepetitive(t *testing.T) {
+	old := bytes.Repeat([]byte("abcabcabd"), 1000)
+	new := bytes.Repeat([]byte("abcabdabc"), 1100)
+	checkBsdiff(t, old, new)
+	checkBsdiff(t, testOnes, testRand)
+	checkBsdiff(t, testRand, testOnes)
+}
@@ -19,6 +19,7 @@ import (
 	"io"
 	"os"
 	"os/exec"
+	"strings"
 )
 
 type bzip2Writer struct {
@@ -27,13 +28,13 @@ type bzip2Writer struct {
 }
 
 // NewBzip2Writer wraps a writer, compressing all data written to it.
+// The block size is set explicitly so that the output doesn't depend on
+// the environment, e.g. BZIP2 variables setting options. Only the
+// reference bzip2 is used, other compressors like lbzip2 produce
+// different output and payloads wouldn't be reproducible.
 func NewBzip2Writer(w io.Writer) (io.WriteCloser, error) {
-	zipper, err := exec.LookPath("lbzip2")
-	if err != nil {
-		zipper = "bzip2"
-	}
-
-	cmd := exec.Command(zipper, "-c")
+	cmd := exec.Command("bzip2", "-9", "-c")
+	cmd.Env = bzip2Env()
 	cmd.Stdout = w
 	cmd.Stderr = os.Stderr
 	in, err := cmd.StdinPipe()
@@ -44,6 +45,17 @@ func NewBzip2Writer(w io.Writer) (io.WriteCloser, error) {
 	return &bzip2Writer{cmd, in}, cmd.Start()
 }
 
+// bzip2Env removes the variables bzip2 reads options from.
+func bzip2Env() []string {
+	var env []string
+	for _, v := range os.Environ() {
+		if !strings.HasPrefix(v, "BZIP2=") && !strings.HasPrefix(v, "BZIP=") {
+			env = append(env, v)
+		}
+	}
+	return env
+}
+
 func (bz *bzip2Writer) Write(p []byte) (n int, err error) {
 	return bz.in.Write(p)
 }
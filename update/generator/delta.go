@@ -0,0 +1,261 @@
+// Copyright The Mantle Authors.
+// SPDX-License-Identifier: Apache-2.0
+
+package generator
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/golang/protobuf/proto"
+
+	"github.com/flatcar/mantle/system"
+	"github.com/flatcar/mantle/update/metadata"
+)
+
+// DeltaUpdate generates an update Procedure which turns the file at
+// oldPath into the file at newPath. Blocks which can be found in the old
+// file are moved, other blocks are either patched with bsdiff against
+// the old blocks at the same location or replaced, whichever is smaller.
+func DeltaUpdate(oldPath, newPath string) (*Procedure, error) {
+	old, err := os.Open(oldPath)
+	if err != nil {
+		return nil, err
+	}
+	defer old.Close()
+
+	source, err := os.Open(newPath)
+	if err != nil {
+		return nil, err
+	}
+	defer source.Close()
+
+	oldInfo, err := NewInstallInfo(old)
+	if err != nil {
+		return nil, err
+	}
+	if oldInfo.GetSize()%BlockSize != 0 {
+		return nil, fmt.Errorf("%s: %v", oldPath, errShortRead)
+	}
+
+	newInfo, err := NewInstallInfo(source)
+	if err != nil {
+		return nil, err
+	}
+
+	// Unlike the data of full updates the deltas aren't created again
+	// while Generator.Write reads them, bsdiff is too slow for that.
+	// They are spooled to an unlinked file instead.
+	payload, err := system.PrivateFile("")
+	if err != nil {
+		return nil, err
+	}
+
+	scanner := deltaScanner{
+		payload:   payload,
+		old:       old,
+		oldBlocks: oldInfo.GetSize() / BlockSize,
+		source:    source,
+	}
+	if err = scanner.indexOld(); err == nil {
+		for err == nil {
+			err = scanner.Scan()
+		}
+	}
+	if err != nil && err != io.EOF {
+		payload.Close()
+		if err == errShortRead {
+			err = fmt.Errorf("%s: %v", newPath, err)
+		}
+		return nil, err
+	}
+
+	if _, err := payload.Seek(0, os.SEEK_SET); err != nil {
+		payload.Close()
+		return nil, err
+	}
+
+	return &Procedure{
+		InstallProcedure: metadata.InstallProcedure{
+			OldInfo:    oldInfo,
+			NewInfo:    newInfo,
+			Operations: scanner.operations,
+		},
+		ReadCloser: payload,
+	}, nil
+}
+
+type deltaScanner struct {
+	payload    io.Writer
+	old        io.ReaderAt
+	oldBlocks  uint64
+	oldIndex   map[[sha256.Size]byte]uint64
+	source     io.Reader
+	offset     uint64
+	operations []*metadata.InstallOperation
+}
+
+// indexOld records the first location of every distinct block of the
+// old file.
+func (d *deltaScanner) indexOld() error {
+	d.oldIndex = make(map[[sha256.Size]byte]uint64)
+	block := make([]byte, BlockSize)
+	for i := uint64(0); i < d.oldBlocks; i++ {
+		if _, err := d.old.ReadAt(block, int64(i*BlockSize)); err != nil {
+			return err
+		}
+		sum := sha256.Sum256(block)
+		if _, ok := d.oldIndex[sum]; !ok {
+			d.oldIndex[sum] = i
+		}
+	}
+	return nil
+}
+
+func (d *deltaScanner) readChunk() ([]byte, error) {
+	chunk := make([]byte, ChunkSize)
+	n, err := io.ReadFull(d.source, chunk)
+	if (err == io.EOF || err == io.ErrUnexpectedEOF) && n != 0 {
+		err = nil
+	}
+	return chunk[:n], err
+}
+
+// findOld returns the location of block in the old file.
+func (d *deltaScanner) findOld(block []byte) (uint64, bool, error) {
+	i, ok := d.oldIndex[sha256.Sum256(block)]
+	if !ok {
+		return 0, false, nil
+	}
+
+	// don't trust the hash alone
+	oldBlock := make([]byte, BlockSize)
+	if _, err := d.old.ReadAt(oldBlock, int64(i*BlockSize)); err != nil {
+		return 0, false, err
+	}
+	return i, bytes.Equal(block, oldBlock), nil
+}
+
+func (d *deltaScanner) Scan() error {
+	chunk, err := d.readChunk()
+	if err != nil {
+		return err
+	}
+	if len(chunk)%BlockSize != 0 {
+		return errShortRead
+	}
+
+	startBlock := d.offset / BlockSize
+	numBlocks := uint64(len(chunk)) / BlockSize
+	d.offset += uint64(len(chunk))
+
+	// Split the chunk into runs of blocks which are either moved from
+	// consecutive old blocks or have to be diffed.
+	var runStart, runOld uint64
+	runMove := false
+	for i := uint64(0); i <= numBlocks; i++ {
+		var oldBlock uint64
+		found := false
+		if i < numBlocks {
+			oldBlock, found, err = d.findOld(chunk[i*BlockSize : (i+1)*BlockSize])
+			if err != nil {
+				return err
+			}
+			if i > runStart && runMove && found && oldBlock == runOld+(i-runStart) {
+				continue
+			}
+			if i > runStart && !runMove && !found {
+				continue
+			}
+		}
+
+		if i > runStart {
+			if runMove {
+				d.move(runOld, startBlock+runStart, i-runStart)
+			} else if err := d.diff(startBlock+runStart, chunk[runStart*BlockSize:i*BlockSize]); err != nil {
+				return err
+			}
+		}
+		runStart, runOld, runMove = i, oldBlock, found
+	}
+
+	return nil
+}
+
+func extent(start, num uint64) []*metadata.Extent {
+	return []*metadata.Extent{&metadata.Extent{
+		StartBlock: proto.Uint64(start),
+		NumBlocks:  proto.Uint64(num),
+	}}
+}
+
+func (d *deltaScanner) move(oldStart, newStart, numBlocks uint64) {
+	d.operations = append(d.operations, &metadata.InstallOperation{
+		Type:       metadata.InstallOperation_MOVE.Enum(),
+		SrcExtents: extent(oldStart, numBlocks),
+		DstExtents: extent(newStart, numBlocks),
+	})
+}
+
+func (d *deltaScanner) diff(startBlock uint64, data []byte) error {
+	numBlocks := uint64(len(data)) / BlockSize
+
+	// Try bzip2 compressing the data, hopefully it will shrink!
+	opType := metadata.InstallOperation_REPLACE_BZ
+	opData, err := Bzip2(data)
+	if err != nil {
+		return err
+	}
+	if len(opData) >= len(data) {
+		opType = metadata.InstallOperation_REPLACE
+		opData = data
+	}
+
+	// Patching the old blocks at the same location may be even better.
+	var srcBlocks uint64
+	if startBlock < d.oldBlocks {
+		srcBlocks = d.oldBlocks - startBlock
+		if srcBlocks > numBlocks {
+			srcBlocks = numBlocks
+		}
+	}
+	if srcBlocks > 0 {
+		old := make([]byte, srcBlocks*BlockSize)
+		if _, err := d.old.ReadAt(old, int64(startBlock*BlockSize)); err != nil {
+			return err
+		}
+		patch, err := Bsdiff(old, data)
+		if err != nil {
+			return err
+		}
+		if len(patch) < len(opData) {
+			opType = metadata.InstallOperation_BSDIFF
+			opData = patch
+		}
+	}
+
+	if _, err := d.payload.Write(opData); err != nil {
+		return err
+	}
+
+	// Operation.DataOffset is filled in by Generator.updateOffsets
+	sum := sha256.Sum256(opData)
+	op := &metadata.InstallOperation{
+		Type:           opType.Enum(),
+		DstExtents:     extent(startBlock, numBlocks),
+		DataLength:     proto.Uint32(uint32(len(opData))),
+		DataSha256Hash: sum[:],
+	}
+	if opType == metadata.InstallOperation_BSDIFF {
+		op.SrcExtents = extent(startBlock, srcBlocks)
+		op.SrcLength = proto.Uint64(srcBlocks * BlockSize)
+		op.DstLength = proto.Uint64(uint64(len(data)))
+	}
+
+	d.operations = append(d.operations, op)
+
+	return nil
+}
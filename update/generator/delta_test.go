@@ -0,0 +1,179 @@
+// Copyright The Mantle Authors.
+// SPDX-License-Identifier: Apache-2.0
+
+package generator
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/flatcar/mantle/system"
+	"github.com/flatcar/mantle/system/exec"
+	"github.com/flatcar/mantle/update"
+	"github.com/flatcar/mantle/update/metadata"
+)
+
+func writeTemp(t *testing.T, data []byte) string {
+	f, err := ioutil.TempFile("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if _, err := f.Write(data); err != nil {
+		os.Remove(f.Name())
+		t.Fatal(err)
+	}
+
+	return f.Name()
+}
+
+func checkDeltaProc(t *testing.T, old, new []byte) *Procedure {
+	oldPath := writeTemp(t, old)
+	defer os.Remove(oldPath)
+	newPath := writeTemp(t, new)
+	defer os.Remove(newPath)
+
+	proc, err := DeltaUpdate(oldPath, newPath)
+	if system.IsOpNotSupported(err) {
+		t.Skip("O_TMPFILE not supported")
+	} else if exec.IsCmdNotFound(err) {
+		t.Skip(err)
+	} else if err != nil {
+		t.Fatal(err)
+	}
+
+	if proc.OldInfo.GetSize() != uint64(len(old)) {
+		t.Errorf("expected %d old bytes, got %d", len(old), proc.OldInfo.GetSize())
+	}
+
+	if proc.NewInfo.GetSize() != uint64(len(new)) {
+		t.Errorf("expected %d new bytes, got %d", len(new), proc.NewInfo.GetSize())
+	}
+
+	return proc
+}
+
+func countOps(ops []*metadata.InstallOperation) map[metadata.InstallOperation_Type]int {
+	counts := make(map[metadata.InstallOperation_Type]int)
+	for _, op := range ops {
+		counts[op.GetType()]++
+	}
+	return counts
+}
+
+// applyDelta writes a payload containing proc and applies it to old.
+func applyDelta(t *testing.T, proc *Procedure, old []byte) []byte {
+	g := testGenerator{t: t}
+	defer g.Destroy()
+
+	if err := g.Partition(proc); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := ioutil.TempFile("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	defer os.Remove(f.Name())
+
+	if err := g.Write(f.Name()); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := f.Seek(0, os.SEEK_SET); err != nil {
+		t.Fatal(err)
+	}
+
+	src := writeTemp(t, old)
+	defer os.Remove(src)
+
+	out, err := ioutil.TempFile("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	defer os.Remove(out.Name())
+
+	updater := update.Updater{
+		SrcPartition: src,
+		DstPartition: out.Name(),
+	}
+
+	if err := updater.UsePayload(f); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := updater.Update(); err != nil {
+		t.Fatal(err)
+	}
+
+	written, err := ioutil.ReadAll(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return written
+}
+
+func TestDeltaUpdateUnchanged(t *testing.T) {
+	old := append(append([]byte{}, testRand...), testOnes...)
+	proc := checkDeltaProc(t, old, old)
+
+	if counts := countOps(proc.Operations); counts[metadata.InstallOperation_MOVE] != 1 || len(proc.Operations) != 1 {
+		t.Errorf("unexpected operations: %v", proc.Operations)
+	}
+
+	if !bytes.Equal(applyDelta(t, proc, old), old) {
+		t.Errorf("Updater did not replicate the unchanged data")
+	}
+}
+
+func TestDeltaUpdateMoved(t *testing.T) {
+	old := append(append([]byte{}, testRand...), testOnes...)
+	new := append(append([]byte{}, testOnes...), testRand...)
+	proc := checkDeltaProc(t, old, new)
+
+	if counts := countOps(proc.Operations); counts[metadata.InstallOperation_MOVE] != 2 || len(proc.Operations) != 2 {
+		t.Errorf("unexpected operations: %v", proc.Operations)
+	}
+
+	if !bytes.Equal(applyDelta(t, proc, old), new) {
+		t.Errorf("Updater did not replicate the moved blocks")
+	}
+}
+
+func TestDeltaUpdateChanged(t *testing.T) {
+	old := append(append([]byte{}, testRand...), testOnes...)
+	new := append([]byte{}, old...)
+	copy(new[100:], "some changed bytes")
+	new = append(new, testOnes...)
+	new[len(new)-1] = 0
+	proc := checkDeltaProc(t, old, new)
+
+	counts := countOps(proc.Operations)
+	if counts[metadata.InstallOperation_BSDIFF] != 1 {
+		t.Errorf("expected the changed block to be diffed: %v", proc.Operations)
+	}
+	if counts[metadata.InstallOperation_MOVE] != 1 {
+		t.Errorf("expected the unchanged block to be moved: %v", proc.Operations)
+	}
+
+	if !bytes.Equal(applyDelta(t, proc, old), new) {
+		t.Errorf("Updater did not replicate the changed blocks")
+	}
+}
+
+func TestDeltaUpdateUnaligned(t *testing.T) {
+	oldPath := writeTemp(t, testOnes)
+	defer os.Remove(oldPath)
+	newPath := writeTemp(t, testUnaligned)
+	defer os.Remove(newPath)
+
+	if _, err := DeltaUpdate(oldPath, newPath); err == nil {
+		t.Errorf("unaligned file accepted")
+	}
+}
@@ -19,11 +19,13 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
+	"runtime"
+	"sync"
 
 	"github.com/golang/protobuf/proto"
 
-	"github.com/flatcar/mantle/system"
 	"github.com/flatcar/mantle/update/metadata"
 )
 
@@ -31,9 +33,44 @@ var (
 	errShortRead = errors.New("read an incomplete block")
 )
 
+// UpdateOptions control how the data of an update is generated.
+type UpdateOptions struct {
+	// Workers is the number of chunks compressed concurrently, the
+	// number of CPUs if zero.
+	Workers int
+
+	// XZ allows REPLACE_XZ operations when they are smaller than
+	// REPLACE_BZ, Zero uses ZERO operations for all-zero blocks instead
+	// of including them in the payload. Older versions of update_engine
+	// don't support these operations.
+	XZ   bool
+	Zero bool
+}
+
 // FullUpdate generates an update Procedure for the given file, embedding its
 // entire contents in the payload so it does not depend any previous state.
 func FullUpdate(path string) (*Procedure, error) {
+	return FullUpdateWithOptions(path, UpdateOptions{})
+}
+
+// FullUpdateWithOptions is FullUpdate with control over the operations
+// used to encode the file.
+func FullUpdateWithOptions(path string, opts UpdateOptions) (*Procedure, error) {
+	return fullUpdate(path, false, opts)
+}
+
+// KernelUpdate generates a full update Procedure for the given kernel
+// image. Unlike partitions a kernel doesn't need to be a multiple of the
+// block size, the last extent is only written up to the kernel's size.
+func KernelUpdate(path string) (*Procedure, error) {
+	return fullUpdate(path, true, UpdateOptions{})
+}
+
+func fullUpdate(path string, partial bool, opts UpdateOptions) (*Procedure, error) {
+	if opts.Workers == 0 {
+		opts.Workers = runtime.NumCPU()
+	}
+
 	source, err := os.Open(path)
 	if err != nil {
 		return nil, err
@@ -45,40 +82,122 @@ func FullUpdate(path string) (*Procedure, error) {
 		return nil, err
 	}
 
-	payload, err := system.PrivateFile("")
+	// The manifest preceding the data in the payload needs the size of
+	// every operation, so the data is encoded twice: here only to create
+	// the operations, and again while Generator.Write reads it, streaming
+	// it directly into the payload.
+	operations, err := encodeFull(source, ioutil.Discard, partial, opts)
 	if err != nil {
-		return nil, err
-	}
-
-	scanner := fullScanner{payload: payload, source: source}
-	for err == nil {
-		err = scanner.Scan()
-	}
-	if err != nil && err != io.EOF {
-		payload.Close()
 		if err == errShortRead {
 			err = fmt.Errorf("%s: %v", path, err)
 		}
 		return nil, err
 	}
 
-	if _, err := payload.Seek(0, os.SEEK_SET); err != nil {
-		payload.Close()
-		return nil, err
-	}
-
 	return &Procedure{
 		InstallProcedure: metadata.InstallProcedure{
 			NewInfo:    info,
-			Operations: scanner.operations,
+			Operations: operations,
+		},
+		ReadCloser: &fullData{
+			path:       path,
+			partial:    partial,
+			opts:       opts,
+			operations: cloneOperations(operations),
 		},
-		ReadCloser: payload,
 	}, nil
 }
 
+// cloneOperations copies operations, e.g. to keep them as they were
+// encoded when Generator.Write sets their data offsets.
+func cloneOperations(operations []*metadata.InstallOperation) []*metadata.InstallOperation {
+	clones := make([]*metadata.InstallOperation, len(operations))
+	for i, op := range operations {
+		clones[i] = proto.Clone(op).(*metadata.InstallOperation)
+	}
+	return clones
+}
+
+// encodeFull writes the data of all operations for source to payload.
+func encodeFull(source io.Reader, payload io.Writer, partial bool, opts UpdateOptions) ([]*metadata.InstallOperation, error) {
+	scanner := fullScanner{
+		payload: payload,
+		source:  source,
+		partial: partial,
+		opts:    opts,
+	}
+	var err error
+	for err == nil {
+		err = scanner.Scan()
+	}
+	if err != io.EOF {
+		return nil, err
+	}
+	return scanner.operations, nil
+}
+
+// fullData is the data of a full update, encoded again while it is read.
+// It fails if the file no longer matches the operations.
+type fullData struct {
+	path       string
+	partial    bool
+	opts       UpdateOptions
+	operations []*metadata.InstallOperation
+
+	once sync.Once
+	r    *io.PipeReader
+}
+
+func (d *fullData) Read(p []byte) (int, error) {
+	d.once.Do(func() {
+		r, w := io.Pipe()
+		d.r = r
+		go func() {
+			w.CloseWithError(d.encode(w))
+		}()
+	})
+	return d.r.Read(p)
+}
+
+// Close stops encoding the data if it is being read.
+func (d *fullData) Close() error {
+	d.once.Do(func() {
+		d.r, _ = io.Pipe()
+	})
+	return d.r.Close()
+}
+
+func (d *fullData) encode(w io.Writer) error {
+	source, err := os.Open(d.path)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	operations, err := encodeFull(source, w, d.partial, d.opts)
+	if err == errShortRead {
+		err = fmt.Errorf("%s: %v", d.path, err)
+	}
+	if err != nil {
+		return err
+	}
+
+	if len(operations) != len(d.operations) {
+		return fmt.Errorf("%s changed while generating the payload", d.path)
+	}
+	for i, op := range operations {
+		if !proto.Equal(op, d.operations[i]) {
+			return fmt.Errorf("%s changed while generating the payload", d.path)
+		}
+	}
+	return nil
+}
+
 type fullScanner struct {
 	payload    io.Writer
 	source     io.Reader
+	partial    bool // allow a partial last block
+	opts       UpdateOptions
 	offset     uint64
 	operations []*metadata.InstallOperation
 }
@@ -92,49 +211,167 @@ func (f *fullScanner) readChunk() ([]byte, error) {
 	return chunk[:n], err
 }
 
+// encodedChunk holds the operations for a chunk and their data, in the
+// same order.
+type encodedChunk struct {
+	operations []*metadata.InstallOperation
+	data       [][]byte
+	err        error
+}
+
+// Scan reads up to one chunk per worker, encodes the chunks concurrently
+// and writes their operations in order.
 func (f *fullScanner) Scan() error {
-	chunk, err := f.readChunk()
-	if err != nil {
-		return err
+	workers := f.opts.Workers
+	if workers < 1 {
+		workers = 1
+	}
+
+	var chunks [][]byte
+	var readErr error
+	for len(chunks) < workers {
+		chunk, err := f.readChunk()
+		if err != nil {
+			readErr = err
+			break
+		}
+		chunks = append(chunks, chunk)
+		if len(chunk)%BlockSize != 0 {
+			if !f.partial {
+				readErr = errShortRead
+			}
+			// a partial chunk can only be the last one
+			break
+		}
+	}
+	if len(chunks) == 0 || readErr == errShortRead {
+		return readErr
+	}
+
+	encoded := make([]encodedChunk, len(chunks))
+	var wg sync.WaitGroup
+	startBlock := f.offset / BlockSize
+	for i, chunk := range chunks {
+		wg.Add(1)
+		go func(i int, chunk []byte, startBlock uint64) {
+			defer wg.Done()
+			encoded[i] = f.encodeChunk(chunk, startBlock)
+		}(i, chunk, startBlock)
+		startBlock += uint64(len(chunk)) / BlockSize
+	}
+	wg.Wait()
+
+	for i, e := range encoded {
+		if e.err != nil {
+			return e.err
+		}
+		for _, data := range e.data {
+			if _, err := f.payload.Write(data); err != nil {
+				return err
+			}
+		}
+		f.operations = append(f.operations, e.operations...)
+		f.offset += uint64(len(chunks[i]))
+	}
+
+	if readErr == io.EOF {
+		readErr = nil
+	}
+	return readErr
+}
+
+// encodeChunk creates the operations for a chunk starting at startBlock.
+// All-zero blocks become ZERO operations if enabled, other blocks are
+// compressed if that makes them smaller.
+func (f *fullScanner) encodeChunk(chunk []byte, startBlock uint64) encodedChunk {
+	var e encodedChunk
+	numBlocks := (uint64(len(chunk)) + BlockSize - 1) / BlockSize
+	blockEnd := func(i uint64) uint64 {
+		return minUint64(uint64(len(chunk)), i*BlockSize)
 	}
-	if len(chunk)%BlockSize != 0 {
-		return errShortRead
+
+	zero := make([]bool, numBlocks)
+	if f.opts.Zero {
+		for i := range zero {
+			block := chunk[uint64(i)*BlockSize : blockEnd(uint64(i)+1)]
+			zero[i] = len(block) == BlockSize && isZero(block)
+		}
 	}
 
-	startBlock := uint64(f.offset) / BlockSize
-	numBlocks := uint64(len(chunk)) / BlockSize
-	f.offset += uint64(len(chunk))
+	for runStart := uint64(0); runStart < numBlocks; {
+		runEnd := runStart + 1
+		for runEnd < numBlocks && zero[runEnd] == zero[runStart] {
+			runEnd++
+		}
 
+		if zero[runStart] {
+			e.operations = append(e.operations, &metadata.InstallOperation{
+				Type:       metadata.InstallOperation_ZERO.Enum(),
+				DstExtents: extent(startBlock+runStart, runEnd-runStart),
+			})
+		} else {
+			op, opData, err := f.encodeData(chunk[runStart*BlockSize : blockEnd(runEnd)])
+			if err != nil {
+				e.err = err
+				return e
+			}
+			op.DstExtents = extent(startBlock+runStart, runEnd-runStart)
+			e.operations = append(e.operations, op)
+			e.data = append(e.data, opData)
+		}
+		runStart = runEnd
+	}
+
+	return e
+}
+
+// encodeData returns the smallest replace operation for data.
+func (f *fullScanner) encodeData(data []byte) (*metadata.InstallOperation, []byte, error) {
 	// Try bzip2 compressing the data, hopefully it will shrink!
 	opType := metadata.InstallOperation_REPLACE_BZ
-	opData, err := Bzip2(chunk)
+	opData, err := Bzip2(data)
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
 
-	if len(opData) >= len(chunk) {
-		// That was disappointing, use the uncompressed data instead.
-		opType = metadata.InstallOperation_REPLACE
-		opData = chunk
+	if f.opts.XZ {
+		xzData, err := Xz(data)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(xzData) < len(opData) {
+			opType = metadata.InstallOperation_REPLACE_XZ
+			opData = xzData
+		}
 	}
 
-	if _, err := f.payload.Write(opData); err != nil {
-		return err
+	if len(opData) >= len(data) {
+		// That was disappointing, use the uncompressed data instead.
+		opType = metadata.InstallOperation_REPLACE
+		opData = data
 	}
 
 	// Operation.DataOffset is filled in by Generator.updateOffsets
 	sum := sha256.Sum256(opData)
-	op := &metadata.InstallOperation{
-		Type: opType.Enum(),
-		DstExtents: []*metadata.Extent{&metadata.Extent{
-			StartBlock: proto.Uint64(startBlock),
-			NumBlocks:  proto.Uint64(numBlocks),
-		}},
+	return &metadata.InstallOperation{
+		Type:           opType.Enum(),
 		DataLength:     proto.Uint32(uint32(len(opData))),
 		DataSha256Hash: sum[:],
-	}
+	}, opData, nil
+}
 
-	f.operations = append(f.operations, op)
+func isZero(data []byte) bool {
+	for _, b := range data {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
 
-	return nil
+func minUint64(a, b uint64) uint64 {
+	if a < b {
+		return a
+	}
+	return b
 }
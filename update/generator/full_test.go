@@ -21,7 +21,6 @@ import (
 	"os"
 	"testing"
 
-	"github.com/flatcar/mantle/system"
 	"github.com/flatcar/mantle/system/exec"
 	"github.com/flatcar/mantle/update/metadata"
 )
@@ -160,16 +159,15 @@ func checkFullProc(t *testing.T, source, sourceHash []byte) *Procedure {
 		t.Fatal(err)
 	}
 	defer f.Close()
-	defer os.Remove(f.Name())
+	// the data is read from the file when the procedure is read
+	t.Cleanup(func() { os.Remove(f.Name()) })
 
 	if _, err := f.Write(source); err != nil {
 		t.Fatal(err)
 	}
 
 	proc, err := FullUpdate(f.Name())
-	if system.IsOpNotSupported(err) {
-		t.Skip("O_TMPFILE not supported")
-	} else if exec.IsCmdNotFound(err) {
+	if exec.IsCmdNotFound(err) {
 		t.Skip(err)
 	} else if err != nil {
 		t.Fatal(err)
@@ -209,3 +207,114 @@ func TestFullUpdateRand(t *testing.T) {
 
 	checkReplace(t, proc.Operations, testRand, testRandHash, payload)
 }
+
+func TestKernelUpdateScanUnaligned(t *testing.T) {
+	var payload bytes.Buffer
+	scanner := fullScanner{
+		payload: &payload,
+		source:  bytes.NewReader(testUnaligned),
+		partial: true,
+	}
+
+	if err := scanner.Scan(); err != nil {
+		if exec.IsCmdNotFound(err) {
+			t.Skip(err)
+		}
+
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	if scanner.offset != uint64(len(testUnaligned)) {
+		t.Errorf("expected %d bytes, got %d", len(testUnaligned), scanner.offset)
+	}
+
+	if len(scanner.operations) != 1 {
+		t.Fatalf("unexpected operations: %v", scanner.operations)
+	}
+
+	ext := scanner.operations[0].DstExtents[0]
+	if ext.GetStartBlock() != 0 || ext.GetNumBlocks() != 2 {
+		t.Errorf("unexpected extent: %v", ext)
+	}
+}
+
+func TestFullUpdateOptions(t *testing.T) {
+	// a few chunks of compressible, random and zero blocks
+	var source []byte
+	for len(source) < 3*ChunkSize {
+		source = append(source, testOnes...)
+		source = append(source, testRand...)
+		source = append(source, make([]byte, 3*BlockSize)...)
+	}
+	sourcePath := writeTemp(t, source)
+	defer os.Remove(sourcePath)
+
+	proc := func(workers int) *Procedure {
+		proc, err := FullUpdateWithOptions(sourcePath, UpdateOptions{
+			Workers: workers,
+			XZ:      true,
+			Zero:    true,
+		})
+		if exec.IsCmdNotFound(err) {
+			t.Skip(err)
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		return proc
+	}
+	read := func(proc *Procedure) []byte {
+		defer proc.Close()
+		payload, err := ioutil.ReadAll(proc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return payload
+	}
+
+	serial := proc(1)
+	serialPayload := read(serial)
+	parallel := proc(4)
+	parallelPayload := read(parallel)
+
+	if !bytes.Equal(serialPayload, parallelPayload) || len(serial.Operations) != len(parallel.Operations) {
+		t.Fatal("output depends on the number of workers")
+	}
+	for i := range serial.Operations {
+		if serial.Operations[i].String() != parallel.Operations[i].String() {
+			t.Fatalf("operation %d depends on the number of workers", i)
+		}
+	}
+
+	counts := countOps(parallel.Operations)
+	if counts[metadata.InstallOperation_ZERO] == 0 {
+		t.Errorf("zero blocks not encoded as ZERO: %v", counts)
+	}
+	if counts[metadata.InstallOperation_REPLACE_XZ]+counts[metadata.InstallOperation_REPLACE_BZ] == 0 {
+		t.Errorf("no compressed operations: %v", counts)
+	}
+
+	if !bytes.Equal(applyDelta(t, proc(4), nil), source) {
+		t.Errorf("Updater did not replicate the source")
+	}
+}
+
+func TestFullUpdateChanged(t *testing.T) {
+	sourcePath := writeTemp(t, testOnes)
+	defer os.Remove(sourcePath)
+
+	proc, err := FullUpdate(sourcePath)
+	if exec.IsCmdNotFound(err) {
+		t.Skip(err)
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	defer proc.Close()
+
+	// the data is encoded again when read
+	if err := ioutil.WriteFile(sourcePath, testRand, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadAll(proc); err == nil {
+		t.Errorf("read the data of a changed file")
+	}
+}
@@ -17,6 +17,7 @@ package generator
 import (
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
 	"os"
 
@@ -42,14 +43,25 @@ var (
 	// ErrProcedureExists indicates that a given procedure type has
 	// already been added to the Generator.
 	ErrProcedureExists = errors.New("generator: procedure already exists")
+
+	// ErrPartitionMissing indicates that a procedure was added to the
+	// Generator before the /usr partition.
+	ErrPartitionMissing = errors.New("generator: partition procedure must be added first")
 )
 
 // Generator assembles an update payload from a number of sources. Each of
-// its methods must only be called once, ending with Write.
+// its methods must only be called once, ending with Write. Identical
+// procedures are written to identical payloads.
 type Generator struct {
 	destructor.MultiDestructor
-	manifest metadata.DeltaArchiveManifest
-	payloads []io.Reader
+	manifest  metadata.DeltaArchiveManifest
+	payloads  []io.Reader
+	partition bool
+
+	// Signers sign the payload, if empty the developer key is used.
+	// The payload is only reproducible if the signatures are, like the
+	// RSA PKCS #1 v1.5 signatures of key signers.
+	Signers []signature.Signer
 }
 
 // Procedure represent independent update within a payload.
@@ -70,6 +82,36 @@ func (g *Generator) Partition(proc *Procedure) error {
 	g.manifest.OldPartitionInfo = proc.OldInfo
 	g.manifest.NewPartitionInfo = proc.NewInfo
 	g.payloads = append(g.payloads, proc)
+	g.partition = true
+	return nil
+}
+
+// Kernel adds the given kernel update Procedure to the payload.
+// It must be added after the /usr partition.
+func (g *Generator) Kernel(proc *Procedure) error {
+	proc.Type = metadata.InstallProcedure_KERNEL.Enum()
+	return g.Procedure(proc)
+}
+
+// Procedure adds an additional update Procedure of the type set in the
+// procedure to the payload, e.g. for other files than the kernel. Each
+// type may only be added once, after the /usr partition.
+func (g *Generator) Procedure(proc *Procedure) error {
+	if !g.partition {
+		return ErrPartitionMissing
+	}
+	if proc.Type == nil {
+		return fmt.Errorf("generator: procedure type missing")
+	}
+	for _, existing := range g.manifest.Procedures {
+		if existing.GetType() == proc.GetType() {
+			return ErrProcedureExists
+		}
+	}
+
+	g.AddCloser(proc)
+	g.manifest.Procedures = append(g.manifest.Procedures, &proc.InstallProcedure)
+	g.payloads = append(g.payloads, proc)
 	return nil
 }
 
@@ -95,11 +137,16 @@ func (g *Generator) Write(path string) (err error) {
 	hasher := signature.NewSignatureHash()
 	w := io.MultiWriter(f, hasher)
 
-	if err = g.writeHeader(w); err != nil {
+	manifest, err := g.marshalManifest()
+	if err != nil {
+		return
+	}
+
+	if err = g.writeHeader(w, len(manifest)); err != nil {
 		return
 	}
 
-	if err = g.writeManifest(w); err != nil {
+	if _, err = w.Write(manifest); err != nil {
 		return
 	}
 
@@ -132,14 +179,13 @@ func (g *Generator) updateOffsets() error {
 		updateOps(proc.Operations)
 	}
 
-	sigSize, err := signature.SignaturesSize()
+	sigSize, err := signature.SignaturesSize(g.Signers...)
 	g.manifest.SignaturesOffset = proto.Uint64(uint64(offset))
 	g.manifest.SignaturesSize = proto.Uint64(uint64(sigSize))
 	return err
 }
 
-func (g *Generator) writeHeader(w io.Writer) error {
-	manifestSize := proto.Size(&g.manifest)
+func (g *Generator) writeHeader(w io.Writer, manifestSize int) error {
 	header := metadata.DeltaArchiveHeader{
 		Version:      metadata.Version,
 		ManifestSize: uint64(manifestSize),
@@ -149,23 +195,28 @@ func (g *Generator) writeHeader(w io.Writer) error {
 	return binary.Write(w, binary.BigEndian, &header)
 }
 
-func (g *Generator) writeManifest(w io.Writer) error {
-	buf, err := proto.Marshal(&g.manifest)
-	if err != nil {
-		return err
-	}
+func (g *Generator) marshalManifest() ([]byte, error) {
+	return marshalDeterministic(&g.manifest)
+}
 
-	_, err = w.Write(buf)
-	return err
+// marshalDeterministic encodes messages the same way every time, so
+// that identical inputs produce identical payloads.
+func marshalDeterministic(m proto.Message) ([]byte, error) {
+	var buf proto.Buffer
+	buf.SetDeterministic(true)
+	if err := buf.Marshal(m); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
 }
 
 func (g *Generator) writeSignatures(w io.Writer, sum []byte) error {
-	signatures, err := signature.Sign(sum)
+	signatures, err := signature.Sign(sum, g.Signers...)
 	if err != nil {
 		return err
 	}
 
-	buf, err := proto.Marshal(signatures)
+	buf, err := marshalDeterministic(signatures)
 	if err != nil {
 		return err
 	}
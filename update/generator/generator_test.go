@@ -18,10 +18,12 @@ import (
 	"bytes"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/golang/protobuf/proto"
 
+	"github.com/flatcar/mantle/system/exec"
 	"github.com/flatcar/mantle/update"
 	"github.com/flatcar/mantle/update/metadata"
 )
@@ -136,3 +138,195 @@ func TestGenerateOneBlockPartition(t *testing.T) {
 		t.Errorf("Updater did not replicate source block")
 	}
 }
+
+func TestGenerateKernelWithoutPartition(t *testing.T) {
+	g := testGenerator{t: t}
+	defer g.Destroy()
+
+	proc := Procedure{ReadCloser: ioutil.NopCloser(&bytes.Buffer{})}
+	if err := g.Kernel(&proc); err != ErrPartitionMissing {
+		t.Errorf("expected ErrPartitionMissing, got %v", err)
+	}
+}
+
+func TestGenerateKernel(t *testing.T) {
+	g := testGenerator{t: t}
+	defer g.Destroy()
+
+	usr := checkFullProc(t, testOnes, testOnesHash)
+	if err := g.Partition(usr); err != nil {
+		t.Fatal(err)
+	}
+
+	kernelPath := writeTemp(t, testUnaligned)
+	defer os.Remove(kernelPath)
+	kernel, err := KernelUpdate(kernelPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := g.Kernel(kernel); err != nil {
+		t.Fatal(err)
+	}
+
+	again := Procedure{ReadCloser: ioutil.NopCloser(&bytes.Buffer{})}
+	if err := g.Kernel(&again); err != ErrProcedureExists {
+		t.Errorf("expected ErrProcedureExists, got %v", err)
+	}
+
+	f, err := ioutil.TempFile("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	defer os.Remove(f.Name())
+
+	if err := g.Write(f.Name()); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := f.Seek(0, os.SEEK_SET); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	updater := update.Updater{
+		DstPartition: filepath.Join(dir, "usr"),
+		DstKernel:    filepath.Join(dir, "vmlinuz"),
+	}
+
+	if err := updater.UsePayload(f); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := updater.Update(); err != nil {
+		t.Fatal(err)
+	}
+
+	written, err := ioutil.ReadFile(updater.DstKernel)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(written, testUnaligned) {
+		t.Errorf("Updater did not replicate the kernel")
+	}
+}
+
+// writeTestPayload generates a payload with a full update of partition
+// and kernel, returning its path.
+func writeTestPayload(t *testing.T, partition, kernel []byte, workers int) string {
+	g := testGenerator{t: t}
+	defer g.Destroy()
+
+	partitionPath := writeTemp(t, partition)
+	defer os.Remove(partitionPath)
+	kernelPath := writeTemp(t, kernel)
+	defer os.Remove(kernelPath)
+
+	proc, err := FullUpdateWithOptions(partitionPath, UpdateOptions{Workers: workers, Zero: true})
+	if exec.IsCmdNotFound(err) {
+		t.Skip(err)
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	if err := g.Partition(proc); err != nil {
+		t.Fatal(err)
+	}
+	if proc, err = KernelUpdate(kernelPath); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.Kernel(proc); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := ioutil.TempFile("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if err := g.Write(f.Name()); err != nil {
+		os.Remove(f.Name())
+		t.Fatal(err)
+	}
+	return f.Name()
+}
+
+func diffTestPayloads(t *testing.T, a, b string) *update.PayloadDiff {
+	aFile, err := os.Open(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer aFile.Close()
+	bFile, err := os.Open(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bFile.Close()
+
+	aPayload, err := update.NewPayloadFrom(aFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bPayload, err := update.NewPayloadFrom(bFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	diff, err := update.DiffPayloads(aPayload, bPayload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return diff
+}
+
+func TestWriteReproducible(t *testing.T) {
+	var partition []byte
+	for len(partition) < 2*ChunkSize {
+		partition = append(partition, testRand...)
+		partition = append(partition, testOnes...)
+		partition = append(partition, make([]byte, BlockSize)...)
+	}
+	kernel := testUnaligned
+
+	first := writeTestPayload(t, partition, kernel, 1)
+	defer os.Remove(first)
+	second := writeTestPayload(t, partition, kernel, 3)
+	defer os.Remove(second)
+
+	firstData, err := ioutil.ReadFile(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secondData, err := ioutil.ReadFile(second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(firstData, secondData) {
+		t.Errorf("payloads of identical inputs differ")
+	}
+	if diff := diffTestPayloads(t, first, second); !diff.Equal() {
+		t.Errorf("diff of identical payloads: %+v", diff)
+	}
+
+	// change two blocks, a single byte each
+	changed := append([]byte{}, partition...)
+	changed[3*BlockSize] ^= 1
+	changed[4*BlockSize+7] ^= 1
+	third := writeTestPayload(t, changed, kernel, 1)
+	defer os.Remove(third)
+
+	diff := diffTestPayloads(t, first, third)
+	if diff.Equal() || len(diff.Differences) == 0 {
+		t.Fatalf("no differences found")
+	}
+	if len(diff.Blocks) != 2 {
+		t.Fatalf("expected block differences of 2 procedures, got %+v", diff.Blocks)
+	}
+	partitionDiff, kernelDiff := diff.Blocks[0], diff.Blocks[1]
+	if partitionDiff.Divergent != 2 || len(partitionDiff.Ranges) != 1 ||
+		partitionDiff.Ranges[0] != (update.ExtentInfo{StartBlock: 3, NumBlocks: 2}) {
+		t.Errorf("unexpected partition differences %+v", partitionDiff)
+	}
+	if kernelDiff.Divergent != 0 {
+		t.Errorf("unexpected kernel differences %+v", kernelDiff)
+	}
+}
@@ -0,0 +1,30 @@
+// Copyright The Mantle Authors.
+// SPDX-License-Identifier: Apache-2.0
+
+package generator
+
+import (
+	"bytes"
+
+	"github.com/ulikunitz/xz"
+)
+
+// Xz compresses an in-memory buffer for REPLACE_XZ operations. The
+// streams use CRC32 checks, which every xz decoder supports.
+func Xz(data []byte) ([]byte, error) {
+	buf := bytes.Buffer{}
+	zip, err := xz.WriterConfig{CheckSum: xz.CRC32}.NewWriter(&buf)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := zip.Write(data); err != nil {
+		return nil, err
+	}
+
+	if err := zip.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,143 @@
+// Copyright The Mantle Authors.
+// SPDX-License-Identifier: Apache-2.0
+
+package update
+
+import (
+	"encoding/hex"
+
+	"github.com/flatcar/mantle/update/metadata"
+)
+
+// PayloadInfo describes the contents of a payload, for displaying it
+// as text or JSON.
+type PayloadInfo struct {
+	Magic            string          `json:"magic"`
+	Version          uint64          `json:"version"`
+	ManifestSize     uint64          `json:"manifestSize"`
+	BlockSize        uint32          `json:"blockSize"`
+	SignaturesOffset uint64          `json:"signaturesOffset"`
+	SignaturesSize   uint64          `json:"signaturesSize"`
+	Procedures       []ProcedureInfo `json:"procedures"`
+	Signatures       []SignatureInfo `json:"signatures,omitempty"`
+	// Verified is set by Inspect, Error describes why it failed.
+	Verified bool   `json:"verified"`
+	Error    string `json:"error,omitempty"`
+}
+
+type ProcedureInfo struct {
+	Type       string          `json:"type"`
+	OldInfo    *ContentInfo    `json:"oldInfo,omitempty"`
+	NewInfo    *ContentInfo    `json:"newInfo,omitempty"`
+	Operations []OperationInfo `json:"operations"`
+}
+
+type ContentInfo struct {
+	Size   uint64 `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+type OperationInfo struct {
+	Type       string       `json:"type"`
+	DataOffset *uint32      `json:"dataOffset,omitempty"`
+	DataLength uint32       `json:"dataLength"`
+	DataSHA256 string       `json:"dataSha256,omitempty"`
+	SrcExtents []ExtentInfo `json:"srcExtents,omitempty"`
+	SrcLength  uint64       `json:"srcLength,omitempty"`
+	DstExtents []ExtentInfo `json:"dstExtents,omitempty"`
+	DstLength  uint64       `json:"dstLength,omitempty"`
+}
+
+type ExtentInfo struct {
+	StartBlock uint64 `json:"startBlock"`
+	NumBlocks  uint64 `json:"numBlocks"`
+}
+
+type SignatureInfo struct {
+	Version uint32 `json:"version"`
+	Size    int    `json:"size"`
+}
+
+// Info describes the header and manifest of the payload. Signatures are
+// only known once they have been read by VerifySignature or Verify.
+func (p *Payload) Info() *PayloadInfo {
+	info := &PayloadInfo{
+		Magic:            string(p.Header.Magic[:]),
+		Version:          p.Header.Version,
+		ManifestSize:     p.Header.ManifestSize,
+		BlockSize:        p.Manifest.GetBlockSize(),
+		SignaturesOffset: p.Manifest.GetSignaturesOffset(),
+		SignaturesSize:   p.Manifest.GetSignaturesSize(),
+	}
+
+	for _, proc := range p.Procedures() {
+		procInfo := ProcedureInfo{
+			Type:       procedureName(proc.GetType()),
+			OldInfo:    installInfo(proc.OldInfo),
+			NewInfo:    installInfo(proc.NewInfo),
+			Operations: []OperationInfo{},
+		}
+		for _, op := range proc.Operations {
+			procInfo.Operations = append(procInfo.Operations, OperationInfo{
+				Type:       op.GetType().String(),
+				DataOffset: op.DataOffset,
+				DataLength: op.GetDataLength(),
+				DataSHA256: hex.EncodeToString(op.DataSha256Hash),
+				SrcExtents: extentInfos(op.SrcExtents),
+				SrcLength:  op.GetSrcLength(),
+				DstExtents: extentInfos(op.DstExtents),
+				DstLength:  op.GetDstLength(),
+			})
+		}
+		info.Procedures = append(info.Procedures, procInfo)
+	}
+
+	for _, sig := range p.Signatures.Signatures {
+		info.Signatures = append(info.Signatures, SignatureInfo{
+			Version: sig.GetVersion(),
+			Size:    len(sig.Data),
+		})
+	}
+
+	return info
+}
+
+// Inspect reads the entire payload, checking it like Verify, and
+// returns its description including the result.
+func (p *Payload) Inspect() *PayloadInfo {
+	err := p.Verify()
+	info := p.Info()
+	info.Verified = err == nil
+	if err != nil {
+		info.Error = err.Error()
+	}
+	return info
+}
+
+func procedureName(t metadata.InstallProcedure_Type) string {
+	if t == installProcedure_partition {
+		return "PARTITION"
+	}
+	return t.String()
+}
+
+func installInfo(info *metadata.InstallInfo) *ContentInfo {
+	if info == nil {
+		return nil
+	}
+	return &ContentInfo{
+		Size:   info.GetSize(),
+		SHA256: hex.EncodeToString(info.Hash),
+	}
+}
+
+func extentInfos(extents []*metadata.Extent) []ExtentInfo {
+	var infos []ExtentInfo
+	for _, extent := range extents {
+		infos = append(infos, ExtentInfo{
+			StartBlock: extent.GetStartBlock(),
+			NumBlocks:  extent.GetNumBlocks(),
+		})
+	}
+	return infos
+}
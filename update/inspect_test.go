@@ -0,0 +1,210 @@
+// Copyright The Mantle Authors.
+// SPDX-License-Identifier: Apache-2.0
+
+package update_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/flatcar/mantle/update"
+	"github.com/flatcar/mantle/update/generator"
+	"github.com/flatcar/mantle/update/metadata"
+	"github.com/flatcar/mantle/update/signature"
+)
+
+// testPayload writes a payload of a three block partition and a short
+// kernel signed with key, returning its path and the partition and
+// kernel contents.
+func testPayload(t *testing.T, dir string, key *rsa.PrivateKey) (path string, usr, kernel []byte) {
+	usr = make([]byte, 3*generator.BlockSize)
+	if _, err := rand.Read(usr[:generator.BlockSize]); err != nil {
+		t.Fatal(err)
+	}
+	copy(usr[2*generator.BlockSize:], bytes.Repeat([]byte{1}, generator.BlockSize))
+	kernel = bytes.Repeat([]byte("kernel"), 100)
+
+	usrPath := filepath.Join(dir, "usr.bin")
+	kernelPath := filepath.Join(dir, "vmlinuz")
+	if err := ioutil.WriteFile(usrPath, usr, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(kernelPath, kernel, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	g := generator.Generator{
+		Signers: []signature.Signer{signature.NewKeySigner(key)},
+	}
+	defer g.Destroy()
+
+	usrProc, err := generator.FullUpdate(usrPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := g.Partition(usrProc); err != nil {
+		t.Fatal(err)
+	}
+	kernelProc, err := generator.KernelUpdate(kernelPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := g.Kernel(kernelProc); err != nil {
+		t.Fatal(err)
+	}
+
+	path = filepath.Join(dir, "update.gz")
+	if err := g.Write(path); err != nil {
+		t.Fatal(err)
+	}
+	return path, usr, kernel
+}
+
+func inspectPayload(t *testing.T, path string, verifiers ...signature.Verifier) *update.PayloadInfo {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	payload, err := update.NewPayloadFrom(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload.Verifiers = verifiers
+	return payload.Inspect()
+}
+
+func checkContentInfo(t *testing.T, name string, info *update.ContentInfo, data []byte) {
+	sum := sha256.Sum256(data)
+	if info == nil {
+		t.Errorf("%s: missing new info", name)
+	} else if info.Size != uint64(len(data)) || info.SHA256 != hex.EncodeToString(sum[:]) {
+		t.Errorf("%s: new info %+v doesn't describe the %d bytes written", name, info, len(data))
+	}
+}
+
+func TestInspect(t *testing.T) {
+	dir, err := ioutil.TempDir("", "update-inspect")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path, usr, kernel := testPayload(t, dir, key)
+	stat, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info := inspectPayload(t, path, signature.NewKeyVerifier("test key", &key.PublicKey))
+	if !info.Verified || info.Error != "" {
+		t.Errorf("payload not verified: %q", info.Error)
+	}
+
+	if info.Magic != metadata.Magic || info.Version != metadata.Version {
+		t.Errorf("unexpected header: magic %q, version %d", info.Magic, info.Version)
+	}
+	if info.BlockSize != generator.BlockSize {
+		t.Errorf("block size is %d, expected %d", info.BlockSize, generator.BlockSize)
+	}
+	// the signatures are at the end of the payload
+	headerSize := uint64(len(metadata.Magic) + 8 + 8)
+	end := headerSize + info.ManifestSize + info.SignaturesOffset + info.SignaturesSize
+	if end != uint64(stat.Size()) {
+		t.Errorf("signatures end at %d, the payload is %d bytes", end, stat.Size())
+	}
+	if len(info.Signatures) != 1 || info.Signatures[0].Size != key.Size() || info.Signatures[0].Version != 2 {
+		t.Errorf("expected one v2 signature of %d bytes, got %+v", key.Size(), info.Signatures)
+	}
+
+	if len(info.Procedures) != 2 {
+		t.Fatalf("expected 2 procedures, got %d", len(info.Procedures))
+	}
+	for i, c := range []struct {
+		typ  string
+		data []byte
+	}{
+		{"PARTITION", usr},
+		{"KERNEL", kernel},
+	} {
+		proc := info.Procedures[i]
+		if proc.Type != c.typ {
+			t.Errorf("procedure %d is %s, expected %s", i, proc.Type, c.typ)
+		}
+		if proc.OldInfo != nil {
+			t.Errorf("%s: full update with old info %+v", c.typ, proc.OldInfo)
+		}
+		checkContentInfo(t, c.typ, proc.NewInfo, c.data)
+
+		// the operations write every block once
+		var blocks uint64
+		for _, op := range proc.Operations {
+			if op.DataLength > 0 && (op.DataOffset == nil || op.DataSHA256 == "") {
+				t.Errorf("%s: %s operation without data offset or hash", c.typ, op.Type)
+			}
+			for _, extent := range op.DstExtents {
+				if extent.StartBlock != blocks {
+					t.Errorf("%s: extent starts at block %d, expected %d", c.typ, extent.StartBlock, blocks)
+				}
+				blocks += extent.NumBlocks
+			}
+		}
+		expected := (uint64(len(c.data)) + generator.BlockSize - 1) / generator.BlockSize
+		if blocks != expected {
+			t.Errorf("%s: operations write %d blocks, expected %d", c.typ, blocks, expected)
+		}
+	}
+}
+
+func TestInspectWrongKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "update-inspect")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path, _, _ := testPayload(t, dir, key)
+
+	for name, verifiers := range map[string][]signature.Verifier{
+		"other key":     {signature.NewKeyVerifier("other key", &other.PublicKey)},
+		"developer key": nil,
+	} {
+		info := inspectPayload(t, path, verifiers...)
+		if info.Verified || info.Error == "" {
+			t.Errorf("%s: payload verified", name)
+		}
+		// the rest is still described
+		if len(info.Procedures) != 2 || len(info.Signatures) != 1 {
+			t.Errorf("%s: expected 2 procedures and 1 signature, got %d and %d",
+				name, len(info.Procedures), len(info.Signatures))
+		}
+	}
+
+	// any of the verifiers may match
+	info := inspectPayload(t, path,
+		signature.NewKeyVerifier("other key", &other.PublicKey),
+		signature.NewKeyVerifier("test key", &key.PublicKey))
+	if !info.Verified {
+		t.Errorf("payload not verified by the second key: %q", info.Error)
+	}
+}
@@ -40,6 +40,9 @@ const (
 	InstallOperation_REPLACE_BZ InstallOperation_Type = 1
 	InstallOperation_MOVE       InstallOperation_Type = 2
 	InstallOperation_BSDIFF     InstallOperation_Type = 3
+	InstallOperation_ZERO       InstallOperation_Type = 6
+	InstallOperation_DISCARD    InstallOperation_Type = 7
+	InstallOperation_REPLACE_XZ InstallOperation_Type = 8
 )
 
 var InstallOperation_Type_name = map[int32]string{
@@ -47,12 +50,18 @@ var InstallOperation_Type_name = map[int32]string{
 	1: "REPLACE_BZ",
 	2: "MOVE",
 	3: "BSDIFF",
+	6: "ZERO",
+	7: "DISCARD",
+	8: "REPLACE_XZ",
 }
 var InstallOperation_Type_value = map[string]int32{
 	"REPLACE":    0,
 	"REPLACE_BZ": 1,
 	"MOVE":       2,
 	"BSDIFF":     3,
+	"ZERO":       6,
+	"DISCARD":    7,
+	"REPLACE_XZ": 8,
 }
 
 func (x InstallOperation_Type) Enum() *InstallOperation_Type {
@@ -486,40 +495,42 @@ func init() {
 }
 
 var fileDescriptor0 = []byte{
-	// 560 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x09, 0x6e, 0x88, 0x02, 0xff, 0xa4, 0x53, 0x5d, 0x6f, 0xd3, 0x30,
-	0x14, 0x5d, 0xdb, 0xd0, 0x76, 0x37, 0xdd, 0x1a, 0xcc, 0x80, 0xc0, 0x03, 0xaa, 0xc2, 0x4b, 0x41,
-	0x50, 0x41, 0x61, 0x93, 0x06, 0x48, 0xd0, 0xb1, 0x54, 0xaa, 0xd8, 0xd8, 0xb4, 0x21, 0x1e, 0x78,
-	0xb1, 0x42, 0xeb, 0x2e, 0x11, 0xa9, 0x1d, 0xc5, 0xee, 0x80, 0xfd, 0x09, 0x7e, 0x0a, 0x7f, 0x89,
-	0x9f, 0xc2, 0xb5, 0x9b, 0x26, 0xd3, 0xc4, 0x44, 0xa6, 0xbd, 0xf9, 0xeb, 0x9c, 0x7b, 0xcf, 0xb9,
-	0xc7, 0x70, 0x7b, 0x9e, 0x4c, 0x02, 0xc5, 0xe8, 0x8c, 0xa9, 0x00, 0x17, 0x41, 0x2f, 0x49, 0x85,
-	0x12, 0xe4, 0xce, 0x38, 0x4c, 0xc5, 0x8c, 0x09, 0x49, 0xb3, 0x7b, 0xc6, 0x4f, 0x22, 0xce, 0xbc,
-	0x3f, 0x55, 0x70, 0x46, 0x5c, 0xaa, 0x20, 0x8e, 0x0f, 0x12, 0x96, 0x06, 0x2a, 0x12, 0x9c, 0xbc,
-	0x06, 0x4b, 0xfd, 0x4c, 0x98, 0x5b, 0xe9, 0x54, 0xbb, 0xeb, 0xfd, 0xa7, 0xbd, 0x7f, 0x63, 0x7b,
-	0x17, 0x71, 0xbd, 0x4f, 0x08, 0x22, 0xb7, 0xc0, 0xd6, 0x75, 0xa9, 0x98, 0x4e, 0x25, 0x53, 0x6e,
-	0xb5, 0x53, 0xe9, 0xae, 0xe5, 0x87, 0x31, 0x42, 0x55, 0xe8, 0xd6, 0xcc, 0xe1, 0x0b, 0xb0, 0x65,
-	0x3a, 0xa6, 0xec, 0x87, 0x62, 0x5c, 0x49, 0xd7, 0xea, 0xd4, 0xba, 0x76, 0xff, 0xc1, 0x65, 0xd5,
-	0x7c, 0xf3, 0x8c, 0x10, 0x00, 0x0d, 0xca, 0x88, 0x6e, 0x20, 0x91, 0xa5, 0x89, 0x26, 0x52, 0xe5,
-	0x44, 0xf5, 0xb2, 0x44, 0x1a, 0x94, 0x11, 0x35, 0x0c, 0x91, 0x0b, 0x8e, 0x69, 0x53, 0x86, 0x41,
-	0x7f, 0x73, 0x8b, 0x86, 0x81, 0x0c, 0xdd, 0x26, 0xde, 0xb4, 0xbc, 0x6d, 0xb0, 0x8c, 0x3a, 0x1b,
-	0x1a, 0x47, 0xfe, 0xe1, 0xde, 0xe0, 0xbd, 0xef, 0xac, 0x90, 0x75, 0x80, 0x6c, 0x43, 0x77, 0xbe,
-	0x38, 0x15, 0xd2, 0x04, 0x6b, 0xff, 0xe0, 0xb3, 0xef, 0x54, 0x91, 0xbb, 0xbe, 0x73, 0xbc, 0x3b,
-	0x1a, 0x0e, 0x9d, 0x9a, 0xf7, 0x1c, 0xea, 0x59, 0x49, 0x74, 0x01, 0x1d, 0x4b, 0x15, 0xfd, 0x1a,
-	0x8b, 0xf1, 0x37, 0xb4, 0x57, 0xd7, 0xc4, 0xb7, 0x7c, 0x3e, 0x5b, 0x1c, 0x49, 0x63, 0x97, 0xe5,
-	0x9d, 0x01, 0x1c, 0x47, 0x27, 0x3c, 0x50, 0xf3, 0x94, 0x49, 0xf2, 0x0e, 0x25, 0xe7, 0x3b, 0x44,
-	0x69, 0x75, 0x4f, 0x2e, 0x53, 0x57, 0xe0, 0x8a, 0xe5, 0xfd, 0xc7, 0xb0, 0x9a, 0x6f, 0x48, 0x1b,
-	0x1a, 0xa7, 0x2c, 0x95, 0x38, 0x30, 0xd3, 0xc1, 0x1a, 0x69, 0x81, 0xa5, 0x55, 0x9b, 0xda, 0x2d,
-	0xef, 0x11, 0xd8, 0xd9, 0x60, 0x47, 0x7c, 0x2a, 0xf4, 0xa5, 0x8c, 0xce, 0x58, 0xd6, 0x2c, 0xee,
-	0x8c, 0x29, 0x8b, 0xa7, 0xbf, 0x8a, 0xf0, 0x1c, 0xa6, 0x62, 0xcc, 0x26, 0x9a, 0xfe, 0x6a, 0xe1,
-	0xc9, 0x71, 0x8b, 0xf0, 0xbc, 0x01, 0x10, 0xcb, 0x38, 0x69, 0x33, 0xb4, 0xd4, 0x6e, 0xd9, 0xfc,
-	0x91, 0x4d, 0x68, 0x8a, 0x78, 0x42, 0x23, 0xec, 0xdb, 0x44, 0xcc, 0xee, 0x3f, 0xfc, 0x0f, 0xd6,
-	0x48, 0x44, 0x18, 0x67, 0xdf, 0x17, 0x30, 0xab, 0x34, 0xcc, 0x23, 0x59, 0x24, 0x70, 0xd6, 0x1f,
-	0xfc, 0xa3, 0x8f, 0xfe, 0x9e, 0xb3, 0xe2, 0xfd, 0xae, 0xc1, 0xc6, 0x2e, 0x8b, 0x55, 0x30, 0x48,
-	0xc7, 0x61, 0x74, 0xca, 0xf6, 0x03, 0x1e, 0x4d, 0x99, 0x54, 0x64, 0x08, 0x1b, 0x09, 0x4e, 0x3e,
-	0xd2, 0x7d, 0xd2, 0x73, 0x12, 0x2b, 0x57, 0x94, 0x38, 0x80, 0x36, 0x17, 0x22, 0xa1, 0xd7, 0x70,
-	0xc9, 0x05, 0x30, 0x61, 0xa3, 0x66, 0xae, 0xe6, 0x2b, 0xbe, 0xb2, 0x5e, 0x3e, 0xdb, 0xde, 0x22,
-	0xf7, 0xe0, 0x66, 0x11, 0xb4, 0xe5, 0x07, 0xb6, 0xcc, 0xe0, 0xef, 0x42, 0xfb, 0xdc, 0x95, 0x41,
-	0x2e, 0xfe, 0xde, 0x5b, 0x20, 0xda, 0xf3, 0x42, 0x9c, 0xb1, 0xb1, 0x59, 0xde, 0x7d, 0x24, 0xd0,
-	0xee, 0x5f, 0x20, 0x58, 0x2d, 0x4f, 0x80, 0x99, 0x49, 0x96, 0x29, 0x92, 0x2e, 0x94, 0x72, 0x23,
-	0x8f, 0xdd, 0xdf, 0x00, 0x00, 0x00, 0xff, 0xff, 0x53, 0xd4, 0x06, 0x13, 0x30, 0x05, 0x00, 0x00,
+	// 584 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xa4, 0x93, 0xd1, 0x6e, 0xd3, 0x30,
+	0x14, 0x86, 0x97, 0x36, 0xb4, 0xd9, 0x49, 0xb7, 0x05, 0x6f, 0x40, 0xe0, 0x02, 0x55, 0xe1, 0x26,
+	0x20, 0xa8, 0xa0, 0xb0, 0x49, 0xc0, 0xa4, 0xd1, 0xad, 0x99, 0x54, 0xb1, 0xd1, 0xa9, 0x45, 0x08,
+	0xf5, 0xc6, 0x98, 0xd6, 0x6d, 0x22, 0x52, 0x3b, 0x8a, 0xdd, 0xc1, 0xf6, 0x02, 0x5c, 0xf2, 0x28,
+	0xbc, 0x22, 0xb2, 0x9b, 0xa6, 0xd5, 0xc4, 0x44, 0x26, 0xee, 0xe2, 0xe3, 0xfc, 0xbf, 0xcf, 0xf9,
+	0xfc, 0x1b, 0xee, 0xcc, 0x92, 0x11, 0x91, 0x14, 0x4f, 0xa9, 0x24, 0x23, 0x22, 0x49, 0x23, 0x49,
+	0xb9, 0xe4, 0xe8, 0xee, 0x30, 0x4c, 0xf9, 0x94, 0x72, 0x81, 0xb3, 0x7d, 0xca, 0x26, 0x11, 0xa3,
+	0xde, 0xcf, 0x32, 0x38, 0x1d, 0x26, 0x24, 0x89, 0xe3, 0x6e, 0x42, 0x53, 0x22, 0x23, 0xce, 0xd0,
+	0x5b, 0x30, 0xe5, 0x45, 0x42, 0x5d, 0xa3, 0x5e, 0xf2, 0x37, 0x9b, 0xcf, 0x1a, 0x7f, 0xd7, 0x36,
+	0xae, 0xea, 0x1a, 0x1f, 0x2f, 0x12, 0x8a, 0xb6, 0xc1, 0x56, 0xe7, 0x62, 0x3e, 0x1e, 0x0b, 0x2a,
+	0xdd, 0x52, 0xdd, 0xf0, 0x37, 0xf2, 0x62, 0x4c, 0xd9, 0x44, 0x86, 0x6e, 0x59, 0x17, 0x5f, 0x82,
+	0x2d, 0xd2, 0x21, 0xa6, 0x3f, 0x24, 0x65, 0x52, 0xb8, 0x66, 0xbd, 0xec, 0xdb, 0xcd, 0x87, 0xd7,
+	0x9d, 0x16, 0xe8, 0xdf, 0x10, 0x02, 0x50, 0xa2, 0xcc, 0xe8, 0x56, 0xdd, 0xf0, 0x4d, 0x65, 0x34,
+	0x12, 0x32, 0x37, 0xaa, 0x14, 0x35, 0x52, 0xa2, 0xcc, 0xa8, 0xaa, 0x8d, 0x5c, 0x70, 0x74, 0x9b,
+	0x22, 0x24, 0xcd, 0xdd, 0x3d, 0x1c, 0x12, 0x11, 0xba, 0x56, 0xdd, 0xf0, 0x6b, 0xde, 0x17, 0x30,
+	0xf5, 0x74, 0x36, 0x54, 0x7b, 0xc1, 0xd9, 0x49, 0xeb, 0x28, 0x70, 0xd6, 0xd0, 0x26, 0x40, 0xb6,
+	0xc0, 0x87, 0x03, 0xc7, 0x40, 0x16, 0x98, 0xa7, 0xdd, 0x4f, 0x81, 0x53, 0x42, 0x00, 0x95, 0xc3,
+	0x7e, 0xbb, 0x73, 0x7c, 0xec, 0x94, 0x55, 0x75, 0x10, 0xf4, 0xba, 0x4e, 0x45, 0x89, 0xdb, 0x9d,
+	0xfe, 0x51, 0xab, 0xd7, 0x76, 0xaa, 0xab, 0xe2, 0xcf, 0x03, 0xc7, 0xf2, 0x5e, 0x40, 0x25, 0xeb,
+	0x6c, 0x1b, 0x6c, 0x21, 0x49, 0x2a, 0xf1, 0xd7, 0x98, 0x0f, 0xbf, 0xb9, 0x86, 0x6e, 0x0d, 0x01,
+	0xb0, 0xd9, 0x74, 0x5e, 0x12, 0x9a, 0xaa, 0xe9, 0x5d, 0x02, 0xf4, 0xa3, 0x09, 0x23, 0x72, 0x96,
+	0x52, 0x81, 0xde, 0x01, 0x88, 0x7c, 0xe5, 0x1a, 0x1a, 0xc2, 0xd3, 0xeb, 0x20, 0x2c, 0x75, 0xcb,
+	0xcf, 0x07, 0x4f, 0x60, 0x3d, 0x5f, 0xa0, 0x2d, 0xa8, 0x9e, 0xd3, 0x54, 0x44, 0x9c, 0xe9, 0x0e,
+	0x36, 0x50, 0x0d, 0x4c, 0x05, 0x47, 0x9f, 0x5d, 0xf3, 0x1e, 0x83, 0x9d, 0xdd, 0x7f, 0x87, 0x8d,
+	0xb9, 0xda, 0x14, 0xd1, 0x25, 0xcd, 0x9a, 0xad, 0x81, 0xa9, 0xd9, 0xcd, 0x7f, 0xfd, 0x55, 0xca,
+	0x33, 0x76, 0x96, 0xf2, 0x21, 0x1d, 0x29, 0xfb, 0x9b, 0x65, 0x2c, 0xd7, 0xcd, 0x33, 0xb6, 0x0f,
+	0xc0, 0x17, 0xa9, 0x53, 0x30, 0xd4, 0xa8, 0x7e, 0xd1, 0x98, 0xa2, 0x5d, 0xb0, 0x78, 0x3c, 0xc2,
+	0x11, 0x1b, 0x73, 0x9d, 0x44, 0xbb, 0xf9, 0xe8, 0x1f, 0x5a, 0x3d, 0xe2, 0x2e, 0x58, 0x8c, 0x7e,
+	0x9f, 0xcb, 0xcc, 0xc2, 0x32, 0x0f, 0x65, 0xc9, 0x01, 0xa8, 0xbc, 0x0f, 0x7a, 0x1f, 0x82, 0x13,
+	0x67, 0xcd, 0xfb, 0x5d, 0x86, 0x9d, 0x36, 0x8d, 0x25, 0x69, 0xa5, 0xc3, 0x30, 0x3a, 0xa7, 0xa7,
+	0x84, 0x45, 0x63, 0x2a, 0x24, 0x3a, 0x86, 0x9d, 0x84, 0xa4, 0x32, 0x52, 0x7d, 0xe2, 0x95, 0x11,
+	0x8d, 0x1b, 0x8e, 0xd8, 0x82, 0x2d, 0xc6, 0x79, 0x82, 0xff, 0x83, 0x92, 0x0b, 0xa0, 0xc3, 0x86,
+	0xf5, 0xbd, 0xea, 0x17, 0xfb, 0xc6, 0x7c, 0xf5, 0xfc, 0xf5, 0x1e, 0xba, 0x0f, 0xb7, 0x97, 0x41,
+	0x5b, 0xbc, 0x73, 0x53, 0x5f, 0xfc, 0x3d, 0xd8, 0x5a, 0xd9, 0xd2, 0xca, 0xf9, 0x13, 0x3d, 0x00,
+	0xa4, 0x98, 0x2f, 0x87, 0xd3, 0x18, 0xad, 0xe2, 0xf4, 0x0f, 0x00, 0x29, 0xfa, 0x57, 0x0c, 0xd6,
+	0x8b, 0x1b, 0xec, 0x03, 0x24, 0x8b, 0x14, 0x09, 0x17, 0x0a, 0xd1, 0xc8, 0x63, 0xf7, 0x67, 0x00,
+	0x75, 0x4d, 0x48, 0x86, 0x57, 0x05, 0x00, 0x00,
 }
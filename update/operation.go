@@ -22,11 +22,19 @@ import (
 	"hash"
 	"io"
 	"io/ioutil"
+	"math"
 	"os"
 
+	"github.com/ulikunitz/xz"
+
+	"github.com/flatcar/mantle/update/bsdiff"
 	"github.com/flatcar/mantle/update/metadata"
 )
 
+// sparseHole is the start block of extents which aren't backed by data,
+// reading them yields zeros and writes to them are discarded.
+const sparseHole = math.MaxUint64
+
 type Operation struct {
 	hash.Hash
 	io.LimitedReader
@@ -55,6 +63,8 @@ func (op *Operation) Verify() error {
 	case metadata.InstallOperation_REPLACE:
 		fallthrough
 	case metadata.InstallOperation_REPLACE_BZ:
+		fallthrough
+	case metadata.InstallOperation_REPLACE_XZ:
 		if err := op.verifyOffset(); err != nil {
 			return err
 		}
@@ -68,18 +78,81 @@ func (op *Operation) Verify() error {
 			return err
 		}
 	case metadata.InstallOperation_MOVE:
-		return fmt.Errorf("MOVE")
+		if err := op.verifyMove(); err != nil {
+			return err
+		}
+	case metadata.InstallOperation_ZERO:
+		fallthrough
+	case metadata.InstallOperation_DISCARD:
+		if err := op.verifyZero(); err != nil {
+			return err
+		}
 	case metadata.InstallOperation_BSDIFF:
-		return fmt.Errorf("BSDIFF")
+		if err := op.verifyOffset(); err != nil {
+			return err
+		}
+		if err := op.verifyBsdiff(); err != nil {
+			return err
+		}
+		if _, err := io.Copy(ioutil.Discard, op); err != nil {
+			return err
+		}
+		if err := op.verifyHash(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (op *Operation) verifyMove() error {
+	if op.Operation.GetDataLength() != 0 {
+		return fmt.Errorf("move contains %d bytes of data", op.Operation.GetDataLength())
+	}
+	src := extentBlocks(op.Operation.SrcExtents)
+	dst := extentBlocks(op.Operation.DstExtents)
+	if src != dst {
+		return fmt.Errorf("move source is %d blocks but destination is %d blocks", src, dst)
+	}
+	return nil
+}
+
+func (op *Operation) verifyZero() error {
+	if op.Operation.GetDataLength() != 0 {
+		return fmt.Errorf("%s contains %d bytes of data",
+			op.Operation.GetType(), op.Operation.GetDataLength())
+	}
+	if len(op.Operation.SrcExtents) != 0 {
+		return fmt.Errorf("%s contains source extents", op.Operation.GetType())
 	}
+	return nil
+}
 
+func (op *Operation) verifyBsdiff() error {
+	bs := uint64(op.Payload.Manifest.GetBlockSize())
+	if src := extentBlocks(op.Operation.SrcExtents) * bs; op.Operation.GetSrcLength() > src {
+		return fmt.Errorf("bsdiff source length %d exceeds source extents of %d bytes",
+			op.Operation.GetSrcLength(), src)
+	}
+	if dst := extentBlocks(op.Operation.DstExtents) * bs; op.Operation.GetDstLength() > dst {
+		return fmt.Errorf("bsdiff destination length %d exceeds destination extents of %d bytes",
+			op.Operation.GetDstLength(), dst)
+	}
 	return nil
 }
 
+func extentBlocks(extents []*metadata.Extent) uint64 {
+	var blocks uint64
+	for _, extent := range extents {
+		blocks += extent.GetNumBlocks()
+	}
+	return blocks
+}
+
 func (op *Operation) verifyOffset() error {
 	if int64(op.Operation.GetDataOffset()) != op.Payload.Offset {
 		return fmt.Errorf("expected payload data offset %d not %d",
-			op.Operation.DataOffset, op.Payload.Offset)
+			op.Operation.GetDataOffset(), op.Payload.Offset)
 	}
 	return nil
 }
@@ -104,6 +177,12 @@ func (op *Operation) Apply(dst, src *os.File) error {
 		return op.replace(dst, op)
 	case metadata.InstallOperation_REPLACE_BZ:
 		return op.replace(dst, bzip2.NewReader(op))
+	case metadata.InstallOperation_REPLACE_XZ:
+		return op.replaceXz(dst)
+	case metadata.InstallOperation_ZERO:
+		return op.zero(dst)
+	case metadata.InstallOperation_DISCARD:
+		return op.discard(dst)
 	case metadata.InstallOperation_MOVE:
 		return op.move(dst, src)
 	case metadata.InstallOperation_BSDIFF:
@@ -113,13 +192,23 @@ func (op *Operation) Apply(dst, src *os.File) error {
 }
 
 func (op *Operation) replace(dst *os.File, src io.Reader) error {
+	if err := op.verifyReplace(); err != nil {
+		return err
+	}
+	return op.writeReplace(dst, src)
+}
+
+func (op *Operation) verifyReplace() error {
 	if err := op.verifyOffset(); err != nil {
 		return err
 	}
 	if len(op.Operation.SrcExtents) != 0 {
 		return fmt.Errorf("replace contains source extents")
 	}
+	return nil
+}
 
+func (op *Operation) writeReplace(dst *os.File, src io.Reader) error {
 	bs := int64(op.Payload.Manifest.GetBlockSize())
 	maxSize := int64(op.Procedure.NewInfo.GetSize())
 	for _, extent := range op.Operation.DstExtents {
@@ -149,12 +238,21 @@ func (op *Operation) replace(dst *os.File, src io.Reader) error {
 	// are there due to a difference in implementation of bzip2 itself or
 	// simply due to the algorithm being driven by reads instead of writes.
 	if op.N != 0 {
-		if op.Operation.GetType() == metadata.InstallOperation_REPLACE_BZ {
+		switch op.Operation.GetType() {
+		case metadata.InstallOperation_REPLACE_BZ:
 			plog.Warningf("Go's bzip2 left %d bytes unread!", op.N)
 			if _, err := io.Copy(ioutil.Discard, op); err != nil {
 				return err
 			}
-		} else {
+		case metadata.InstallOperation_REPLACE_XZ:
+			// The end of the xz stream hasn't been read yet, it
+			// must not contain more data.
+			if n, err := io.Copy(ioutil.Discard, src); err != nil {
+				return err
+			} else if n != 0 {
+				return fmt.Errorf("replace left %d trailing bytes", n)
+			}
+		default:
 			return fmt.Errorf("replace left %d trailing bytes", op.N)
 		}
 	}
@@ -162,10 +260,160 @@ func (op *Operation) replace(dst *os.File, src io.Reader) error {
 	return op.verifyHash()
 }
 
+func (op *Operation) replaceXz(dst *os.File) error {
+	// Unlike bzip2 the xz reader consumes the stream header right
+	// away, check the operation before that happens.
+	if err := op.verifyReplace(); err != nil {
+		return err
+	}
+	r, err := xz.NewReader(op)
+	if err != nil {
+		return err
+	}
+	return op.writeReplace(dst, r)
+}
+
+func (op *Operation) zero(dst *os.File) error {
+	if err := op.verifyZero(); err != nil {
+		return err
+	}
+
+	bs := op.Payload.Manifest.GetBlockSize()
+	zeros := make([]byte, bs)
+	for _, extent := range op.Operation.DstExtents {
+		if extent.GetStartBlock() == sparseHole {
+			continue
+		}
+		for i := uint64(0); i < extent.GetNumBlocks(); i++ {
+			offset := int64(extent.GetStartBlock()+i) * int64(bs)
+			if _, err := dst.WriteAt(zeros, offset); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// discard leaves the content of the destination extents undefined, it
+// only makes sure the destination covers them.
+func (op *Operation) discard(dst *os.File) error {
+	if err := op.verifyZero(); err != nil {
+		return err
+	}
+
+	info, err := dst.Stat()
+	if err != nil {
+		return err
+	}
+
+	bs := int64(op.Payload.Manifest.GetBlockSize())
+	size := info.Size()
+	for _, extent := range op.Operation.DstExtents {
+		if extent.GetStartBlock() == sparseHole {
+			continue
+		}
+		end := int64(extent.GetStartBlock()+extent.GetNumBlocks()) * bs
+		if end > size {
+			size = end
+		}
+	}
+	if size != info.Size() {
+		return dst.Truncate(size)
+	}
+	return nil
+}
+
 func (op *Operation) move(dst, src *os.File) error {
-	return fmt.Errorf("MOVE")
+	if src == nil {
+		return fmt.Errorf("move requires a source partition")
+	}
+	if err := op.verifyMove(); err != nil {
+		return err
+	}
+
+	// All source data is read before writing any of it, as
+	// update_engine does, so the result doesn't depend on the order of
+	// the extents even if the source and destination are the same file.
+	data, err := op.readExtents(src, op.Operation.SrcExtents)
+	if err != nil {
+		return err
+	}
+	return op.writeExtents(dst, op.Operation.DstExtents, data)
 }
 
 func (op *Operation) bsdiff(dst, src *os.File) error {
-	return fmt.Errorf("BSDIFF")
+	if src == nil {
+		return fmt.Errorf("bsdiff requires a source partition")
+	}
+	if err := op.verifyOffset(); err != nil {
+		return err
+	}
+	if err := op.verifyBsdiff(); err != nil {
+		return err
+	}
+
+	patch := make([]byte, op.Operation.GetDataLength())
+	if _, err := io.ReadFull(op, patch); err != nil {
+		return err
+	}
+	if err := op.verifyHash(); err != nil {
+		return err
+	}
+
+	old, err := op.readExtents(src, op.Operation.SrcExtents)
+	if err != nil {
+		return err
+	}
+	old = old[:op.Operation.GetSrcLength()]
+
+	data, err := bsdiff.Patch(old, patch)
+	if err != nil {
+		return err
+	}
+	if uint64(len(data)) != op.Operation.GetDstLength() {
+		return fmt.Errorf("bsdiff produced %d bytes, expected %d",
+			len(data), op.Operation.GetDstLength())
+	}
+
+	// The rest of the last destination block is filled with zeros.
+	bs := uint64(op.Payload.Manifest.GetBlockSize())
+	padded := make([]byte, extentBlocks(op.Operation.DstExtents)*bs)
+	copy(padded, data)
+	return op.writeExtents(dst, op.Operation.DstExtents, padded)
+}
+
+// readExtents returns the concatenated data of the extents in src.
+func (op *Operation) readExtents(src *os.File, extents []*metadata.Extent) ([]byte, error) {
+	bs := int64(op.Payload.Manifest.GetBlockSize())
+	data := make([]byte, int64(extentBlocks(extents))*bs)
+	pos := int64(0)
+	for _, extent := range extents {
+		length := int64(extent.GetNumBlocks()) * bs
+		if extent.GetStartBlock() != sparseHole {
+			offset := int64(extent.GetStartBlock()) * bs
+			if _, err := src.ReadAt(data[pos:pos+length], offset); err != nil {
+				return nil, fmt.Errorf("reading source extent at block %d: %v",
+					extent.GetStartBlock(), err)
+			}
+		}
+		pos += length
+	}
+	return data, nil
+}
+
+// writeExtents writes data, which must cover all extents, to dst.
+func (op *Operation) writeExtents(dst *os.File, extents []*metadata.Extent, data []byte) error {
+	bs := int64(op.Payload.Manifest.GetBlockSize())
+	pos := int64(0)
+	for _, extent := range extents {
+		length := int64(extent.GetNumBlocks()) * bs
+		if extent.GetStartBlock() != sparseHole {
+			offset := int64(extent.GetStartBlock()) * bs
+			if _, err := dst.WriteAt(data[pos:pos+length], offset); err != nil {
+				return err
+			}
+		}
+		pos += length
+	}
+	return nil
 }
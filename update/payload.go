@@ -52,6 +52,10 @@ type Payload struct {
 	Header     metadata.DeltaArchiveHeader
 	Manifest   metadata.DeltaArchiveManifest
 	Signatures metadata.Signatures
+
+	// Verifiers check the signatures of the payload, if empty the
+	// developer key is used.
+	Verifiers []signature.Verifier
 }
 
 func NewPayloadFrom(r io.Reader) (*Payload, error) {
@@ -147,7 +151,7 @@ func (p *Payload) VerifySignature() error {
 		return err
 	}
 
-	if err := signature.VerifySignature(sum, &p.Signatures); err != nil {
+	if err := signature.VerifySignature(sum, &p.Signatures, p.Verifiers...); err != nil {
 		return err
 	}
 
@@ -0,0 +1,199 @@
+// Copyright The Mantle Authors.
+// SPDX-License-Identifier: Apache-2.0
+
+package signature
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// Signer signs the hash of a payload.
+type Signer interface {
+	// Sign returns the signature of the hash.
+	Sign(sum []byte) ([]byte, error)
+	// Size returns the length of the signatures Sign returns, it must
+	// be known before the payload can be hashed.
+	Size() int
+}
+
+// Verifier checks the signature of the hash of a payload.
+type Verifier interface {
+	Verify(sum, sig []byte) error
+}
+
+type keySigner struct {
+	key *rsa.PrivateKey
+}
+
+// NewKeySigner returns a Signer using the given private key.
+func NewKeySigner(key *rsa.PrivateKey) Signer {
+	return &keySigner{key}
+}
+
+func (s *keySigner) Sign(sum []byte) ([]byte, error) {
+	return rsa.SignPKCS1v15(rand.Reader, s.key, signatureHash, sum)
+}
+
+func (s *keySigner) Size() int {
+	return s.key.Size()
+}
+
+type keyVerifier struct {
+	name string
+	key  *rsa.PublicKey
+}
+
+// NewKeyVerifier returns a Verifier using the given public key, name
+// identifies the key in log messages.
+func NewKeyVerifier(name string, key *rsa.PublicKey) Verifier {
+	return &keyVerifier{name, key}
+}
+
+func (v *keyVerifier) Verify(sum, sig []byte) error {
+	return rsa.VerifyPKCS1v15(v.key, signatureHash, sum, sig)
+}
+
+func (v *keyVerifier) String() string {
+	return v.name
+}
+
+type commandSigner struct {
+	command []string
+	key     *rsa.PublicKey
+}
+
+// NewCommandSigner returns a Signer running an external command, e.g. to
+// sign with a key kept in an HSM. The command gets the hash on stdin and
+// must write the raw PKCS #1 v1.5 signature to stdout. Signatures are
+// checked against the public key, which also provides their size.
+func NewCommandSigner(command []string, key *rsa.PublicKey) Signer {
+	return &commandSigner{command, key}
+}
+
+func (s *commandSigner) Sign(sum []byte) ([]byte, error) {
+	if len(s.command) == 0 {
+		return nil, fmt.Errorf("missing signing command")
+	}
+
+	var stdout bytes.Buffer
+	cmd := exec.Command(s.command[0], s.command[1:]...)
+	cmd.Stdin = bytes.NewReader(sum)
+	cmd.Stdout = &stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("signing command %q: %v", strings.Join(s.command, " "), err)
+	}
+
+	sig := stdout.Bytes()
+	if err := rsa.VerifyPKCS1v15(s.key, signatureHash, sum, sig); err != nil {
+		return nil, fmt.Errorf("signing command %q returned a bad signature: %v",
+			strings.Join(s.command, " "), err)
+	}
+	return sig, nil
+}
+
+func (s *commandSigner) Size() int {
+	return s.key.Size()
+}
+
+// DeveloperSigner returns the Signer of the developer key, which is used
+// when no other signers are given.
+func DeveloperSigner() Signer {
+	key, err := ParsePrivateKey([]byte(developerSecKey))
+	if err != nil {
+		panic(err)
+	}
+	return NewKeySigner(key)
+}
+
+// DeveloperVerifier returns the Verifier of the developer key, which is
+// used when no other verifiers are given.
+func DeveloperVerifier() Verifier {
+	key, err := ParsePublicKey([]byte(DeveloperPublicKey))
+	if err != nil {
+		panic(err)
+	}
+	return NewKeyVerifier("dev key", key)
+}
+
+// ParsePrivateKey parses a PEM encoded PKCS #1 or PKCS #8 RSA private key.
+func ParsePrivateKey(data []byte) (*rsa.PrivateKey, error) {
+	pemBlock, _ := pem.Decode(data)
+	if pemBlock == nil {
+		return nil, fmt.Errorf("unable to parse key")
+	}
+
+	if key, err := x509.ParsePKCS1PrivateKey(pemBlock.Bytes); err == nil {
+		return key, nil
+	}
+
+	someKey, err := x509.ParsePKCS8PrivateKey(pemBlock.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	rsaKey, ok := someKey.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("unexpected key type %T", someKey)
+	}
+	return rsaKey, nil
+}
+
+// ParsePublicKey parses a PEM encoded PKIX or PKCS #1 RSA public key.
+func ParsePublicKey(data []byte) (*rsa.PublicKey, error) {
+	pemBlock, _ := pem.Decode(data)
+	if pemBlock == nil {
+		return nil, fmt.Errorf("unable to parse key")
+	}
+
+	if key, err := x509.ParsePKCS1PublicKey(pemBlock.Bytes); err == nil {
+		return key, nil
+	}
+
+	somePub, err := x509.ParsePKIXPublicKey(pemBlock.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	rsaPub, ok := somePub.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("unexpected key type %T", somePub)
+	}
+	return rsaPub, nil
+}
+
+// ReadPrivateKey reads a PEM encoded RSA private key from a file.
+func ReadPrivateKey(path string) (*rsa.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := ParsePrivateKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return key, nil
+}
+
+// ReadPublicKey reads a PEM encoded RSA public key from a file.
+func ReadPublicKey(path string) (*rsa.PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := ParsePublicKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return key, nil
+}
@@ -0,0 +1,119 @@
+// Copyright The Mantle Authors.
+// SPDX-License-Identifier: Apache-2.0
+
+package signature
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+)
+
+func generateKey(t *testing.T) *rsa.PrivateKey {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestMultipleSignatures(t *testing.T) {
+	oldKey := generateKey(t)
+	newKey := generateKey(t)
+	signers := []Signer{NewKeySigner(oldKey), NewKeySigner(newKey)}
+
+	sigs, err := Sign(testHash, signers...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(sigs.Signatures) != 2 {
+		t.Fatalf("Unexpected: %s", sigs)
+	}
+
+	size, err := SignaturesSize(signers...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if proto.Size(sigs) != size {
+		t.Errorf("sig size is %d not %d", proto.Size(sigs), size)
+	}
+
+	// clients with either key accept the payload
+	for _, key := range []*rsa.PrivateKey{oldKey, newKey} {
+		if err := VerifySignature(testHash, sigs, NewKeyVerifier("test key", &key.PublicKey)); err != nil {
+			t.Error(err)
+		}
+	}
+
+	if err := VerifySignature(testHash, sigs); err == nil {
+		t.Error("signatures verified with the developer key")
+	}
+}
+
+func TestParseKeys(t *testing.T) {
+	key := generateKey(t)
+
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsedKey, err := ParsePrivateKey(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !parsedKey.Equal(key) {
+		t.Error("PKCS #8 private key not parsed correctly")
+	}
+
+	pkcs1 := x509.MarshalPKCS1PublicKey(&key.PublicKey)
+	parsedPub, err := ParsePublicKey(pem.EncodeToMemory(&pem.Block{Type: "RSA PUBLIC KEY", Bytes: pkcs1}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !parsedPub.Equal(&key.PublicKey) {
+		t.Error("PKCS #1 public key not parsed correctly")
+	}
+
+	if _, err := ParsePublicKey([]byte("garbage")); err == nil {
+		t.Error("garbage parsed as a key")
+	}
+}
+
+func TestCommandSigner(t *testing.T) {
+	openssl, err := exec.LookPath("openssl")
+	if err != nil {
+		t.Skip(err)
+	}
+
+	key := generateKey(t)
+	keyPath := filepath.Join(t.TempDir(), "key.pem")
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	if err := os.WriteFile(keyPath, keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	signer := NewCommandSigner([]string{openssl, "pkeyutl", "-sign",
+		"-inkey", keyPath, "-pkeyopt", "digest:sha256"}, &key.PublicKey)
+	sigs, err := Sign(testHash, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := VerifySignature(testHash, sigs, NewKeyVerifier("test key", &key.PublicKey)); err != nil {
+		t.Error(err)
+	}
+
+	// a command signing with another key is caught
+	bad := NewCommandSigner(signer.(*commandSigner).command, &generateKey(t).PublicKey)
+	if _, err := Sign(testHash, bad); err == nil {
+		t.Error("bad signature accepted")
+	}
+}
@@ -16,11 +16,7 @@ package signature
 
 import (
 	"crypto"
-	"crypto/rand"
-	"crypto/rsa"
 	_ "crypto/sha256"
-	"crypto/x509"
-	"encoding/pem"
 	"fmt"
 	"hash"
 
@@ -33,7 +29,9 @@ import (
 const (
 	signatureVersion = 2
 	signatureHash    = crypto.SHA256
-	developerPubKey  = `
+
+	// DeveloperPublicKey is the public part of the developer key.
+	DeveloperPublicKey = `
 -----BEGIN PUBLIC KEY-----
 MIIBIjANBgkqhkiG9w0BAQEFAAOCAQ8AMIIBCgKCAQEAzFS5uVJ+pgibcFLD3kbY
 k02Edj0HXq31ZT/Bva1sLp3Ysv+QTv/ezjf0gGFfASdgpz6G+zTipS9AIrQr0yFR
@@ -82,83 +80,62 @@ func NewSignatureHash() hash.Hash {
 	return signatureHash.New()
 }
 
-func keySize() (int, error) {
-	pemBlock, _ := pem.Decode([]byte(developerPubKey))
-	if pemBlock == nil {
-		return 0, fmt.Errorf("unable to parse key")
-	}
-
-	somePub, err := x509.ParsePKIXPublicKey(pemBlock.Bytes)
-	if err != nil {
-		return 0, err
+// SignaturesSize returns the size of the signatures Sign creates with the
+// given signers, or with the developer key if there are none.
+func SignaturesSize(signers ...Signer) (int, error) {
+	if len(signers) == 0 {
+		signers = []Signer{DeveloperSigner()}
 	}
 
-	rsaPub, ok := somePub.(*rsa.PublicKey)
-	if !ok {
-		return 0, fmt.Errorf("unexpected key type %T", somePub)
+	sizes := make([]int, len(signers))
+	for i, signer := range signers {
+		sizes[i] = signer.Size()
 	}
-
-	// This is how the rsa package computes key length.
-	return (rsaPub.N.BitLen() + 7) / 8, nil
+	return signaturesSize(sizes), nil
 }
 
-func SignaturesSize() (int, error) {
-	dataLen, err := keySize()
-	if err != nil {
-		return 0, err
+func signaturesSize(sizes []int) int {
+	sigs := &metadata.Signatures{}
+	for _, size := range sizes {
+		sigs.Signatures = append(sigs.Signatures, &metadata.Signatures_Signature{
+			Version: proto.Uint32(signatureVersion),
+			Data:    make([]byte, size),
+		})
 	}
-	data := make([]byte, dataLen)
-	sigs := &metadata.Signatures{
-		Signatures: []*metadata.Signatures_Signature{
-			&metadata.Signatures_Signature{
-				Version: proto.Uint32(signatureVersion),
-				Data:    data,
-			},
-		},
-	}
-	return proto.Size(sigs), nil
+	return proto.Size(sigs)
 }
 
-func Sign(sum []byte) (*metadata.Signatures, error) {
-	pemBlock, _ := pem.Decode([]byte(developerSecKey))
-	if pemBlock == nil {
-		return nil, fmt.Errorf("unable to parse key")
-	}
-
-	rsaKey, err := x509.ParsePKCS1PrivateKey(pemBlock.Bytes)
-	if err != nil {
-		return nil, err
+// Sign signs the hash with each of the signers, or with the developer key
+// if there are none. Multiple signatures allow rotating keys: clients
+// accept the payload if any of the signatures is good.
+func Sign(sum []byte, signers ...Signer) (*metadata.Signatures, error) {
+	if len(signers) == 0 {
+		signers = []Signer{DeveloperSigner()}
 	}
 
-	sig, err := rsa.SignPKCS1v15(rand.Reader, rsaKey, signatureHash, sum)
-	if err != nil {
-		return nil, err
+	sigs := &metadata.Signatures{}
+	for i, signer := range signers {
+		sig, err := signer.Sign(sum)
+		if err != nil {
+			return nil, err
+		}
+		if len(sig) != signer.Size() {
+			return nil, fmt.Errorf("signature %d is %d bytes, expected %d",
+				i, len(sig), signer.Size())
+		}
+		sigs.Signatures = append(sigs.Signatures, &metadata.Signatures_Signature{
+			Version: proto.Uint32(signatureVersion),
+			Data:    sig,
+		})
 	}
-
-	return &metadata.Signatures{
-		Signatures: []*metadata.Signatures_Signature{
-			&metadata.Signatures_Signature{
-				Version: proto.Uint32(signatureVersion),
-				Data:    sig,
-			},
-		},
-	}, nil
+	return sigs, nil
 }
 
-func VerifySignature(sum []byte, sigs *metadata.Signatures) error {
-	pemBlock, _ := pem.Decode([]byte(developerPubKey))
-	if pemBlock == nil {
-		return fmt.Errorf("unable to parse key")
-	}
-
-	somePub, err := x509.ParsePKIXPublicKey(pemBlock.Bytes)
-	if err != nil {
-		return err
-	}
-
-	rsaPub, ok := somePub.(*rsa.PublicKey)
-	if !ok {
-		return fmt.Errorf("unexpected key type %T", somePub)
+// VerifySignature checks that at least one of the signatures is good for
+// one of the verifiers, or for the developer key if there are none.
+func VerifySignature(sum []byte, sigs *metadata.Signatures, verifiers ...Verifier) error {
+	if len(verifiers) == 0 {
+		verifiers = []Verifier{DeveloperVerifier()}
 	}
 
 	for _, sig := range sigs.Signatures {
@@ -168,13 +145,14 @@ func VerifySignature(sum []byte, sigs *metadata.Signatures) error {
 			continue
 		}
 
-		if err := rsa.VerifyPKCS1v15(rsaPub, signatureHash, sum, sig.Data); err != nil {
-			plog.Debugf("Cannot verify v%d signature with dev key", v)
-		} else {
-			plog.Infof("Good v%d signature by dev key", v)
-			return nil
+		for _, verifier := range verifiers {
+			if err := verifier.Verify(sum, sig.Data); err != nil {
+				plog.Debugf("Cannot verify v%d signature with %v", v, verifier)
+			} else {
+				plog.Infof("Good v%d signature by %v", v, verifier)
+				return nil
+			}
 		}
-
 	}
 
 	return fmt.Errorf("no valid signatures found")
@@ -69,12 +69,7 @@ func init() {
 }
 
 func TestKeySize(t *testing.T) {
-	n, err := keySize()
-	if err != nil {
-		t.Fatal(err)
-	}
-
-	if n != developerKeyBytes {
+	if n := DeveloperSigner().Size(); n != developerKeyBytes {
 		t.Errorf("key size is %d not %d", n, developerKeyBytes)
 	}
 }
@@ -25,6 +25,7 @@ import (
 	"github.com/golang/protobuf/proto"
 
 	"github.com/flatcar/mantle/update/metadata"
+	"github.com/flatcar/mantle/update/signature"
 )
 
 var (
@@ -35,6 +36,14 @@ type Updater struct {
 	SrcPartition string
 	DstPartition string
 
+	// Kernel files updated by a kernel procedure in the payload.
+	SrcKernel string
+	DstKernel string
+
+	// Verifiers check the signatures of the payload, if empty the
+	// developer key is used.
+	Verifiers []signature.Verifier
+
 	payload *Payload
 }
 
@@ -51,7 +60,11 @@ func (u *Updater) OpenPayload(file string) error {
 
 func (u *Updater) UsePayload(r io.Reader) (err error) {
 	u.payload, err = NewPayloadFrom(r)
-	return err
+	if err != nil {
+		return err
+	}
+	u.payload.Verifiers = u.Verifiers
+	return nil
 }
 
 func (u *Updater) Update() error {
@@ -77,7 +90,10 @@ func (u *Updater) UpdatePartition(proc *metadata.InstallProcedure) error {
 }
 
 func (u *Updater) UpdateKernel(proc *metadata.InstallProcedure) error {
-	return fmt.Errorf("KERNEL")
+	if u.DstKernel == "" {
+		return fmt.Errorf("payload updates the kernel but no kernel destination is set")
+	}
+	return u.updateCommon(proc, "kernel", u.SrcKernel, u.DstKernel)
 }
 
 func (u *Updater) updateCommon(proc *metadata.InstallProcedure, procName, srcPath, dstPath string) (err error) {
@@ -93,7 +109,7 @@ func (u *Updater) updateCommon(proc *metadata.InstallProcedure, procName, srcPat
 		}
 	}
 
-	dstFile, err = os.OpenFile(u.DstPartition, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+	dstFile, err = os.OpenFile(dstPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
 	if err != nil {
 		return err
 	}